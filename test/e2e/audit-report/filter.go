@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zalando-incubator/kubernetes-on-aws/tests/e2e/utils"
+)
+
+// filter selects the events included in the report. Every field is a list of
+// alternatives, an empty list matches every event. An event must match all
+// fields.
+type filter struct {
+	// users and groups match the authenticated as well as the impersonated
+	// user.
+	users      []string
+	groups     []string
+	namespaces []string
+	resources  []string
+	verbs      []string
+	codes      []codeMatcher
+	// since and until limit the time the request was received, zero values
+	// don't limit it.
+	since, until time.Time
+}
+
+// codeMatcher matches a response code, either exactly or its class, e.g. 4xx.
+type codeMatcher struct {
+	code  int32
+	class bool
+}
+
+func (m codeMatcher) matches(code int32) bool {
+	if m.class {
+		return code/100 == m.code
+	}
+	return code == m.code
+}
+
+// parseCodes parses a comma-separated list of response codes or classes,
+// e.g. 403,5xx.
+func parseCodes(value string) ([]codeMatcher, error) {
+	var codes []codeMatcher
+	for _, code := range splitList(value) {
+		matcher := codeMatcher{}
+		if class, ok := strings.CutSuffix(strings.ToLower(code), "xx"); ok {
+			matcher.class = true
+			code = class
+		}
+
+		parsed, err := strconv.ParseInt(code, 10, 32)
+		if err != nil || parsed < 0 || (matcher.class && parsed > 9) {
+			return nil, fmt.Errorf("invalid response code %q, must be a code or a class like 4xx", code)
+		}
+		matcher.code = int32(parsed)
+		codes = append(codes, matcher)
+	}
+	return codes, nil
+}
+
+// parseTime parses an RFC3339 time, or a duration which is subtracted from
+// now, e.g. 2h for two hours ago. An empty value is the zero time.
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, must be RFC3339 or a duration", value)
+	}
+	return t, nil
+}
+
+// splitList splits a comma-separated list, ignoring empty values.
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// matches returns true if the event, received at the time, is selected by the
+// filter.
+func (f *filter) matches(event utils.AuditEvent, received time.Time) bool {
+	if len(f.users) > 0 && !slices.Contains(f.users, event.User.Username) && !slices.Contains(f.users, event.ImpersonatedUser) {
+		return false
+	}
+	if len(f.groups) > 0 && !slices.ContainsFunc(f.groups, func(group string) bool { return inGroup(event, group) }) {
+		return false
+	}
+	if len(f.namespaces) > 0 && !slices.Contains(f.namespaces, event.Namespace) {
+		return false
+	}
+	if len(f.resources) > 0 && !slices.Contains(f.resources, event.Resource) {
+		return false
+	}
+	if len(f.verbs) > 0 && !slices.Contains(f.verbs, event.Verb) {
+		return false
+	}
+	if len(f.codes) > 0 && !slices.ContainsFunc(f.codes, func(m codeMatcher) bool { return m.matches(event.Code) }) {
+		return false
+	}
+	if !f.since.IsZero() && received.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !received.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+// inGroup returns true if the authenticated or the impersonated user of the
+// event is in the group.
+func inGroup(event utils.AuditEvent, group string) bool {
+	return slices.Contains(event.User.Groups, group) || slices.Contains(splitList(event.ImpersonatedGroups), group)
+}
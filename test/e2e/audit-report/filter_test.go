@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zalando-incubator/kubernetes-on-aws/tests/e2e/utils"
+	authnv1 "k8s.io/api/authentication/v1"
+)
+
+func TestFilter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	event := utils.AuditEvent{
+		Verb:               "delete",
+		Code:               403,
+		User:               authnv1.UserInfo{Username: "alice", Groups: []string{"PowerUser"}},
+		ImpersonatedUser:   "bob",
+		ImpersonatedGroups: "Emergency,ReadOnly",
+		Resource:           "pods",
+		Namespace:          "teapot",
+	}
+	received := now.Add(-time.Hour)
+
+	for _, tc := range []struct {
+		name    string
+		filter  []string
+		matches bool
+	}{
+		{name: "no filter", matches: true},
+		{name: "authenticated user", filter: []string{"alice"}, matches: true},
+		{name: "impersonated user", filter: []string{"carol,bob"}, matches: true},
+		{name: "other user", filter: []string{"carol"}},
+		{name: "authenticated group", filter: []string{"", "PowerUser"}, matches: true},
+		{name: "impersonated group", filter: []string{"", "Emergency"}, matches: true},
+		{name: "other group", filter: []string{"", "Administrator"}},
+		{name: "namespace and resource", filter: []string{"", "", "kube-system,teapot", "pods"}, matches: true},
+		{name: "other resource", filter: []string{"", "", "teapot", "secrets"}},
+		{name: "other verb", filter: []string{"", "", "", "", "create,update"}},
+		{name: "code class", filter: []string{"", "", "", "", "", "200,4xx"}, matches: true},
+		{name: "other code", filter: []string{"", "", "", "", "", "401,5xx"}},
+		{name: "relative time range", filter: []string{"", "", "", "", "", "", "2h", "30m"}, matches: true},
+		{name: "received before", filter: []string{"", "", "", "", "", "", "30m"}},
+		{name: "received at until", filter: []string{"", "", "", "", "", "", "", "2024-01-01T11:00:00Z"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			values := make([]string, 8)
+			copy(values, tc.filter)
+
+			f, err := newFilter(values[0], values[1], values[2], values[3], values[4], values[5], values[6], values[7], now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if matches := f.matches(event, received); matches != tc.matches {
+				t.Errorf("expected match %t, got %t", tc.matches, matches)
+			}
+		})
+	}
+}
+
+func TestNewFilterErrors(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name                string
+		codes, since, until string
+	}{
+		{name: "invalid code", codes: "forbidden"},
+		{name: "invalid class", codes: "40xx"},
+		{name: "invalid time", since: "yesterday"},
+		{name: "empty range", since: "1h", until: "2h"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newFilter("", "", "", "", "", tc.codes, tc.since, tc.until, now); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
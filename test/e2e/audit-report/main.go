@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/zalando-incubator/kubernetes-on-aws/tests/e2e/utils"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// defaultEmergencyGroups are the groups of the emergency access roles.
+const defaultEmergencyGroups = "Emergency,CollaboratorEmergency"
+
+func main() {
+	users := flag.String("user", "", "Comma-separated usernames to include, matching the authenticated or the impersonated user.")
+	groups := flag.String("group", "", "Comma-separated groups to include, matching the groups of the authenticated or the impersonated user.")
+	namespaces := flag.String("namespace", "", "Comma-separated namespaces to include.")
+	resources := flag.String("resource", "", "Comma-separated resources to include, e.g. pods,secrets.")
+	verbs := flag.String("verb", "", "Comma-separated verbs to include, e.g. create,delete.")
+	codes := flag.String("code", "", "Comma-separated response codes or classes to include, e.g. 403,5xx.")
+	since := flag.String("since", "", "Only include requests received at or after this time, either RFC3339 or a duration before now (e.g. 2h).")
+	until := flag.String("until", "", "Only include requests received before this time, either RFC3339 or a duration before now (e.g. 30m).")
+	emergencyGroups := flag.String("emergency-groups", defaultEmergencyGroups, "Comma-separated groups whose activity is reported as emergency-group activity.")
+	top := flag.Int("top", 20, "Maximum number of rows per table (0 means no limit).")
+	output := flag.String("output", outputTable, "Output format of the report (table or json).")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [audit log files...]\n\nReads audit.k8s.io/v1 events, one per line, from the files or stdin.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	f, err := newFilter(*users, *groups, *namespaces, *resources, *verbs, *codes, *since, *until, time.Now())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	builder := newReportBuilder(f, splitList(*emergencyGroups))
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, file := range files {
+		if err := readAuditLog(file, builder); err != nil {
+			log.Fatalf("Failed to read audit log %s: %v", file, err)
+		}
+	}
+
+	if err := writeReport(os.Stdout, *output, builder.build(*top)); err != nil {
+		log.Fatalf("Failed to write report: %v", err)
+	}
+}
+
+// newFilter returns the filter of the flag values.
+func newFilter(users, groups, namespaces, resources, verbs, codes, since, until string, now time.Time) (*filter, error) {
+	f := &filter{
+		users:      splitList(users),
+		groups:     splitList(groups),
+		namespaces: splitList(namespaces),
+		resources:  splitList(resources),
+		verbs:      splitList(verbs),
+	}
+
+	var err error
+	if f.codes, err = parseCodes(codes); err != nil {
+		return nil, err
+	}
+	if f.since, err = parseTime(since, now); err != nil {
+		return nil, err
+	}
+	if f.until, err = parseTime(until, now); err != nil {
+		return nil, err
+	}
+	if !f.since.IsZero() && !f.until.IsZero() && !f.since.Before(f.until) {
+		return nil, fmt.Errorf("since (%s) must be before until (%s)", formatTime(f.since), formatTime(f.until))
+	}
+	return f, nil
+}
+
+// readAuditLog adds the events of the audit log file to the report, or of
+// stdin if file is -. Lines which can't be decoded are skipped.
+func readAuditLog(file string, builder *reportBuilder) error {
+	var reader io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		reader = f
+	}
+
+	skipped := 0
+	_, err := utils.ScanAuditLinesSkipping(reader, auditv1.SchemeGroupVersion, builder.observe, func(err *utils.AuditLineError) {
+		if skipped == 0 {
+			log.Printf("Skipping invalid lines of audit log %s, the first one: %v", file, err)
+		}
+		skipped++
+		builder.skip(err)
+	})
+	if skipped > 1 {
+		log.Printf("Skipped %d invalid lines of audit log %s", skipped, file)
+	}
+	return err
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zalando-incubator/kubernetes-on-aws/tests/e2e/utils"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+
+	decisionForbid   = "forbid"
+	reasonAnnotation = "authorization.k8s.io/reason"
+)
+
+// Report is the aggregated activity of the events selected by the filter.
+// Only the events of the last stage of a request are counted, so that every
+// request is counted once. InvalidLines is the number of lines skipped
+// because they couldn't be decoded, e.g. the incomplete last line of a log
+// being written.
+type Report struct {
+	EventsRead    int        `json:"eventsRead"`
+	EventsMatched int        `json:"eventsMatched"`
+	InvalidLines  int        `json:"invalidLines"`
+	From          *time.Time `json:"from,omitempty"`
+	To            *time.Time `json:"to,omitempty"`
+
+	TopUsers          []UserActivity    `json:"topUsers"`
+	Denied            []RequestActivity `json:"denied"`
+	Impersonations    []Impersonation   `json:"impersonations"`
+	EmergencyActivity []RequestActivity `json:"emergencyActivity"`
+}
+
+// Activity is the number of requests and the time of the first and the last
+// one.
+type Activity struct {
+	Requests  int       `json:"requests"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+func (a *Activity) add(received time.Time) {
+	if a.Requests == 0 || received.Before(a.FirstSeen) {
+		a.FirstSeen = received
+	}
+	if a.Requests == 0 || received.After(a.LastSeen) {
+		a.LastSeen = received
+	}
+	a.Requests++
+}
+
+// UserActivity is the activity of an authenticated user.
+type UserActivity struct {
+	User string `json:"user"`
+	Activity
+	Denied int `json:"denied"`
+}
+
+// Request identifies the requests of a user with a verb on a resource in a
+// namespace. The code and the reason are only set for denied requests.
+type Request struct {
+	User             string `json:"user"`
+	ImpersonatedUser string `json:"impersonatedUser,omitempty"`
+	Verb             string `json:"verb"`
+	Resource         string `json:"resource,omitempty"`
+	Namespace        string `json:"namespace,omitempty"`
+	Code             int32  `json:"code,omitempty"`
+	Reason           string `json:"reason,omitempty"`
+}
+
+// user formats the user and the impersonated user, if any.
+func (r Request) user() string {
+	if r.ImpersonatedUser == "" {
+		return r.User
+	}
+	return fmt.Sprintf("%s (as %s)", r.User, r.ImpersonatedUser)
+}
+
+// RequestActivity is the activity of the requests.
+type RequestActivity struct {
+	Request
+	Activity
+}
+
+// Impersonator identifies a user impersonating another user.
+type Impersonator struct {
+	User               string `json:"user"`
+	ImpersonatedUser   string `json:"impersonatedUser"`
+	ImpersonatedGroups string `json:"impersonatedGroups,omitempty"`
+}
+
+// Impersonation is the activity of a user impersonating another user.
+type Impersonation struct {
+	Impersonator
+	Activity
+}
+
+// reportBuilder aggregates the events selected by the filter.
+type reportBuilder struct {
+	filter          *filter
+	emergencyGroups []string
+
+	report         Report
+	users          map[string]*Activity
+	usersDenied    map[string]int
+	denied         map[Request]*Activity
+	impersonations map[Impersonator]*Activity
+	emergency      map[Request]*Activity
+}
+
+func newReportBuilder(filter *filter, emergencyGroups []string) *reportBuilder {
+	return &reportBuilder{
+		filter:          filter,
+		emergencyGroups: emergencyGroups,
+		users:           map[string]*Activity{},
+		usersDenied:     map[string]int{},
+		denied:          map[Request]*Activity{},
+		impersonations:  map[Impersonator]*Activity{},
+		emergency:       map[Request]*Activity{},
+	}
+}
+
+// observe adds the event to the report if it's the last stage of a request
+// and selected by the filter.
+func (b *reportBuilder) observe(e *auditinternal.Event, event utils.AuditEvent) {
+	b.report.EventsRead++
+	if event.Stage != auditinternal.StageResponseComplete && event.Stage != auditinternal.StagePanic {
+		return
+	}
+
+	received := e.RequestReceivedTimestamp.Time
+	if !b.filter.matches(event, received) {
+		return
+	}
+
+	b.report.EventsMatched++
+	if b.report.From == nil || received.Before(*b.report.From) {
+		b.report.From = &received
+	}
+	if b.report.To == nil || received.After(*b.report.To) {
+		b.report.To = &received
+	}
+
+	denied := event.AuthorizeDecision == decisionForbid || event.Code == 403
+
+	addActivity(b.users, event.User.Username, received)
+	if denied {
+		b.usersDenied[event.User.Username]++
+	}
+
+	request := Request{
+		User:             event.User.Username,
+		ImpersonatedUser: event.ImpersonatedUser,
+		Verb:             event.Verb,
+		Resource:         event.Resource,
+		Namespace:        event.Namespace,
+	}
+	if event.Resource == "" {
+		request.Resource = event.RequestURI
+	}
+
+	if denied {
+		deniedRequest := request
+		deniedRequest.Code = event.Code
+		deniedRequest.Reason = e.Annotations[reasonAnnotation]
+		addActivity(b.denied, deniedRequest, received)
+	}
+
+	if event.ImpersonatedUser != "" {
+		addActivity(b.impersonations, Impersonator{
+			User:               event.User.Username,
+			ImpersonatedUser:   event.ImpersonatedUser,
+			ImpersonatedGroups: event.ImpersonatedGroups,
+		}, received)
+	}
+
+	if slices.ContainsFunc(b.emergencyGroups, func(group string) bool { return inGroup(event, group) }) {
+		addActivity(b.emergency, request, received)
+	}
+}
+
+// skip counts a line which couldn't be decoded.
+func (b *reportBuilder) skip(*utils.AuditLineError) {
+	b.report.InvalidLines++
+}
+
+// addActivity adds a request received at the time to the activity of the
+// key.
+func addActivity[K comparable](activities map[K]*Activity, key K, received time.Time) {
+	activity, ok := activities[key]
+	if !ok {
+		activity = &Activity{}
+		activities[key] = activity
+	}
+	activity.add(received)
+}
+
+// build returns the report with the most active entries first. Every table is
+// limited to top entries, unless top is 0.
+func (b *reportBuilder) build(top int) *Report {
+	report := b.report
+	report.TopUsers = sortedActivities(b.users, top, func(user string, activity Activity) UserActivity {
+		return UserActivity{User: user, Activity: activity, Denied: b.usersDenied[user]}
+	})
+	report.Denied = sortedActivities(b.denied, top, newRequestActivity)
+	report.Impersonations = sortedActivities(b.impersonations, top, func(impersonator Impersonator, activity Activity) Impersonation {
+		return Impersonation{Impersonator: impersonator, Activity: activity}
+	})
+	report.EmergencyActivity = sortedActivities(b.emergency, top, newRequestActivity)
+	return &report
+}
+
+func newRequestActivity(request Request, activity Activity) RequestActivity {
+	return RequestActivity{Request: request, Activity: activity}
+}
+
+// sortedActivities returns the entries of the activities with the most
+// requests first, and sorted by key otherwise.
+func sortedActivities[K comparable, T any](activities map[K]*Activity, top int, entry func(K, Activity) T) []T {
+	sorted := slices.Collect(maps.Keys(activities))
+	slices.SortFunc(sorted, func(a, b K) int {
+		if c := cmp.Compare(activities[b].Requests, activities[a].Requests); c != 0 {
+			return c
+		}
+		return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	})
+
+	if top > 0 && len(sorted) > top {
+		sorted = sorted[:top]
+	}
+
+	entries := make([]T, 0, len(sorted))
+	for _, key := range sorted {
+		entries = append(entries, entry(key, *activities[key]))
+	}
+	return entries
+}
+
+// writeReport writes the report to w in the specified output format.
+func writeReport(w io.Writer, output string, report *Report) error {
+	switch output {
+	case outputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case outputTable:
+		return writeReportTables(w, report)
+	default:
+		return fmt.Errorf("unknown output format %q", output)
+	}
+}
+
+func writeReportTables(w io.Writer, report *Report) error {
+	if _, err := fmt.Fprintf(w, "%d of %d events matched", report.EventsMatched, report.EventsRead); err != nil {
+		return err
+	}
+	if report.From != nil {
+		if _, err := fmt.Fprintf(w, ", from %s to %s", formatTime(*report.From), formatTime(*report.To)); err != nil {
+			return err
+		}
+	}
+	if report.InvalidLines > 0 {
+		if _, err := fmt.Fprintf(w, ", %d invalid lines skipped", report.InvalidLines); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintln(w); err != nil {
+		return err
+	}
+
+	sections := []struct {
+		title  string
+		header string
+		rows   []string
+	}{
+		{"TOP USERS", "USER\tDENIED\tREQUESTS\tFIRST-SEEN\tLAST-SEEN", rows(report.TopUsers, func(u UserActivity) string {
+			return fmt.Sprintf("%s\t%d\t%s", u.User, u.Denied, u.Activity)
+		})},
+		{"DENIED REQUESTS", "USER\tVERB\tNAMESPACE\tRESOURCE\tCODE\tREASON\tREQUESTS\tFIRST-SEEN\tLAST-SEEN", rows(report.Denied, func(r RequestActivity) string {
+			return fmt.Sprintf("%s\t%s\t%s\t%s\t%d\t%s\t%s", r.user(), r.Verb, orDash(r.Namespace), orDash(r.Resource), r.Code, orDash(r.Reason), r.Activity)
+		})},
+		{"IMPERSONATIONS", "USER\tIMPERSONATED-USER\tIMPERSONATED-GROUPS\tREQUESTS\tFIRST-SEEN\tLAST-SEEN", rows(report.Impersonations, func(i Impersonation) string {
+			return fmt.Sprintf("%s\t%s\t%s\t%s", i.User, i.ImpersonatedUser, orDash(i.ImpersonatedGroups), i.Activity)
+		})},
+		{"EMERGENCY-GROUP ACTIVITY", "USER\tVERB\tNAMESPACE\tRESOURCE\tREQUESTS\tFIRST-SEEN\tLAST-SEEN", rows(report.EmergencyActivity, func(r RequestActivity) string {
+			return fmt.Sprintf("%s\t%s\t%s\t%s\t%s", r.user(), r.Verb, orDash(r.Namespace), orDash(r.Resource), r.Activity)
+		})},
+	}
+
+	for _, section := range sections {
+		if _, err := fmt.Fprintf(w, "\n%s\n", section.title); err != nil {
+			return err
+		}
+		if len(section.rows) == 0 {
+			if _, err := fmt.Fprintln(w, "none"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, section.header)
+		for _, row := range section.rows {
+			fmt.Fprintln(tw, row)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String formats the activity as the tab-separated requests, first and last
+// seen columns.
+func (a Activity) String() string {
+	return fmt.Sprintf("%d\t%s\t%s", a.Requests, formatTime(a.FirstSeen), formatTime(a.LastSeen))
+}
+
+func rows[T any](items []T, row func(T) string) []string {
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		result = append(result, row(item))
+	}
+	return result
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// orDash formats the value, or returns a dash for the zero value.
+func orDash[T comparable](value T) string {
+	var zero T
+	if value == zero {
+		return "-"
+	}
+	return fmt.Sprint(value)
+}
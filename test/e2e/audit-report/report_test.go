@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/zalando-incubator/kubernetes-on-aws/tests/e2e/utils"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+func testAuditLine(stage, verb, resource, user, groups, impersonation, status, annotations, received string) string {
+	return fmt.Sprintf(`{"kind":"Event","apiVersion":"audit.k8s.io/v1","level":"Request","auditID":"1","stage":%q,"requestURI":"/api/v1/namespaces/teapot/%s","verb":%q,"user":{"username":%q,"groups":[%s]}%s,"objectRef":{"resource":%q,"namespace":"teapot"},"responseStatus":{"code":%s},"annotations":{%s},"requestReceivedTimestamp":"2024-01-01T%s.000000Z"}`,
+		stage, resource, verb, user, groups, impersonation, resource, status, annotations, received)
+}
+
+const testForbidden = `"authorization.k8s.io/decision":"forbid","authorization.k8s.io/reason":"no access to secrets"`
+
+var testAuditLog = strings.Join([]string{
+	testAuditLine("ResponseComplete", "create", "pods", "alice", `"Emergency"`, "", "201", "", "10:00:00"),
+	// only the last stage of a request is counted
+	testAuditLine("ResponseStarted", "watch", "pods", "alice", `"Emergency"`, "", "200", "", "10:01:00"),
+	testAuditLine("ResponseComplete", "watch", "pods", "alice", `"Emergency"`, "", "200", "", "10:01:00"),
+	testAuditLine("ResponseComplete", "create", "pods", "alice", `"Emergency"`, "", "201", "", "10:05:00"),
+	testAuditLine("ResponseComplete", "list", "secrets", "bob", "", `,"impersonatedUser":{"username":"carol","groups":["ReadOnly"]}`, "403", testForbidden, "11:00:00"),
+	testAuditLine("ResponseComplete", "list", "secrets", "bob", "", `,"impersonatedUser":{"username":"carol","groups":["ReadOnly"]}`, "403", testForbidden, "11:30:00"),
+	testAuditLine("ResponseComplete", "get", "pods", "dave", "", "", "200", "", "12:00:00"),
+}, "\n")
+
+func buildTestReport(t *testing.T, f *filter, top int) *Report {
+	builder := newReportBuilder(f, []string{"Emergency"})
+	if _, err := utils.ScanAuditLines(strings.NewReader(testAuditLog), auditv1.SchemeGroupVersion, builder.observe); err != nil {
+		t.Fatal(err)
+	}
+	return builder.build(top)
+}
+
+func TestReportTables(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeReport(&out, outputTable, buildTestReport(t, &filter{}, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `6 of 7 events matched, from 2024-01-01T10:00:00Z to 2024-01-01T12:00:00Z
+
+TOP USERS
+USER   DENIED  REQUESTS  FIRST-SEEN            LAST-SEEN
+alice  0       3         2024-01-01T10:00:00Z  2024-01-01T10:05:00Z
+bob    2       2         2024-01-01T11:00:00Z  2024-01-01T11:30:00Z
+
+DENIED REQUESTS
+USER            VERB  NAMESPACE  RESOURCE  CODE  REASON                REQUESTS  FIRST-SEEN            LAST-SEEN
+bob (as carol)  list  teapot     secrets   403   no access to secrets  2         2024-01-01T11:00:00Z  2024-01-01T11:30:00Z
+
+IMPERSONATIONS
+USER  IMPERSONATED-USER  IMPERSONATED-GROUPS  REQUESTS  FIRST-SEEN            LAST-SEEN
+bob   carol              ReadOnly             2         2024-01-01T11:00:00Z  2024-01-01T11:30:00Z
+
+EMERGENCY-GROUP ACTIVITY
+USER   VERB    NAMESPACE  RESOURCE  REQUESTS  FIRST-SEEN            LAST-SEEN
+alice  create  teapot     pods      2         2024-01-01T10:00:00Z  2024-01-01T10:05:00Z
+alice  watch   teapot     pods      1         2024-01-01T10:01:00Z  2024-01-01T10:01:00Z
+`
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestReportFiltered(t *testing.T) {
+	report := buildTestReport(t, &filter{users: []string{"dave"}}, 0)
+	if report.EventsRead != 7 || report.EventsMatched != 1 {
+		t.Errorf("expected 1 of 7 events to match, got %d of %d", report.EventsMatched, report.EventsRead)
+	}
+	if len(report.TopUsers) != 1 || report.TopUsers[0].User != "dave" || len(report.Denied) != 0 || len(report.EmergencyActivity) != 0 {
+		t.Errorf("expected only the activity of dave, got %+v", report)
+	}
+
+	var out bytes.Buffer
+	if err := writeReport(&out, outputJSON, report); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.TopUsers) != 1 || decoded.TopUsers[0].User != "dave" || !decoded.TopUsers[0].LastSeen.Equal(report.TopUsers[0].LastSeen) || decoded.Denied == nil {
+		t.Errorf("unexpected JSON report:\n%s", out.String())
+	}
+
+	if err := writeReport(&out, "yaml", report); err == nil {
+		t.Error("expected error for unknown output format")
+	}
+}
+
+func TestReportInvalidLines(t *testing.T) {
+	log := strings.Join([]string{
+		`{"kind":"Foo","apiVersion":"example.org/v1"}`,
+		testAuditLog,
+		// the incomplete last line of a log being written
+		testAuditLine("ResponseComplete", "get", "pods", "erin", "", "", "200", "", "13:00:00")[:100],
+	}, "\n")
+
+	builder := newReportBuilder(&filter{}, []string{"Emergency"})
+	if _, err := utils.ScanAuditLinesSkipping(strings.NewReader(log), auditv1.SchemeGroupVersion, builder.observe, builder.skip); err != nil {
+		t.Fatal(err)
+	}
+	report := builder.build(0)
+	if report.EventsRead != 7 || report.InvalidLines != 2 {
+		t.Errorf("expected 7 events and 2 invalid lines, got %d and %d", report.EventsRead, report.InvalidLines)
+	}
+
+	var out bytes.Buffer
+	if err := writeReport(&out, outputTable, report); err != nil {
+		t.Fatal(err)
+	}
+	if first, _, _ := strings.Cut(out.String(), "\n"); !strings.HasSuffix(first, ", 2 invalid lines skipped") {
+		t.Errorf("expected the invalid lines in the summary, got %q", first)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"regexp"
 	"time"
 
 	"github.com/zalando-incubator/kubernetes-on-aws/tests/e2e/utils"
@@ -11,9 +12,8 @@ import (
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/wait"
 	auditinternal "k8s.io/apiserver/pkg/apis/audit"
-	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/client-go/rest"
 	"k8s.io/kubernetes/test/e2e/framework"
 	e2epod "k8s.io/kubernetes/test/e2e/framework/pod"
 	admissionapi "k8s.io/pod-security-admission/api"
@@ -66,7 +66,7 @@ var _ = describe("Audit", func() {
 
 		e2epod.NewPodClient(f).DeleteSync(context.TODO(), pod.Name, metav1.DeleteOptions{}, e2epod.DefaultPodDeletionTimeout)
 
-		expectEvents(f, []utils.AuditEvent{
+		expectedEvents := []utils.AuditEvent{
 			{
 				Level:             auditinternal.LevelRequest,
 				Stage:             auditinternal.StageResponseComplete,
@@ -112,29 +112,62 @@ var _ = describe("Audit", func() {
 				RequestObject:     true,
 				AuthorizeDecision: "allow",
 			},
-		})
-	})
-})
-
-func expectEvents(f *framework.Framework, expectedEvents []utils.AuditEvent) {
-	// The default flush timeout is 30 seconds, therefore it should be enough to retry once
-	// to find all expected events. However, we're waiting for 5 minutes to avoid flakes.
-	pollingInterval := 30 * time.Second
-	pollingTimeout := 5 * time.Minute
-	err := wait.PollUntilContextTimeout(context.TODO(), pollingInterval, pollingTimeout, false, func(context.Context) (bool, error) {
-		// Fetch the log stream.
-		stream, err := f.ClientSet.CoreV1().RESTClient().Get().AbsPath("/logs/kube-audit.log").Stream(context.TODO())
-		if err != nil {
-			return false, err
 		}
-		defer stream.Close()
-		missingReport, err := utils.CheckAuditLines(stream, expectedEvents, auditv1.SchemeGroupVersion)
-		if err != nil {
-			framework.Logf("Failed to observe audit events: %v", err)
-		} else if len(missingReport.MissingEvents) > 0 {
-			framework.Logf("Events %#v not found!", missingReport)
+
+		podURI := utils.Exact(fmt.Sprintf("/api/v1/namespaces/%s/pods/audit-pod", namespace))
+		podEvent := func(verb string, uri *regexp.Regexp) *utils.AuditEventMatcher {
+			return &utils.AuditEventMatcher{
+				Stage:      auditinternal.StageResponseComplete,
+				Verb:       verb,
+				RequestURI: uri,
+				User:       utils.Exact(auditTestUser.Username),
+			}
 		}
-		return len(missingReport.MissingEvents) == 0, nil
+		create := podEvent("create", utils.Exact(fmt.Sprintf("/api/v1/namespaces/%s/pods", namespace)))
+
+		// the events and the assertions are checked on the same read of the
+		// log, which is only read once per spec
+		expectAuditAssertions(f, expectedEvents,
+			utils.InOrder(create, podEvent("update", podURI), podEvent("patch", podURI), podEvent("delete", podURI)),
+			utils.Exactly(1, create),
+			utils.Exactly(1, podEvent("patch", podURI)),
+		)
 	})
-	framework.ExpectNoError(err, "after %v failed to observe audit events", pollingTimeout)
+})
+
+// expectAuditAssertions waits until all expected events are found and all
+// assertions hold for the audit log, and until they still hold a flush
+// interval later.
+func expectAuditAssertions(f *framework.Framework, expectedEvents []utils.AuditEvent, assertions ...utils.AuditAssertion) {
+	for _, expectation := range utils.AuditEventExpectations(expectedEvents) {
+		assertions = append(assertions, utils.AtLeast(1, expectation))
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), auditPollingTimeout+auditSettlePeriod)
+	defer cancel()
+	report, err := utils.WaitForAuditAssertions(ctx, newAuditSource(f), auditPollingInterval, auditSettlePeriod, assertions...)
+	if err != nil {
+		framework.Logf("Audit assertions failed: %s", report)
+	}
+	framework.ExpectNoError(err, "after %v audit assertions didn't hold", auditPollingTimeout)
+}
+
+const (
+	// The default flush timeout is 30 seconds, but only the appended part of
+	// the log is read, so it's polled more often. We're waiting for 5 minutes
+	// to avoid flakes.
+	auditPollingInterval = 5 * time.Second
+	auditPollingTimeout  = 5 * time.Minute
+	// Duplicated events can be logged after the expected ones, so the log is
+	// read for a flush timeout longer after the assertions hold.
+	auditSettlePeriod = 30*time.Second + auditPollingInterval
+)
+
+// newAuditSource returns a source of the audit log of the API server.
+func newAuditSource(f *framework.Framework) utils.AuditSource {
+	client, ok := f.ClientSet.CoreV1().RESTClient().(*rest.RESTClient)
+	if !ok {
+		framework.Failf("unexpected REST client %T", f.ClientSet.CoreV1().RESTClient())
+	}
+	return utils.APIServerAuditSource(client, "/logs/kube-audit.log")
 }
@@ -0,0 +1,355 @@
+package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/zalando-incubator/kubernetes-on-aws/tests/e2e/utils"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/audit"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// auditPolicyUserdata is the userdata, relative to this package, which
+	// writes the audit policy of the API server.
+	auditPolicyUserdata = "../../cluster/node-pools/master-default/userdata.yaml"
+	// auditPolicyPath is the path of the audit policy on the control plane
+	// nodes.
+	auditPolicyPath = "/etc/kubernetes/config/audit-policy.yaml"
+	// auditPolicyExpectations is the table of expected audit levels and
+	// stages, relative to this package.
+	auditPolicyExpectations = "testdata/audit-policy.yaml"
+)
+
+// auditPolicyTable is the checked-in table of the level and stages requests
+// are expected to be logged at with the config items.
+type auditPolicyTable struct {
+	ConfigItems map[string]string `json:"configItems"`
+	Items       []auditPolicyItem `json:"items"`
+}
+
+// auditPolicyItem is a matrixItem with an expected audit level and stages
+// instead of an authorization result. Items without expect inherit the
+// expectation of their parent.
+type auditPolicyItem struct {
+	Name    string             `json:"name"`
+	Request matrixRequest      `json:"request,omitempty"`
+	Items   []auditPolicyItem  `json:"items,omitempty"`
+	Expect  *auditPolicyResult `json:"expect,omitempty"`
+}
+
+// auditPolicyResult is the level a request is logged at, and the stages it's
+// logged in. It's either just the level None, or an object with the level
+// and the stages, e.g.:
+//
+//	expect: None
+//	expect: {level: Request, stages: [ResponseComplete]}
+type auditPolicyResult struct {
+	Level  auditinternal.Level   `json:"level"`
+	Stages []auditinternal.Stage `json:"stages,omitempty"`
+}
+
+func (r *auditPolicyResult) UnmarshalJSON(data []byte) error {
+	var level auditinternal.Level
+	if err := json.Unmarshal(data, &level); err == nil {
+		*r = auditPolicyResult{Level: level}
+		return nil
+	}
+
+	// avoid recursing into UnmarshalJSON
+	type plain auditPolicyResult
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*r = auditPolicyResult(p)
+	return nil
+}
+
+func (r auditPolicyResult) String() string {
+	if len(r.Stages) == 0 {
+		return string(r.Level)
+	}
+	stages := make([]string, 0, len(r.Stages))
+	for _, stage := range r.Stages {
+		stages = append(stages, string(stage))
+	}
+	return fmt.Sprintf("%s/%s", r.Level, strings.Join(stages, ","))
+}
+
+// auditPolicyEventsResult returns the level and stages of the events logged
+// for a request.
+func auditPolicyEventsResult(events []utils.AuditEvent) auditPolicyResult {
+	if len(events) == 0 {
+		return auditPolicyResult{Level: auditinternal.LevelNone}
+	}
+
+	result := auditPolicyResult{Level: events[0].Level}
+	for _, event := range events {
+		result.Stages = append(result.Stages, event.Stage)
+	}
+	return result
+}
+
+// testItem returns the requests of the item as a testItem, so that they are
+// expanded like the authorization test matrix. The expectations of the leaf
+// items are added to expectations, by the name of the expanded cases.
+func (item auditPolicyItem) testItem(prefix string, inherited *auditPolicyResult, expectations map[string]auditPolicyResult) (testItem, error) {
+	name := item.Name
+	if prefix != "" {
+		name = prefix + "/" + item.Name
+	}
+
+	expect := inherited
+	if item.Expect != nil {
+		if !slices.Contains(auditPolicyLevels, item.Expect.Level) {
+			return testItem{}, fmt.Errorf("%s: unknown level %q", name, item.Expect.Level)
+		}
+		expect = item.Expect
+	}
+
+	test, err := matrixItem{Name: item.Name, Request: item.Request}.testItem()
+	if err != nil {
+		return testItem{}, err
+	}
+
+	if len(item.Items) == 0 {
+		if _, ok := expectations[name]; ok {
+			return testItem{}, fmt.Errorf("%s: duplicated item", name)
+		}
+		if expect == nil {
+			return testItem{}, fmt.Errorf("%s: no expectation", name)
+		}
+		expectations[name] = *expect
+		return test, nil
+	}
+
+	for _, subitem := range item.Items {
+		subtest, err := subitem.testItem(name, expect, expectations)
+		if err != nil {
+			return testItem{}, err
+		}
+		test.items = append(test.items, subtest)
+	}
+	return test, nil
+}
+
+var auditPolicyLevels = []auditinternal.Level{
+	auditinternal.LevelNone,
+	auditinternal.LevelMetadata,
+	auditinternal.LevelRequest,
+	auditinternal.LevelRequestResponse,
+}
+
+// auditPolicyCase is an expanded request of the table with its expected and
+// actual result.
+type auditPolicyCase struct {
+	test           testItem
+	expect, result auditPolicyResult
+}
+
+// loadAuditPolicyTable parses a table of audit policy expectations. Unknown
+// fields are rejected, so that typos don't silently widen a case.
+func loadAuditPolicyTable(data []byte) (*auditPolicyTable, error) {
+	var table auditPolicyTable
+	if err := yaml.UnmarshalStrict(data, &table); err != nil {
+		return nil, err
+	}
+	return &table, nil
+}
+
+// cases expands the items of the table and returns the cases with their
+// expected result.
+func (t *auditPolicyTable) cases() ([]auditPolicyCase, error) {
+	expectations := map[string]auditPolicyResult{}
+
+	var cases []auditPolicyCase
+	for _, item := range t.Items {
+		test, err := item.testItem("", nil, expectations)
+		if err != nil {
+			return nil, err
+		}
+		for _, expanded := range test.expand() {
+			cases = append(cases, auditPolicyCase{test: expanded, expect: expectations[expanded.name]})
+		}
+	}
+	return cases, nil
+}
+
+// evaluateAuditPolicy sets the result of every case to the level and stages
+// the policy logs its request at.
+func evaluateAuditPolicy(evaluator audit.PolicyRuleEvaluator, cases []auditPolicyCase) error {
+	for i := range cases {
+		events, err := utils.AuditPolicyEvents(evaluator, reviewAttributes(cases[i].test.subjectReview()))
+		if err != nil {
+			return fmt.Errorf("%s: %w", cases[i].test, err)
+		}
+		cases[i].result = auditPolicyEventsResult(events)
+	}
+	return nil
+}
+
+// userdataFile returns the content of the file written to path by the
+// userdata, as it's in the userdata, i.e. not rendered. Template actions at
+// the start of a line are part of the content regardless of their
+// indentation.
+func userdataFile(userdata []byte, path string) ([]byte, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(userdata))
+	indentation := func(line string) int {
+		return len(line) - len(strings.TrimLeft(line, " "))
+	}
+
+	found := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "- "))
+		if line == "path: "+path {
+			found = true
+			continue
+		}
+		if found && line == "content: |" {
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no file %s in userdata", path)
+	}
+
+	var content bytes.Buffer
+	indent := -1
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			content.WriteString("\n")
+		case strings.HasPrefix(trimmed, "{{") && (indent < 0 || indentation(line) < indent):
+			content.WriteString(trimmed + "\n")
+		default:
+			if indent < 0 {
+				indent = indentation(line)
+			}
+			if indentation(line) < indent {
+				return content.Bytes(), scanner.Err()
+			}
+			content.WriteString(line[indent:] + "\n")
+		}
+	}
+	if indent < 0 {
+		return nil, fmt.Errorf("file %s in userdata has no content", path)
+	}
+	return content.Bytes(), scanner.Err()
+}
+
+// loadClusterAuditPolicy returns the evaluator of the audit policy in the
+// userdata, rendered for the e2e clusters with the config items.
+func loadClusterAuditPolicy(userdataPath string, configItems map[string]string) (audit.PolicyRuleEvaluator, error) {
+	userdata, err := os.ReadFile(userdataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := userdataFile(userdata, auditPolicyPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", userdataPath, err)
+	}
+
+	tmpl, err := template.New(auditPolicyPath).Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	var data rbacManifestData
+	data.Cluster.Environment = rbacEnvironment
+	data.Cluster.ConfigItems = configItems
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return nil, err
+	}
+
+	evaluator, err := utils.NewAuditPolicyEvaluator(rendered.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load audit policy of %s: %w", userdataPath, err)
+	}
+	return evaluator, nil
+}
+
+func TestAuditPolicyConformance(t *testing.T) {
+	data, err := os.ReadFile(auditPolicyExpectations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := loadAuditPolicyTable(data)
+	if err != nil {
+		t.Fatalf("failed to load %s: %v", auditPolicyExpectations, err)
+	}
+
+	cases, err := table.cases()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evaluator, err := loadClusterAuditPolicy(auditPolicyUserdata, table.ConfigItems)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := evaluateAuditPolicy(evaluator, cases); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		if c.result.String() != c.expect.String() {
+			t.Errorf("%s: expected %s, got %s", c.test, c.expect, c.result)
+		} else if testing.Verbose() {
+			t.Logf("%s: %s", c.test, c.result)
+		}
+	}
+}
+
+func TestUserdataFile(t *testing.T) {
+	userdata := []byte(`
+write_files:
+  - owner: root:root
+    path: /etc/kubernetes/config/policy.yaml
+    content: |
+      rules:
+        - level: None
+{{- if eq .Cluster.Environment "e2e" }}
+        - level: Request
+{{- end }}
+
+        - level: Metadata
+  - owner: root:root
+    path: /etc/kubernetes/config/other.yaml
+    content: |
+      other: true
+`)
+
+	content, err := userdataFile(userdata, "/etc/kubernetes/config/policy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `rules:
+  - level: None
+{{- if eq .Cluster.Environment "e2e" }}
+  - level: Request
+{{- end }}
+
+  - level: Metadata
+`
+	if string(content) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, content)
+	}
+
+	if _, err := userdataFile(userdata, "/etc/kubernetes/config/missing.yaml"); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
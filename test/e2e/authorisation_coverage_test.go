@@ -0,0 +1,484 @@
+package e2e
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/kubernetes/plugin/pkg/auth/authorizer/rbac"
+)
+
+// ruleCoverage is a rule of a Role or ClusterRole defined in the manifests
+// and the test cases matching it.
+type ruleCoverage struct {
+	Kind      string            `json:"kind"`
+	Namespace string            `json:"namespace,omitempty"`
+	Name      string            `json:"name"`
+	Manifest  string            `json:"manifest"`
+	Index     int               `json:"index"`
+	Rule      rbacv1.PolicyRule `json:"rule"`
+	// Cases are the names of the matching cases by their expected result:
+	// allowed, denied or undecided.
+	Cases map[string][]string `json:"cases,omitempty"`
+}
+
+// hits returns the number of cases matching the rule.
+func (c *ruleCoverage) hits() int {
+	hits := 0
+	for _, cases := range c.Cases {
+		hits += len(cases)
+	}
+	return hits
+}
+
+func (c *ruleCoverage) role() string {
+	if c.Namespace != "" {
+		return fmt.Sprintf("%s %s/%s", c.Kind, c.Namespace, c.Name)
+	}
+	return fmt.Sprintf("%s %s", c.Kind, c.Name)
+}
+
+// rbacCoverage reports which rules of the manifests are exercised by the
+// authorization test cases.
+type rbacCoverage struct {
+	Cases   int             `json:"cases"`
+	Rules   []*ruleCoverage `json:"rules"`
+	Unused  []*ruleCoverage `json:"unused"`
+	Covered int             `json:"covered"`
+}
+
+// computeRBACCoverage matches the cases against the rules of the roles
+// bound to their subjects. A rule is hit by a case if it would allow the
+// request, independent of the expected result, so rules granting requests
+// which are denied by the authorization webhook are covered as well. Rules
+// of aggregated ClusterRoles are attributed to the roles they are
+// aggregated from.
+func computeRBACCoverage(policy *rbacPolicy, cases []testItem) *rbacCoverage {
+	rules := make(map[roleKey][]*ruleCoverage)
+	for key, manifest := range policy.manifests {
+		// the rules of aggregated roles are covered by their sources
+		if key.kind == "ClusterRole" && policy.clusterRoles[key.name].AggregationRule != nil {
+			continue
+		}
+
+		for i, rule := range policy.roleRules(key) {
+			rules[key] = append(rules[key], &ruleCoverage{
+				Kind:      key.kind,
+				Namespace: key.namespace,
+				Name:      key.name,
+				Manifest:  manifest,
+				Index:     i,
+				Rule:      rule,
+				Cases:     map[string][]string{},
+			})
+		}
+	}
+
+	for _, test := range cases {
+		attributes := reviewAttributes(test.subjectReview())
+		expected := test.expect.decision()
+
+		hit := make(map[*ruleCoverage]struct{})
+		for _, key := range policy.boundRoles(attributes.User, attributes.Namespace) {
+			for _, rule := range policy.roleRules(key) {
+				if !rbac.RuleAllows(attributes, &rule) {
+					continue
+				}
+
+				for _, source := range policy.ruleSources(key) {
+					for _, coverage := range rules[source] {
+						if reflect.DeepEqual(coverage.Rule, rule) {
+							hit[coverage] = struct{}{}
+						}
+					}
+				}
+			}
+		}
+
+		for coverage := range hit {
+			coverage.Cases[expected] = append(coverage.Cases[expected], test.name)
+		}
+	}
+
+	report := &rbacCoverage{Cases: len(cases)}
+	for _, key := range sortedRoleKeys(rules) {
+		for _, coverage := range rules[key] {
+			report.Rules = append(report.Rules, coverage)
+			if coverage.hits() == 0 {
+				report.Unused = append(report.Unused, coverage)
+				continue
+			}
+			report.Covered++
+		}
+	}
+
+	return report
+}
+
+func sortedRoleKeys[V any](m map[roleKey]V) []roleKey {
+	keys := make([]roleKey, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].kind != keys[j].kind {
+			return keys[i].kind < keys[j].kind
+		}
+		if keys[i].namespace != keys[j].namespace {
+			return keys[i].namespace < keys[j].namespace
+		}
+		return keys[i].name < keys[j].name
+	})
+	return keys
+}
+
+// roleRules returns the rules of the role.
+func (p *rbacPolicy) roleRules(key roleKey) []rbacv1.PolicyRule {
+	switch key.kind {
+	case "Role":
+		if role, ok := p.roles[key.namespace][key.name]; ok {
+			return role.Rules
+		}
+	case "ClusterRole":
+		if role, ok := p.clusterRoles[key.name]; ok {
+			return role.Rules
+		}
+	}
+	return nil
+}
+
+// ruleSources returns the role itself or, for aggregated ClusterRoles, the
+// roles it is aggregated from.
+func (p *rbacPolicy) ruleSources(key roleKey) []roleKey {
+	if key.kind != "ClusterRole" || p.clusterRoles[key.name] == nil || p.clusterRoles[key.name].AggregationRule == nil {
+		return []roleKey{key}
+	}
+
+	var sources []roleKey
+	visited := map[string]struct{}{key.name: {}}
+	queue := []string{key.name}
+	for len(queue) > 0 {
+		aggregated := p.clusterRoles[queue[0]]
+		queue = queue[1:]
+
+		for _, name := range sortedKeys(p.clusterRoles) {
+			if _, ok := visited[name]; ok {
+				continue
+			}
+
+			source := p.clusterRoles[name]
+			for _, selector := range aggregated.AggregationRule.ClusterRoleSelectors {
+				s, err := metav1.LabelSelectorAsSelector(&selector)
+				if err != nil || !s.Matches(labels.Set(source.Labels)) {
+					continue
+				}
+
+				visited[name] = struct{}{}
+				if source.AggregationRule != nil {
+					queue = append(queue, name)
+				} else {
+					sources = append(sources, roleKey{kind: "ClusterRole", name: name})
+				}
+				break
+			}
+		}
+	}
+	return sources
+}
+
+// boundRoles returns the roles bound to the user in the namespace, or only
+// the ones bound cluster-wide if namespace is empty.
+func (p *rbacPolicy) boundRoles(u user.Info, namespace string) []roleKey {
+	var roles []roleKey
+	for _, binding := range p.clusterRoleBindings {
+		if subjectsApply(u, binding.Subjects, "") {
+			roles = append(roles, roleKey{kind: "ClusterRole", name: binding.RoleRef.Name})
+		}
+	}
+
+	if namespace == "" {
+		return roles
+	}
+
+	for _, binding := range p.roleBindings[namespace] {
+		if !subjectsApply(u, binding.Subjects, namespace) {
+			continue
+		}
+
+		key := roleKey{kind: binding.RoleRef.Kind, name: binding.RoleRef.Name}
+		if key.kind == "Role" {
+			key.namespace = namespace
+		}
+		roles = append(roles, key)
+	}
+	return roles
+}
+
+// subjectsApply returns true if any of the subjects of a binding in
+// namespace applies to the user, like the RBAC authorizer does.
+func subjectsApply(u user.Info, subjects []rbacv1.Subject, namespace string) bool {
+	for _, subject := range subjects {
+		switch subject.Kind {
+		case rbacv1.UserKind:
+			if u.GetName() == subject.Name {
+				return true
+			}
+		case rbacv1.GroupKind:
+			if slices.Contains(u.GetGroups(), subject.Name) {
+				return true
+			}
+		case rbacv1.ServiceAccountKind:
+			saNamespace := namespace
+			if subject.Namespace != "" {
+				saNamespace = subject.Namespace
+			}
+			if saNamespace != "" && u.GetName() == serviceaccount.MakeUsername(saNamespace, subject.Name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeJSON writes the coverage report as JSON.
+func (c *rbacCoverage) writeJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(c)
+}
+
+// writeMarkdown writes the coverage report as Markdown.
+func (c *rbacCoverage) writeMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# RBAC rule coverage\n\n")
+	fmt.Fprintf(&b, "%d of %d rules are exercised by %d authorization test cases.\n", c.Covered, len(c.Rules), c.Cases)
+
+	fmt.Fprintf(&b, "\n## Rules never hit\n\n")
+	if len(c.Unused) == 0 {
+		fmt.Fprintf(&b, "None.\n")
+	} else {
+		fmt.Fprintf(&b, "| Role | Manifest | Verbs | API groups | Resources | Resource names | Non-resource URLs |\n")
+		fmt.Fprintf(&b, "|---|---|---|---|---|---|---|\n")
+		for _, rule := range c.Unused {
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", rule.role(), filepath.Base(rule.Manifest), markdownRule(rule.Rule))
+		}
+	}
+
+	fmt.Fprintf(&b, "\n## Rules hit\n\n")
+	fmt.Fprintf(&b, "| Role | Verbs | API groups | Resources | Resource names | Non-resource URLs | Allowed | Denied | Undecided |\n")
+	fmt.Fprintf(&b, "|---|---|---|---|---|---|---|---|---|\n")
+	for _, rule := range c.Rules {
+		if rule.hits() == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "| %s | %s | %d | %d | %d |\n",
+			rule.role(),
+			markdownRule(rule.Rule),
+			len(rule.Cases[matrixAllowed]),
+			len(rule.Cases[matrixDenied]),
+			len(rule.Cases[matrixUndecided]),
+		)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func markdownRule(rule rbacv1.PolicyRule) string {
+	column := func(values []string) string {
+		if len(values) == 0 {
+			return ""
+		}
+		quoted := make([]string, 0, len(values))
+		for _, value := range values {
+			if value == "" {
+				value = `""`
+			}
+			quoted = append(quoted, "`"+value+"`")
+		}
+		return strings.Join(quoted, ", ")
+	}
+
+	return strings.Join([]string{
+		column(rule.Verbs),
+		column(rule.APIGroups),
+		column(rule.Resources),
+		column(rule.ResourceNames),
+		column(rule.NonResourceURLs),
+	}, " | ")
+}
+
+// writeRBACCoverage writes the coverage report to the file at path, as JSON
+// if it has a .json extension, otherwise as Markdown.
+func writeRBACCoverage(path string, coverage *rbacCoverage) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if filepath.Ext(path) == ".json" {
+		err = coverage.writeJSON(f)
+	} else {
+		err = coverage.writeMarkdown(f)
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func TestRBACCoverage(t *testing.T) {
+	policy, err := loadRBACPolicy(rbacManifests...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests, err := authorizationTests()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coverage := computeRBACCoverage(policy, expandAll(tests))
+	t.Logf("%d of %d rules are exercised by %d authorization test cases", coverage.Covered, len(coverage.Rules), coverage.Cases)
+
+	if path := E2ERBACCoverageReport(); path != "" {
+		if err := writeRBACCoverage(path, coverage); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestComputeRBACCoverage(t *testing.T) {
+	policy := newRBACPolicy()
+	err := policy.loadObjects("roles.yaml", []byte(`
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: readonly
+aggregationRule:
+  clusterRoleSelectors:
+  - matchLabels:
+      aggregate-to-readonly: "true"
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: readonly-pods
+  labels:
+    aggregate-to-readonly: "true"
+rules:
+- apiGroups: [""]
+  resources: [pods]
+  verbs: [get, list]
+- apiGroups: [""]
+  resources: [secrets]
+  verbs: [get]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: readonly
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: readonly
+subjects:
+- apiGroup: rbac.authorization.k8s.io
+  kind: Group
+  name: ReadOnly
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: operator
+  namespace: teapot
+rules:
+- apiGroups: [apps]
+  resources: [deployments]
+  verbs: ["*"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: operator
+  namespace: teapot
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: operator
+subjects:
+- kind: ServiceAccount
+  name: operator
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.aggregate(); err != nil {
+		t.Fatal(err)
+	}
+
+	coverage := computeRBACCoverage(policy, expandAll([]testItem{{
+		name:    "read pods",
+		request: req().ns("teapot").verb("get").res("pods").user("test-user").setGroups([]string{"ReadOnly"}),
+		expect:  allowed,
+	}, {
+		name:    "operator",
+		request: req().ns("teapot").verb("delete").res("apps/deployments").user("system:serviceaccount:teapot:operator"),
+		expect:  denied,
+	}, {
+		name:    "operator in other namespace",
+		request: req().ns("default").verb("delete").res("apps/deployments").user("system:serviceaccount:teapot:operator"),
+		expect:  undecided,
+	}}))
+
+	hits := make(map[string]map[string][]string)
+	for _, rule := range coverage.Rules {
+		hits[fmt.Sprintf("%s[%d]", rule.role(), rule.Index)] = rule.Cases
+	}
+
+	expected := map[string]map[string][]string{
+		"ClusterRole readonly-pods[0]": {matrixAllowed: {"read pods"}},
+		"ClusterRole readonly-pods[1]": {},
+		"Role teapot/operator[0]":      {matrixDenied: {"operator"}},
+	}
+	if !reflect.DeepEqual(hits, expected) {
+		t.Errorf("expected hits %v, got %v", expected, hits)
+	}
+
+	if coverage.Covered != 2 || len(coverage.Unused) != 1 || coverage.Unused[0].Name != "readonly-pods" || coverage.Unused[0].Index != 1 {
+		t.Errorf("unexpected coverage: %d covered, unused %v", coverage.Covered, coverage.Unused)
+	}
+
+	var markdown strings.Builder
+	if err := coverage.writeMarkdown(&markdown); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(markdown.String(), "| ClusterRole readonly-pods | roles.yaml | `get` | `\"\"` | `secrets` |  |  |") {
+		t.Errorf("unused rule not reported:\n%s", markdown.String())
+	}
+
+	var out strings.Builder
+	if err := coverage.writeJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+	var decoded rbacCoverage
+	if err := json.Unmarshal([]byte(out.String()), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Unused) != 1 || decoded.Covered != 2 {
+		t.Errorf("unexpected JSON report:\n%s", out.String())
+	}
+}
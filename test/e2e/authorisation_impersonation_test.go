@@ -0,0 +1,375 @@
+package e2e
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+// impersonationPlaceholderName is the name of the object requested if the
+// review doesn't name one. It must not exist, so that no request has an effect
+// even if it passes validation.
+const impersonationPlaceholderName = "e2e-impersonation-does-not-exist"
+
+// impersonationBackend reviews a SubjectAccessReview by making the request it
+// describes against the API server, impersonating its subject. This verifies
+// the actual request path including impersonation instead of only the
+// decision of the authorizers. Mutating requests are dry-run and have an
+// empty body, so that they fail after authorization at the latest.
+type impersonationBackend struct {
+	config *rest.Config
+	mapper meta.RESTMapper
+}
+
+func newImpersonationBackend(config *rest.Config) (*impersonationBackend, error) {
+	client, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	resources, err := restmapper.GetAPIGroupResources(client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &impersonationBackend{
+		config: config,
+		mapper: restmapper.NewDiscoveryRESTMapper(resources),
+	}, nil
+}
+
+// impersonatedRequest is an API request equivalent to a SubjectAccessReview.
+type impersonatedRequest struct {
+	method string
+	path   string
+	query  url.Values
+}
+
+var impersonationMethods = map[string]string{
+	"get":              http.MethodGet,
+	"list":             http.MethodGet,
+	"watch":            http.MethodGet,
+	"create":           http.MethodPost,
+	"update":           http.MethodPut,
+	"patch":            http.MethodPatch,
+	"delete":           http.MethodDelete,
+	"deletecollection": http.MethodDelete,
+}
+
+// request returns the API request which is authorized with the attributes of
+// the review, or an error if there is none, e.g. for the impersonate verb or
+// unknown resources.
+func (b *impersonationBackend) request(review *authorizationv1.SubjectAccessReview) (*impersonatedRequest, error) {
+	if attrs := review.Spec.NonResourceAttributes; attrs != nil {
+		if attrs.Verb != "get" {
+			return nil, fmt.Errorf("unsupported non-resource verb %q", attrs.Verb)
+		}
+		return &impersonatedRequest{method: http.MethodGet, path: attrs.Path}, nil
+	}
+
+	attrs := review.Spec.ResourceAttributes
+	method, ok := impersonationMethods[attrs.Verb]
+	if !ok {
+		return nil, fmt.Errorf("unsupported verb %q", attrs.Verb)
+	}
+
+	gvr, err := b.mapper.ResourceFor(schema.GroupVersionResource{Group: attrs.Group, Version: attrs.Version, Resource: attrs.Resource})
+	if err != nil {
+		return nil, err
+	}
+	gvk, err := b.mapper.KindFor(gvr)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := b.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []string{"/apis", gvr.Group, gvr.Version}
+	if gvr.Group == "" {
+		segments = []string{"/api", gvr.Version}
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace && attrs.Namespace != "" {
+		segments = append(segments, "namespaces", attrs.Namespace)
+	}
+	segments = append(segments, gvr.Resource)
+
+	collection := attrs.Verb == "list" || attrs.Verb == "watch" || attrs.Verb == "deletecollection" ||
+		attrs.Verb == "create" && attrs.Subresource == ""
+	if !collection {
+		name := attrs.Name
+		if name == "" {
+			name = impersonationPlaceholderName
+		}
+		segments = append(segments, name)
+		if attrs.Subresource != "" {
+			segments = append(segments, attrs.Subresource)
+		}
+	}
+
+	query := url.Values{}
+	switch {
+	case attrs.Verb == "watch":
+		query.Set("watch", "true")
+		query.Set("timeoutSeconds", "1")
+	case method != http.MethodGet:
+		query.Set("dryRun", metav1.DryRunAll)
+	}
+
+	return &impersonatedRequest{method: method, path: path.Join(segments...), query: query}, nil
+}
+
+// supports returns true if the review can be made as an API request.
+func (b *impersonationBackend) supports(review *authorizationv1.SubjectAccessReview) bool {
+	_, err := b.request(review)
+	return err == nil
+}
+
+func (b *impersonationBackend) review(ctx context.Context, review *authorizationv1.SubjectAccessReview) (*authorizationv1.SubjectAccessReviewStatus, error) {
+	request, err := b.request(review)
+	if err != nil {
+		return nil, err
+	}
+
+	config := rest.CopyConfig(b.config)
+	config.Impersonate = rest.ImpersonationConfig{
+		UserName: review.Spec.User,
+		UID:      review.Spec.UID,
+		Groups:   review.Spec.Groups,
+	}
+	if len(review.Spec.Extra) > 0 {
+		config.Impersonate.Extra = make(map[string][]string, len(review.Spec.Extra))
+		for key, value := range review.Spec.Extra {
+			config.Impersonate.Extra[key] = value
+		}
+	}
+	config.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
+
+	client, err := rest.UnversionedRESTClientFor(config)
+	if err != nil {
+		return nil, err
+	}
+
+	req := client.Verb(request.method).AbsPath(request.path)
+	for key, values := range request.query {
+		for _, value := range values {
+			req.Param(key, value)
+		}
+	}
+	switch request.method {
+	case http.MethodPost, http.MethodPut:
+		req.SetHeader("Content-Type", "application/json").Body([]byte("{}"))
+	case http.MethodPatch:
+		req.SetHeader("Content-Type", "application/merge-patch+json").Body([]byte("{}"))
+	}
+
+	var code int
+	err = req.Do(ctx).StatusCode(&code).Error()
+	return impersonationStatus(request, code, err)
+}
+
+// impersonationStatus converts the result of an impersonated request to the
+// status of a review. Only forbidden requests are considered not allowed,
+// every other response means that the request was authorized. The API server
+// doesn't tell denied and undecided apart, so the status is never denied.
+func impersonationStatus(request *impersonatedRequest, code int, err error) (*authorizationv1.SubjectAccessReviewStatus, error) {
+	switch {
+	case code == http.StatusForbidden:
+		if strings.Contains(err.Error(), "cannot impersonate") {
+			return nil, fmt.Errorf("not allowed to impersonate: %w", err)
+		}
+		return &authorizationv1.SubjectAccessReviewStatus{Reason: err.Error()}, nil
+	case code == 0, code == http.StatusUnauthorized, code == http.StatusTooManyRequests, code >= http.StatusInternalServerError:
+		if err == nil {
+			err = errors.New("no response")
+		}
+		return nil, fmt.Errorf("%s %s: %w", request.method, request.path, err)
+	}
+
+	return &authorizationv1.SubjectAccessReviewStatus{
+		Allowed: true,
+		Reason:  fmt.Sprintf("%s %s: %d", request.method, request.path, code),
+	}, nil
+}
+
+// impersonationTests returns the expanded cases of the authorization tests
+// which can be made as impersonated requests. The expected reasons are
+// cleared, because they are part of SubjectAccessReviews only.
+func impersonationTests(backend *impersonationBackend, tests []testItem) []testItem {
+	var cases []testItem
+	for _, test := range expandAll(tests) {
+		if test.expect.status != http.StatusCreated || !backend.supports(test.subjectReview()) {
+			continue
+		}
+		test.expect.reason = nil
+		cases = append(cases, test)
+	}
+	return cases
+}
+
+func testImpersonationMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Node"}, meta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, meta.RESTScopeNamespace)
+	return mapper
+}
+
+func TestImpersonatedRequest(t *testing.T) {
+	backend := &impersonationBackend{mapper: testImpersonationMapper()}
+
+	for _, tc := range []struct {
+		request  requestData
+		expected *impersonatedRequest
+	}{{
+		request:  req().ns("teapot").verb("get").res("pods"),
+		expected: &impersonatedRequest{method: "GET", path: "/api/v1/namespaces/teapot/pods/" + impersonationPlaceholderName, query: url.Values{}},
+	}, {
+		request:  req().ns("teapot").verb("list").res("apps/deployments"),
+		expected: &impersonatedRequest{method: "GET", path: "/apis/apps/v1/namespaces/teapot/deployments", query: url.Values{}},
+	}, {
+		request:  req().verb("watch").res("pods"),
+		expected: &impersonatedRequest{method: "GET", path: "/api/v1/pods", query: url.Values{"watch": {"true"}, "timeoutSeconds": {"1"}}},
+	}, {
+		request:  req().ns("teapot").verb("create").res("pods"),
+		expected: &impersonatedRequest{method: "POST", path: "/api/v1/namespaces/teapot/pods", query: url.Values{"dryRun": {"All"}}},
+	}, {
+		request:  req().ns("teapot").name("web").verb("create").res("pods").subres("eviction"),
+		expected: &impersonatedRequest{method: "POST", path: "/api/v1/namespaces/teapot/pods/web/eviction", query: url.Values{"dryRun": {"All"}}},
+	}, {
+		request:  req().ns("teapot").verb("patch").res("apps/deployments/scale"),
+		expected: &impersonatedRequest{method: "PATCH", path: "/apis/apps/v1/namespaces/teapot/deployments/" + impersonationPlaceholderName + "/scale", query: url.Values{"dryRun": {"All"}}},
+	}, {
+		request:  req().ns("teapot").verb("delete").name("node-1").res("nodes"),
+		expected: &impersonatedRequest{method: "DELETE", path: "/api/v1/nodes/node-1", query: url.Values{"dryRun": {"All"}}},
+	}, {
+		request:  req().nonResVerb("get").nonResPath("/metrics"),
+		expected: &impersonatedRequest{method: "GET", path: "/metrics"},
+	}, {
+		request: req().verb("impersonate").res("users"),
+	}, {
+		request: req().verb("get").res("podsecuritypolicies"),
+	}, {
+		request: req().nonResVerb("post").nonResPath("/metrics"),
+	}} {
+		item := testItem{name: "request", request: tc.request}
+		request, err := backend.request(item.subjectReview())
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", item, request)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", item, err)
+			continue
+		}
+		if !reflect.DeepEqual(request, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", item, tc.expected, request)
+		}
+	}
+}
+
+func TestImpersonationBackend(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		headers = map[string]http.Header{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers[r.Header.Get("Impersonate-User")] = r.Header.Clone()
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Header.Get("Impersonate-User") {
+		case "reader":
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"Forbidden","code":403,"message":"pods is forbidden: User \"reader\" cannot %s"}`, r.Method)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`)
+		case "not-impersonatable":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"Forbidden","code":403,"message":"users \"not-impersonatable\" is forbidden: User \"e2e\" cannot impersonate resource \"users\""}`)
+		default:
+			fmt.Fprint(w, `{"kind":"Status","apiVersion":"v1","status":"Success","code":200}`)
+		}
+	}))
+	defer server.Close()
+
+	backend := &impersonationBackend{
+		config: &rest.Config{Host: server.URL},
+		mapper: testImpersonationMapper(),
+	}
+
+	cases := impersonationTests(backend, []testItem{{
+		name:    "reader",
+		request: req().ns("teapot").res("pods").user("reader").setGroups([]string{"ReadOnly"}),
+		items: []testItem{{
+			name:    "read",
+			request: req().verb("get", "list"),
+			expect:  allowed,
+		}, {
+			name:    "write",
+			request: req().verb("create", "delete"),
+			expect:  deniedReason("only part of SubjectAccessReviews"),
+		}, {
+			name:    "impersonate",
+			request: req().verb("impersonate").res("users"),
+			expect:  denied,
+		}},
+	}, {
+		name: "service account",
+		request: req().ns("teapot").verb("get").res("pods").serviceAccount("teapot/operator").
+			uid("1234").extra(map[string][]string{"reason": {"e2e"}}),
+		expect: allowed,
+	}})
+	if len(cases) != 5 {
+		t.Fatalf("expected 5 supported cases, got %d", len(cases))
+	}
+
+	report := runAuthorizationTests(context.Background(), backend, cases, 2)
+	if len(report.failures) > 0 {
+		t.Fatal(report)
+	}
+
+	header := headers["system:serviceaccount:teapot:operator"]
+	if header == nil {
+		t.Fatal("service account not impersonated")
+	}
+	expectedGroups := []string{"system:serviceaccounts", "system:serviceaccounts:teapot", "system:authenticated"}
+	if groups := header.Values("Impersonate-Group"); !reflect.DeepEqual(groups, expectedGroups) {
+		t.Errorf("expected impersonated groups %v, got %v", expectedGroups, groups)
+	}
+	if uid := header.Get("Impersonate-Uid"); uid != "1234" {
+		t.Errorf("expected impersonated uid 1234, got %q", uid)
+	}
+	if reason := header.Get("Impersonate-Extra-Reason"); reason != "e2e" {
+		t.Errorf("expected impersonated extra reason e2e, got %q", reason)
+	}
+
+	_, err := backend.review(context.Background(), testItem{request: req().ns("teapot").verb("get").res("pods").user("not-impersonatable")}.subjectReview())
+	if err == nil || !strings.Contains(err.Error(), "not allowed to impersonate") {
+		t.Errorf("expected impersonation error, got %v", err)
+	}
+}
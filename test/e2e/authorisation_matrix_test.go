@@ -0,0 +1,346 @@
+package e2e
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+// matrixItem is the YAML/JSON form of a testItem. Fields which are not set
+// are inherited and expanded exactly like those of a testItem.
+type matrixItem struct {
+	Name    string        `json:"name"`
+	Request matrixRequest `json:"request,omitempty"`
+	Items   []matrixItem  `json:"items,omitempty"`
+	Expect  *matrixExpect `json:"expect,omitempty"`
+}
+
+// matrixRequest is the YAML/JSON form of requestData.
+type matrixRequest struct {
+	Namespaces       []string              `json:"namespaces,omitempty"`
+	Names            []string              `json:"names,omitempty"`
+	Verbs            []string              `json:"verbs,omitempty"`
+	APIGroups        []string              `json:"apiGroups,omitempty"`
+	Resources        []string              `json:"resources,omitempty"`
+	Subresources     []string              `json:"subresources,omitempty"`
+	NonResourceVerbs []string              `json:"nonResourceVerbs,omitempty"`
+	NonResourcePaths []string              `json:"nonResourcePaths,omitempty"`
+	Users            []string              `json:"users,omitempty"`
+	Groups           [][]string            `json:"groups,omitempty"`
+	UIDs             []string              `json:"uids,omitempty"`
+	Extra            []map[string][]string `json:"extra,omitempty"`
+	ServiceAccounts  []string              `json:"serviceAccounts,omitempty"`
+}
+
+const (
+	matrixAllowed   = "allowed"
+	matrixDenied    = "denied"
+	matrixUndecided = "undecided"
+)
+
+// matrixExpect is the YAML/JSON form of response. It is either one of
+// allowed, denied or undecided, or an object with the result, the expected
+// reasons and optionally the status code, e.g.:
+//
+//	expect: denied
+//	expect: {result: undecided, reason: ["access undecided"]}
+type matrixExpect struct {
+	Result string   `json:"result"`
+	Reason []string `json:"reason,omitempty"`
+	Status int      `json:"status,omitempty"`
+}
+
+func (e *matrixExpect) UnmarshalJSON(data []byte) error {
+	var result string
+	if err := json.Unmarshal(data, &result); err == nil {
+		*e = matrixExpect{Result: result}
+		return nil
+	}
+
+	// avoid recursing into UnmarshalJSON
+	type plain matrixExpect
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*e = matrixExpect(p)
+	return nil
+}
+
+func (e *matrixExpect) response() (response, error) {
+	var rsp response
+	switch e.Result {
+	case matrixAllowed:
+		rsp = allowed
+	case matrixDenied:
+		rsp = denied
+	case matrixUndecided:
+		rsp = undecided
+	default:
+		return response{}, fmt.Errorf("unknown result %q, must be one of: %s, %s, %s", e.Result, matrixAllowed, matrixDenied, matrixUndecided)
+	}
+
+	if e.Status != 0 {
+		rsp.status = e.Status
+	}
+	if len(e.Reason) > 0 {
+		rsp.reason = e.Reason
+	}
+
+	return rsp, nil
+}
+
+func (item matrixItem) testItem() (testItem, error) {
+	test := testItem{
+		name: item.Name,
+		request: requestData{
+			namespaces:       nonEmpty(item.Request.Namespaces),
+			names:            nonEmpty(item.Request.Names),
+			verbs:            nonEmpty(item.Request.Verbs),
+			apiGroups:        nonEmpty(item.Request.APIGroups),
+			resources:        nonEmpty(item.Request.Resources),
+			subresources:     nonEmpty(item.Request.Subresources),
+			nonResourceVerbs: nonEmpty(item.Request.NonResourceVerbs),
+			nonResourcePaths: nonEmpty(item.Request.NonResourcePaths),
+			users:            nonEmpty(item.Request.Users),
+			groups:           nonEmpty(item.Request.Groups),
+			uids:             nonEmpty(item.Request.UIDs),
+			extras:           nonEmpty(item.Request.Extra),
+			serviceAccounts:  nonEmpty(item.Request.ServiceAccounts),
+		},
+	}
+
+	if item.Expect != nil {
+		rsp, err := item.Expect.response()
+		if err != nil {
+			return testItem{}, fmt.Errorf("%s: %w", item.Name, err)
+		}
+		test.expect = rsp
+	}
+
+	for _, subitem := range item.Items {
+		subtest, err := subitem.testItem()
+		if err != nil {
+			return testItem{}, fmt.Errorf("%s/%w", item.Name, err)
+		}
+		test.items = append(test.items, subtest)
+	}
+
+	return test, nil
+}
+
+// nonEmpty returns nil for empty lists, so that the loaded items are equal
+// to the ones built with req().
+func nonEmpty[T any](values []T) []T {
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+// loadTestMatrix parses an authorization test matrix in YAML or JSON. Unknown
+// fields are rejected, so that typos don't silently widen a test case.
+func loadTestMatrix(data []byte) ([]testItem, error) {
+	var items []matrixItem
+	if err := yaml.UnmarshalStrict(data, &items); err != nil {
+		return nil, err
+	}
+
+	tests := make([]testItem, 0, len(items))
+	for _, item := range items {
+		test, err := item.testItem()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+	}
+
+	return tests, nil
+}
+
+// defaultTestMatrix is the authorization test matrix used unless
+// AUTHORIZATION_MATRIX is set.
+//
+//go:embed testdata/authorization-matrix.yaml
+var defaultTestMatrix []byte
+
+// loadDefaultTestMatrix parses the default authorization test matrix.
+func loadDefaultTestMatrix() ([]testItem, error) {
+	tests, err := loadTestMatrix(defaultTestMatrix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load authorization test matrix testdata/authorization-matrix.yaml: %w", err)
+	}
+	return tests, nil
+}
+
+// loadTestMatrixFile parses the authorization test matrix in the file at
+// path.
+func loadTestMatrixFile(path string) ([]testItem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tests, err := loadTestMatrix(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load authorization test matrix %s: %w", path, err)
+	}
+	return tests, nil
+}
+
+// matrixCase formats an expanded test case as a line of
+// testdata/authorization-matrix-cases.txt: the name, the spec of its
+// SubjectAccessReview and the expected response.
+func matrixCase(item testItem) (string, error) {
+	spec, err := json.Marshal(item.subjectReview().Spec)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s => status=%d allowed=%t denied=%t reason=%q",
+		item.name, spec, item.expect.status, item.expect.allowed, item.expect.denied, item.expect.reason), nil
+}
+
+// defaultTestMatrixCases are the expanded cases of the authorization test
+// matrix which was defined in Go before it was moved to
+// testdata/authorization-matrix.yaml. Changes of the matrix have to be made
+// in both files.
+//
+//go:embed testdata/authorization-matrix-cases.txt
+var defaultTestMatrixCases string
+
+func TestLoadDefaultTestMatrix(t *testing.T) {
+	tests, err := loadDefaultTestMatrix()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]bool{}
+	for _, test := range tests {
+		if names[test.name] {
+			t.Errorf("duplicate top-level item %q", test.name)
+		}
+		names[test.name] = true
+	}
+
+	var cases []string
+	for _, test := range expandAll(tests) {
+		c, err := matrixCase(test)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases = append(cases, c)
+	}
+
+	expected := strings.Split(strings.TrimSuffix(defaultTestMatrixCases, "\n"), "\n")
+	for i := range max(len(cases), len(expected)) {
+		switch {
+		case i >= len(cases):
+			t.Errorf("missing case %d: %s", i, expected[i])
+		case i >= len(expected):
+			t.Errorf("unexpected case %d: %s", i, cases[i])
+		case cases[i] != expected[i]:
+			t.Errorf("case %d differs:\nexpected: %s\ngot:      %s", i, expected[i], cases[i])
+		default:
+			continue
+		}
+		t.Fatalf("expected %d cases, got %d", len(expected), len(cases))
+	}
+}
+
+func TestLoadTestMatrix(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		matrix   string
+		expected []testItem
+		err      bool
+	}{{
+		name: "inherits and expands like a testItem",
+		matrix: `
+- name: parent
+  request:
+    users: [test-user]
+    groups:
+    - [ReadOnly]
+    - [PowerUser]
+  expect: denied
+  items:
+  - name: child
+    request:
+      verbs: [get]
+      resources: [pods, secrets]
+  - name: override
+    request:
+      groups:
+      - [Administrator]
+    expect:
+      result: undecided
+      reason: [not allowed]
+`,
+		expected: []testItem{{
+			name:    "parent",
+			request: req().user("test-user").setGroups([]string{"ReadOnly"}, []string{"PowerUser"}),
+			expect:  denied,
+			items: []testItem{{
+				name:    "child",
+				request: req().verb("get").res("pods", "secrets"),
+			}, {
+				name:    "override",
+				request: req().setGroups([]string{"Administrator"}),
+				expect:  undecidedReason("not allowed"),
+			}},
+		}},
+	}, {
+		name:   "json",
+		matrix: `[{"name": "json", "request": {"verbs": ["get"]}, "expect": {"result": "allowed", "status": 403}}]`,
+		expected: []testItem{{
+			name:    "json",
+			request: req().verb("get"),
+			expect:  expect(http.StatusForbidden, true, false),
+		}},
+	}, {
+		name: "unknown result",
+		matrix: `
+- name: invalid
+  expect: allow
+`,
+		err: true,
+	}, {
+		name: "unknown field",
+		matrix: `
+- name: invalid
+  request:
+    verb: [get]
+`,
+		err: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			tests, err := loadTestMatrix([]byte(tc.matrix))
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(tests, tc.expected) {
+				t.Fatalf("expected %+v, got %+v", tc.expected, tests)
+			}
+
+			for i := range tests {
+				if !reflect.DeepEqual(tests[i].expand(), tc.expected[i].expand()) {
+					t.Errorf("expanded cases of %s differ", tests[i].name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,489 @@
+package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"text/template"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/kubernetes/plugin/pkg/auth/authorizer/rbac"
+	"k8s.io/kubernetes/plugin/pkg/auth/authorizer/rbac/bootstrappolicy"
+	"sigs.k8s.io/yaml"
+)
+
+// rbacEnvironment is the cluster environment the manifests are rendered for,
+// matching the e2e clusters.
+const rbacEnvironment = "e2e"
+
+// rbacManifests are the manifests, relative to this package, with the RBAC
+// objects exercised by the authorization tests.
+var rbacManifests = []string{
+	"../../cluster/manifests/roles",
+	"../../cluster/manifests/skipper/skipper-default-filter-writers.yaml",
+}
+
+// rbacPolicy holds all Roles, ClusterRoles and bindings of a cluster and
+// implements the getters and listers used by the RBAC authorizer.
+type rbacPolicy struct {
+	roles               map[string]map[string]*rbacv1.Role
+	roleBindings        map[string][]*rbacv1.RoleBinding
+	clusterRoles        map[string]*rbacv1.ClusterRole
+	clusterRoleBindings []*rbacv1.ClusterRoleBinding
+
+	// manifests are the manifests the roles were loaded from. Roles of the
+	// bootstrap policy are not included.
+	manifests map[roleKey]string
+}
+
+// roleKey identifies a Role or ClusterRole.
+type roleKey struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+func newRBACPolicy() *rbacPolicy {
+	return &rbacPolicy{
+		roles:        make(map[string]map[string]*rbacv1.Role),
+		roleBindings: make(map[string][]*rbacv1.RoleBinding),
+		clusterRoles: make(map[string]*rbacv1.ClusterRole),
+		manifests:    make(map[roleKey]string),
+	}
+}
+
+func (p *rbacPolicy) GetRole(namespace, name string) (*rbacv1.Role, error) {
+	if role, ok := p.roles[namespace][name]; ok {
+		return role, nil
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Group: rbacv1.GroupName, Resource: "roles"}, name)
+}
+
+func (p *rbacPolicy) ListRoleBindings(namespace string) ([]*rbacv1.RoleBinding, error) {
+	return p.roleBindings[namespace], nil
+}
+
+func (p *rbacPolicy) GetClusterRole(name string) (*rbacv1.ClusterRole, error) {
+	if role, ok := p.clusterRoles[name]; ok {
+		return role, nil
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Group: rbacv1.GroupName, Resource: "clusterroles"}, name)
+}
+
+func (p *rbacPolicy) ListClusterRoleBindings() ([]*rbacv1.ClusterRoleBinding, error) {
+	return p.clusterRoleBindings, nil
+}
+
+func (p *rbacPolicy) addRole(role *rbacv1.Role) {
+	if p.roles[role.Namespace] == nil {
+		p.roles[role.Namespace] = make(map[string]*rbacv1.Role)
+	}
+	p.roles[role.Namespace][role.Name] = role
+}
+
+func (p *rbacPolicy) addRoleBinding(binding *rbacv1.RoleBinding) {
+	p.roleBindings[binding.Namespace] = append(p.roleBindings[binding.Namespace], binding)
+}
+
+func (p *rbacPolicy) addClusterRole(role *rbacv1.ClusterRole) {
+	p.clusterRoles[role.Name] = role
+}
+
+func (p *rbacPolicy) addClusterRoleBinding(binding *rbacv1.ClusterRoleBinding) {
+	p.clusterRoleBindings = append(p.clusterRoleBindings, binding)
+}
+
+// addBootstrapPolicy adds the default roles and bindings created by the API
+// server.
+func (p *rbacPolicy) addBootstrapPolicy() {
+	for _, role := range append(bootstrappolicy.ClusterRoles(), bootstrappolicy.ControllerRoles()...) {
+		p.addClusterRole(role.DeepCopy())
+	}
+	for _, binding := range append(bootstrappolicy.ClusterRoleBindings(), bootstrappolicy.ControllerRoleBindings()...) {
+		p.addClusterRoleBinding(binding.DeepCopy())
+	}
+	for namespace, roles := range bootstrappolicy.NamespaceRoles() {
+		for _, role := range roles {
+			role := role.DeepCopy()
+			role.Namespace = namespace
+			p.addRole(role)
+		}
+	}
+	for namespace, bindings := range bootstrappolicy.NamespaceRoleBindings() {
+		for _, binding := range bindings {
+			binding := binding.DeepCopy()
+			binding.Namespace = namespace
+			p.addRoleBinding(binding)
+		}
+	}
+}
+
+// aggregate fills the rules of aggregated ClusterRoles like the clusterrole
+// aggregation controller does.
+func (p *rbacPolicy) aggregate() error {
+	// aggregated roles can select other aggregated roles, so repeat until
+	// nothing changes anymore.
+	for changed := true; changed; {
+		changed = false
+		for _, role := range p.clusterRoles {
+			if role.AggregationRule == nil {
+				continue
+			}
+
+			var rules []rbacv1.PolicyRule
+			for _, name := range sortedKeys(p.clusterRoles) {
+				source := p.clusterRoles[name]
+				if source.Name == role.Name {
+					continue
+				}
+
+				for _, selector := range role.AggregationRule.ClusterRoleSelectors {
+					s, err := metav1.LabelSelectorAsSelector(&selector)
+					if err != nil {
+						return fmt.Errorf("invalid aggregation rule of ClusterRole %s: %w", role.Name, err)
+					}
+					if s.Matches(labels.Set(source.Labels)) {
+						rules = appendMissingRules(rules, source.Rules...)
+						break
+					}
+				}
+			}
+
+			if !reflect.DeepEqual(rules, role.Rules) {
+				role.Rules = rules
+				changed = true
+			}
+		}
+	}
+	return nil
+}
+
+func appendMissingRules(rules []rbacv1.PolicyRule, add ...rbacv1.PolicyRule) []rbacv1.PolicyRule {
+	for _, rule := range add {
+		found := false
+		for _, existing := range rules {
+			if reflect.DeepEqual(existing, rule) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// rbacManifestData is the data the manifests are rendered with. Config items
+// which are not set render as empty strings, i.e. optional components are
+// disabled.
+type rbacManifestData struct {
+	Cluster struct {
+		Environment string
+		ConfigItems map[string]string
+	}
+}
+
+// loadManifests adds the RBAC objects of the manifest at path, or of all
+// manifests in it if it's a directory. The manifests are rendered as
+// templates first, objects of other kinds are ignored.
+func (p *rbacPolicy) loadManifests(path string) error {
+	files := []string{path}
+	if info, err := os.Stat(path); err != nil {
+		return err
+	} else if info.IsDir() {
+		files, err = filepath.Glob(filepath.Join(path, "*.yaml"))
+		if err != nil {
+			return err
+		}
+	}
+
+	var data rbacManifestData
+	data.Cluster.Environment = rbacEnvironment
+	data.Cluster.ConfigItems = map[string]string{}
+
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		tmpl, err := template.New(filepath.Base(file)).Parse(string(content))
+		if err != nil {
+			return err
+		}
+
+		var rendered bytes.Buffer
+		if err := tmpl.Execute(&rendered, data); err != nil {
+			return err
+		}
+
+		if err := p.loadObjects(file, rendered.Bytes()); err != nil {
+			return fmt.Errorf("failed to load %s: %w", file, err)
+		}
+	}
+
+	return nil
+}
+
+// loadObjects adds the RBAC objects of the manifest loaded from source.
+func (p *rbacPolicy) loadObjects(source string, manifest []byte) error {
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(manifest)))
+	for {
+		document, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var meta metav1.TypeMeta
+		if err := yaml.Unmarshal(document, &meta); err != nil {
+			return err
+		}
+
+		if meta.APIVersion != rbacv1.SchemeGroupVersion.String() {
+			continue
+		}
+
+		switch meta.Kind {
+		case "Role":
+			var role rbacv1.Role
+			if err := yaml.Unmarshal(document, &role); err != nil {
+				return err
+			}
+			p.addRole(&role)
+			p.manifests[roleKey{kind: meta.Kind, namespace: role.Namespace, name: role.Name}] = source
+		case "RoleBinding":
+			var binding rbacv1.RoleBinding
+			if err := yaml.Unmarshal(document, &binding); err != nil {
+				return err
+			}
+			p.addRoleBinding(&binding)
+		case "ClusterRole":
+			var role rbacv1.ClusterRole
+			if err := yaml.Unmarshal(document, &role); err != nil {
+				return err
+			}
+			p.addClusterRole(&role)
+			p.manifests[roleKey{kind: meta.Kind, name: role.Name}] = source
+		case "ClusterRoleBinding":
+			var binding rbacv1.ClusterRoleBinding
+			if err := yaml.Unmarshal(document, &binding); err != nil {
+				return err
+			}
+			p.addClusterRoleBinding(&binding)
+		}
+	}
+}
+
+// rbacBackend evaluates the SubjectAccessReviews in-process with the
+// upstream RBAC authorizer. It only knows about RBAC, so decisions of the
+// authorization webhook which runs before RBAC in the API server are not
+// reflected: requests are either allowed or undecided.
+type rbacBackend struct {
+	authorizer *rbac.RBACAuthorizer
+}
+
+// loadRBACPolicy returns the bootstrap policy of the API server with the RBAC
+// objects of the manifests at paths.
+func loadRBACPolicy(paths ...string) (*rbacPolicy, error) {
+	policy := newRBACPolicy()
+	policy.addBootstrapPolicy()
+
+	for _, path := range paths {
+		if err := policy.loadManifests(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := policy.aggregate(); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// newRBACBackend returns a backend with the bootstrap policy of the API
+// server and the RBAC objects of the manifests at paths.
+func newRBACBackend(paths ...string) (*rbacBackend, error) {
+	policy, err := loadRBACPolicy(paths...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rbacBackend{
+		authorizer: rbac.New(policy, policy, policy, policy),
+	}, nil
+}
+
+// reviewAttributes returns the attributes the API server authorizes for a
+// SubjectAccessReview.
+func reviewAttributes(review *authorizationv1.SubjectAccessReview) authorizer.AttributesRecord {
+	info := &user.DefaultInfo{
+		Name:   review.Spec.User,
+		UID:    review.Spec.UID,
+		Groups: review.Spec.Groups,
+	}
+	if len(review.Spec.Extra) > 0 {
+		info.Extra = make(map[string][]string, len(review.Spec.Extra))
+		for key, value := range review.Spec.Extra {
+			info.Extra[key] = value
+		}
+	}
+
+	attributes := authorizer.AttributesRecord{User: info}
+
+	if review.Spec.ResourceAttributes != nil {
+		attributes.ResourceRequest = true
+		attributes.Verb = review.Spec.ResourceAttributes.Verb
+		attributes.Namespace = review.Spec.ResourceAttributes.Namespace
+		attributes.APIGroup = review.Spec.ResourceAttributes.Group
+		attributes.Resource = review.Spec.ResourceAttributes.Resource
+		attributes.Subresource = review.Spec.ResourceAttributes.Subresource
+		attributes.Name = review.Spec.ResourceAttributes.Name
+	} else if review.Spec.NonResourceAttributes != nil {
+		attributes.Verb = review.Spec.NonResourceAttributes.Verb
+		attributes.Path = review.Spec.NonResourceAttributes.Path
+	}
+
+	return attributes
+}
+
+func (b *rbacBackend) review(ctx context.Context, review *authorizationv1.SubjectAccessReview) (*authorizationv1.SubjectAccessReviewStatus, error) {
+	decision, reason, err := b.authorizer.Authorize(ctx, reviewAttributes(review))
+	if err != nil {
+		return nil, err
+	}
+
+	return &authorizationv1.SubjectAccessReviewStatus{
+		Allowed: decision == authorizer.DecisionAllow,
+		Reason:  reason,
+	}, nil
+}
+
+func TestAuthorizationMatrixRBAC(t *testing.T) {
+	backend, err := newRBACBackend(rbacManifests...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests, err := authorizationTests()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cases []testItem
+	skipped := 0
+	for _, test := range expandAll(tests) {
+		// explicit denials are decided by the authorization webhook,
+		// before RBAC is consulted
+		if test.expect.denied {
+			skipped++
+			continue
+		}
+
+		// the reasons are given by the authorization webhook
+		test.expect.reason = nil
+		cases = append(cases, test)
+	}
+
+	report := runAuthorizationTests(context.Background(), backend, cases, authorizationParallelism)
+	if len(report.failures) > 0 {
+		t.Error(report)
+	}
+
+	t.Logf("skipped %d cases expected to be denied by the authorization webhook", skipped)
+}
+
+func TestRBACBackend(t *testing.T) {
+	policy := newRBACPolicy()
+	err := policy.loadObjects("test.yaml", []byte(`
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: aggregated
+aggregationRule:
+  clusterRoleSelectors:
+  - matchLabels:
+      aggregate-to: aggregated
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: pods
+  labels:
+    aggregate-to: aggregated
+rules:
+- apiGroups: [""]
+  resources: [pods]
+  verbs: [get]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: aggregated
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: aggregated
+subjects:
+- apiGroup: rbac.authorization.k8s.io
+  kind: Group
+  name: ReadOnly
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.aggregate(); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &rbacBackend{authorizer: rbac.New(policy, policy, policy, policy)}
+	report := runAuthorizationTests(context.Background(), backend, []testItem{{
+		name:    "allowed by aggregated role",
+		request: req().ns("teapot").verb("get").res("pods").user("test-user").setGroups([]string{"ReadOnly"}),
+		expect:  allowed,
+	}, {
+		name:    "verb not in aggregated role",
+		request: req().ns("teapot").verb("delete").res("pods").user("test-user").setGroups([]string{"ReadOnly"}),
+		expect:  undecided,
+	}, {
+		name:    "group not bound",
+		request: req().ns("teapot").verb("get").res("pods").user("test-user").setGroups([]string{"PowerUser"}),
+		expect:  undecided,
+	}}, 1)
+	if len(report.failures) > 0 {
+		t.Error(report)
+	}
+}
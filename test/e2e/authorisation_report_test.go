@@ -0,0 +1,264 @@
+package e2e
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// decision returns allowed, denied or undecided.
+func (rsp response) decision() string {
+	switch {
+	case rsp.allowed:
+		return matrixAllowed
+	case rsp.denied:
+		return matrixDenied
+	default:
+		return matrixUndecided
+	}
+}
+
+// diff returns the differences of the actual response to the expected one.
+// Undecided is considered as denied.
+func (rsp response) diff(actual response) []string {
+	if actual.status != rsp.status {
+		return []string{
+			fmt.Sprintf("status: expected %d, got %d: %s", rsp.status, actual.status, strings.Join(actual.reason, "; ")),
+		}
+	}
+
+	var diffs []string
+	if actual.allowed != rsp.allowed || rsp.denied && actual.allowed {
+		diffs = append(diffs, fmt.Sprintf("allowed: expected %t, got %t", rsp.allowed, actual.allowed))
+		if actual.denied != rsp.denied {
+			diffs = append(diffs, fmt.Sprintf("denied: expected %t, got %t", rsp.denied, actual.denied))
+		}
+	}
+
+	reason := strings.Join(actual.reason, "; ")
+	for _, r := range rsp.reason {
+		if !strings.Contains(reason, r) {
+			diffs = append(diffs, fmt.Sprintf("reason: expected to contain %q, got %q", r, reason))
+		}
+	}
+
+	return diffs
+}
+
+// reviewResponse converts the result of a SubjectAccessReview to a response
+// comparable to the expectation of a test. Errors returned by the API server
+// are converted to their status code.
+func reviewResponse(status *authorizationv1.SubjectAccessReviewStatus, err error) (response, error) {
+	if err != nil {
+		var apiStatus apierrors.APIStatus
+		if errors.As(err, &apiStatus) {
+			return response{
+				status: int(apiStatus.Status().Code),
+				reason: []string{apiStatus.Status().Message},
+			}, nil
+		}
+		return response{}, err
+	}
+
+	return response{
+		status:  http.StatusCreated,
+		allowed: status.Allowed,
+		denied:  status.Denied,
+		reason:  []string{status.Reason},
+	}, nil
+}
+
+// authorizationFailure is a test case whose result doesn't match its
+// expectation, or which couldn't be evaluated.
+type authorizationFailure struct {
+	test   testItem
+	actual response
+	diff   []string
+	err    error
+}
+
+// authorizationReport is the result of evaluating a list of test cases.
+type authorizationReport struct {
+	total    int
+	failures []authorizationFailure
+}
+
+func (r *authorizationReport) String() string {
+	if len(r.failures) == 0 {
+		return fmt.Sprintf("all %d authorization cases passed", r.total)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d of %d authorization cases failed:\n", len(r.failures), r.total)
+	for _, failure := range r.failures {
+		fmt.Fprintf(&b, "\n%s\n", failure.test)
+		if failure.err != nil {
+			fmt.Fprintf(&b, "    error: %v\n", failure.err)
+			continue
+		}
+		for _, diff := range failure.diff {
+			fmt.Fprintf(&b, "    %s\n", diff)
+		}
+	}
+	return b.String()
+}
+
+// expandAll returns the expanded cases of all tests.
+func expandAll(tests []testItem) []testItem {
+	var cases []testItem
+	for _, test := range tests {
+		cases = append(cases, test.expand()...)
+	}
+	return cases
+}
+
+// runAuthorizationTests evaluates the expanded test cases with up to
+// parallelism concurrent reviews, and reports all cases which don't match
+// their expectation. Cases which weren't evaluated before ctx is done are
+// reported as failed.
+func runAuthorizationTests(ctx context.Context, backend authorizationBackend, cases []testItem, parallelism int) *authorizationReport {
+	failures := make([]*authorizationFailure, len(cases))
+	evaluated := make([]bool, len(cases))
+
+	workqueue.ParallelizeUntil(ctx, parallelism, len(cases), func(i int) {
+		test := cases[i]
+		evaluated[i] = true
+
+		actual, err := reviewResponse(backend.review(ctx, test.subjectReview()))
+		if err != nil {
+			failures[i] = &authorizationFailure{test: test, err: err}
+			return
+		}
+
+		if diff := test.expect.diff(actual); len(diff) > 0 {
+			failures[i] = &authorizationFailure{test: test, actual: actual, diff: diff}
+		}
+	})
+
+	report := &authorizationReport{total: len(cases)}
+	for i, failure := range failures {
+		if !evaluated[i] {
+			failure = &authorizationFailure{test: cases[i], err: fmt.Errorf("not evaluated: %w", ctx.Err())}
+		}
+		if failure != nil {
+			report.failures = append(report.failures, *failure)
+		}
+	}
+	return report
+}
+
+func TestRunAuthorizationTests(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		switch review.Spec.User {
+		case "admin":
+			review.Status = authorizationv1.SubjectAccessReviewStatus{Allowed: true, Reason: "allowed by admin"}
+		case "denied":
+			review.Status = authorizationv1.SubjectAccessReviewStatus{Denied: true, Reason: "denied by webhook"}
+		case "forbidden":
+			return true, nil, apierrors.NewForbidden(authorizationv1.Resource("subjectaccessreviews"), "", errors.New("not allowed"))
+		}
+		return true, review, nil
+	})
+
+	cases := expandAll([]testItem{{
+		name:    "matching",
+		request: req().verb("get").res("pods").user("admin", "denied"),
+		items: []testItem{{
+			name:    "admin",
+			request: req().user("admin"),
+			expect:  allowed,
+		}, {
+			name:    "denied",
+			request: req().user("denied"),
+			expect:  deniedReason("denied by webhook"),
+		}},
+	}, {
+		name:    "mismatching",
+		request: req().verb("get").res("pods"),
+		items: []testItem{{
+			name:    "allowed instead of denied",
+			request: req().user("admin"),
+			expect:  denied,
+		}, {
+			name:    "wrong reason",
+			request: req().user("denied"),
+			expect:  deniedReason("not bound"),
+		}, {
+			name:    "api error",
+			request: req().user("forbidden"),
+			expect:  undecided,
+		}},
+	}})
+
+	report := runAuthorizationTests(context.Background(), &apiServerBackend{client: client}, cases, 2)
+	if report.total != 5 {
+		t.Errorf("expected 5 cases, got %d", report.total)
+	}
+
+	expected := map[string][]string{
+		"mismatching/allowed instead of denied": {
+			"allowed: expected false, got true",
+			"denied: expected true, got false",
+		},
+		"mismatching/wrong reason": {
+			`reason: expected to contain "not bound", got "denied by webhook"`,
+		},
+		"mismatching/api error": {
+			"status: expected 201, got 403: subjectaccessreviews.authorization.k8s.io is forbidden: not allowed",
+		},
+	}
+
+	if len(report.failures) != len(expected) {
+		t.Fatalf("expected %d failures, got:\n%s", len(expected), report)
+	}
+
+	for _, failure := range report.failures {
+		diff, ok := expected[failure.test.name]
+		if !ok {
+			t.Errorf("unexpected failure of %s", failure.test.name)
+			continue
+		}
+		if !reflect.DeepEqual(failure.diff, diff) {
+			t.Errorf("%s: expected diff %q, got %q", failure.test.name, diff, failure.diff)
+		}
+	}
+
+	// the failures are reported in the order of the cases
+	if report.failures[0].test.name != "mismatching/allowed instead of denied" {
+		t.Errorf("unexpected order of failures:\n%s", report)
+	}
+}
+
+func TestRunAuthorizationTestsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cases := expandAll([]testItem{{
+		name:    "cancelled",
+		request: req().verb("get").res("pods").user("a", "b"),
+		expect:  undecided,
+	}})
+
+	report := runAuthorizationTests(ctx, &apiServerBackend{client: fake.NewSimpleClientset()}, cases, 1)
+	if len(report.failures) != len(cases) {
+		t.Fatalf("expected all cases to fail, got:\n%s", report)
+	}
+	for _, failure := range report.failures {
+		if !errors.Is(failure.err, context.Canceled) {
+			t.Errorf("expected cancellation error, got %v", failure.err)
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/yaml"
+)
+
+// snapshotTests returns a broad matrix of subjects, verbs and resources
+// without expectations. Their decisions are recorded in snapshots to find
+// changes of the effective permissions.
+func snapshotTests() []testItem {
+	requests := []testItem{{
+		name: "resources",
+		request: req().ns("", "teapot", "kube-system").
+			verb("get", "list", "watch", "create", "update", "patch", "delete", "deletecollection").
+			res(
+				"pods",
+				"services",
+				"endpoints",
+				"configmaps",
+				"secrets",
+				"serviceaccounts",
+				"persistentvolumeclaims",
+				"persistentvolumes",
+				"nodes",
+				"namespaces",
+				"events",
+				"apps/deployments",
+				"apps/statefulsets",
+				"apps/daemonsets",
+				"batch/jobs",
+				"batch/cronjobs",
+				"networking.k8s.io/ingresses",
+				"policy/poddisruptionbudgets",
+				"rbac.authorization.k8s.io/roles",
+				"rbac.authorization.k8s.io/rolebindings",
+				"rbac.authorization.k8s.io/clusterroles",
+				"rbac.authorization.k8s.io/clusterrolebindings",
+				"apiextensions.k8s.io/customresourcedefinitions",
+				"zalando.org/stacksets",
+				"zalando.org/routegroups",
+			),
+	}, {
+		name: "subresources",
+		request: req().ns("teapot", "kube-system").verb("get", "create").res("pods").
+			subres("exec", "attach", "portforward", "log", "eviction"),
+	}, {
+		name:    "escalation",
+		request: req().ns("", "teapot", "kube-system").verb("escalate", "bind").res("rbac.authorization.k8s.io/roles", "rbac.authorization.k8s.io/clusterroles"),
+	}, {
+		name:    "impersonation",
+		request: req().verb("impersonate").res("users", "groups", "serviceaccounts"),
+	}, {
+		name:    "non-resource",
+		request: req().nonResVerb("get").nonResPath("/metrics", "/healthz", "/logs"),
+	}}
+
+	tests := []testItem{{
+		name: "users",
+		request: req().user("test-user").
+			setGroups(
+				[]string{readOnlyGroup},
+				[]string{powerUserGroup},
+				[]string{emergencyGroup},
+				[]string{manualGroup},
+				[]string{"CollaboratorEmergency"},
+				[]string{"CollaboratorManual"},
+				[]string{"Collaborator24x7"},
+				[]string{"CollaboratorPowerUser"},
+				[]string{"Administrator"},
+				[]string{"system:masters"},
+			),
+		items: requests,
+	}}
+
+	for _, sa := range []string{"default/default", "kube-system/default", "teapot/operator"} {
+		tests = append(tests, testItem{
+			name:    "service account " + sa,
+			request: req().serviceAccount(sa),
+			items:   requests,
+		})
+	}
+
+	return tests
+}
+
+// snapshotKey identifies a SubjectAccessReview in a snapshot independent of
+// the name of the test case.
+func snapshotKey(review *authorizationv1.SubjectAccessReview) string {
+	attrs := []string{
+		"user=" + review.Spec.User,
+		"groups=" + strings.Join(review.Spec.Groups, ","),
+	}
+	if review.Spec.UID != "" {
+		attrs = append(attrs, "uid="+review.Spec.UID)
+	}
+	for _, key := range sortedKeys(review.Spec.Extra) {
+		attrs = append(attrs, fmt.Sprintf("extra.%s=%s", key, strings.Join(review.Spec.Extra[key], ",")))
+	}
+
+	if review.Spec.NonResourceAttributes != nil {
+		attrs = append(attrs,
+			"verb="+review.Spec.NonResourceAttributes.Verb,
+			"path="+review.Spec.NonResourceAttributes.Path,
+		)
+		return strings.Join(attrs, " ")
+	}
+
+	resource := review.Spec.ResourceAttributes
+	if resource.Namespace != "" {
+		attrs = append(attrs, "namespace="+resource.Namespace)
+	}
+
+	name := resource.Resource
+	if resource.Group != "" {
+		name = resource.Group + "/" + name
+	}
+	if resource.Subresource != "" {
+		name += "/" + resource.Subresource
+	}
+	attrs = append(attrs, "verb="+resource.Verb, "resource="+name)
+	if resource.Name != "" {
+		attrs = append(attrs, "name="+resource.Name)
+	}
+
+	return strings.Join(attrs, " ")
+}
+
+// authorizationSnapshot records the decision, allowed, denied or undecided,
+// of every SubjectAccessReview by its key.
+type authorizationSnapshot struct {
+	Decisions map[string]string `json:"decisions"`
+}
+
+// takeAuthorizationSnapshot records the decisions of the backend for all
+// cases with up to parallelism concurrent reviews.
+func takeAuthorizationSnapshot(ctx context.Context, backend authorizationBackend, cases []testItem, parallelism int) (*authorizationSnapshot, error) {
+	snapshot := &authorizationSnapshot{Decisions: make(map[string]string, len(cases))}
+
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	workqueue.ParallelizeUntil(ctx, parallelism, len(cases), func(i int) {
+		review := cases[i].subjectReview()
+		actual, err := reviewResponse(backend.review(ctx, review))
+		if err == nil && actual.status != http.StatusCreated {
+			err = errors.New(strings.Join(actual.reason, "; "))
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", cases[i], err))
+			return
+		}
+		snapshot.Decisions[snapshotKey(review)] = actual.decision()
+	})
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return snapshot, nil
+}
+
+func readAuthorizationSnapshot(path string) (*authorizationSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot authorizationSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to read authorization snapshot %s: %w", path, err)
+	}
+	return &snapshot, nil
+}
+
+func writeAuthorizationSnapshot(path string, snapshot *authorizationSnapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// snapshotFlip is a SubjectAccessReview which was allowed in one snapshot
+// and not in the other.
+type snapshotFlip struct {
+	Case string `json:"case"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (f snapshotFlip) String() string {
+	return fmt.Sprintf("%s -> %s: %s", f.From, f.To, f.Case)
+}
+
+// snapshotDiff is the difference between two snapshots.
+type snapshotDiff struct {
+	// Flips are the reviews which flipped between allowed and denied or
+	// undecided and weren't approved.
+	Flips []snapshotFlip
+	// Approved are the flips which were approved.
+	Approved []snapshotFlip
+	// Added and Removed are the reviews only in the new or old snapshot.
+	Added, Removed []string
+}
+
+func (d *snapshotDiff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d unapproved and %d approved authorization flips, %d reviews added, %d reviews removed\n", len(d.Flips), len(d.Approved), len(d.Added), len(d.Removed))
+	for _, flip := range d.Flips {
+		fmt.Fprintf(&b, "    %s\n", flip)
+	}
+	return b.String()
+}
+
+// diffAuthorizationSnapshots returns all reviews whose decision flipped
+// between allowed and not allowed. Changes between denied and undecided are
+// not flips. Flips listed in approved don't fail the comparison.
+func diffAuthorizationSnapshots(old, new *authorizationSnapshot, approved []snapshotFlip) *snapshotDiff {
+	approvals := make(map[snapshotFlip]struct{}, len(approved))
+	for _, flip := range approved {
+		approvals[flip] = struct{}{}
+	}
+
+	diff := &snapshotDiff{}
+	for _, key := range sortedKeys(new.Decisions) {
+		to := new.Decisions[key]
+		from, ok := old.Decisions[key]
+		if !ok {
+			diff.Added = append(diff.Added, key)
+			continue
+		}
+
+		if (from == matrixAllowed) == (to == matrixAllowed) {
+			continue
+		}
+
+		flip := snapshotFlip{Case: key, From: from, To: to}
+		if _, ok := approvals[flip]; ok {
+			diff.Approved = append(diff.Approved, flip)
+			continue
+		}
+		diff.Flips = append(diff.Flips, flip)
+	}
+
+	for key := range old.Decisions {
+		if _, ok := new.Decisions[key]; !ok {
+			diff.Removed = append(diff.Removed, key)
+		}
+	}
+	sort.Strings(diff.Removed)
+
+	return diff
+}
+
+// readApprovedFlips reads the approved flips from a YAML or JSON list of
+// objects with case, from and to.
+func readApprovedFlips(path string) ([]snapshotFlip, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var flips []snapshotFlip
+	if err := yaml.UnmarshalStrict(data, &flips); err != nil {
+		return nil, fmt.Errorf("failed to read approved authorization flips %s: %w", path, err)
+	}
+	return flips, nil
+}
+
+// compareAuthorizationSnapshot compares the snapshot with the one stored at
+// path. If there is none yet, the snapshot is stored instead. Otherwise the
+// new snapshot is written next to it with a .new suffix, so that it can
+// replace the old one once all flips are approved.
+func compareAuthorizationSnapshot(path, approvedPath string, snapshot *authorizationSnapshot) (*snapshotDiff, error) {
+	old, err := readAuthorizationSnapshot(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &snapshotDiff{}, writeAuthorizationSnapshot(path, snapshot)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	approved, err := readApprovedFlips(approvedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeAuthorizationSnapshot(path+".new", snapshot); err != nil {
+		return nil, err
+	}
+
+	return diffAuthorizationSnapshots(old, snapshot, approved), nil
+}
+
+func TestAuthorizationSnapshot(t *testing.T) {
+	path := E2EAuthorizationSnapshot()
+	if path == "" {
+		t.Skip("AUTHORIZATION_SNAPSHOT not set")
+	}
+
+	backend, err := newRBACBackend(rbacManifests...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := expandAll(snapshotTests())
+	snapshot, err := takeAuthorizationSnapshot(context.Background(), backend, cases, authorizationParallelism)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := compareAuthorizationSnapshot(path, E2EAuthorizationSnapshotApprovals(), snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(diff)
+	if len(diff.Flips) > 0 {
+		t.Errorf("unapproved authorization flips, see %s.new", path)
+	}
+}
+
+func TestDiffAuthorizationSnapshots(t *testing.T) {
+	old := &authorizationSnapshot{Decisions: map[string]string{
+		"a":       matrixAllowed,
+		"b":       matrixUndecided,
+		"c":       matrixDenied,
+		"d":       matrixAllowed,
+		"e":       matrixAllowed,
+		"removed": matrixAllowed,
+	}}
+	new := &authorizationSnapshot{Decisions: map[string]string{
+		"a":     matrixAllowed,
+		"b":     matrixAllowed,
+		"c":     matrixUndecided,
+		"d":     matrixDenied,
+		"e":     matrixUndecided,
+		"added": matrixAllowed,
+	}}
+
+	diff := diffAuthorizationSnapshots(old, new, []snapshotFlip{
+		{Case: "e", From: matrixAllowed, To: matrixUndecided},
+		// approvals only apply to the exact flip
+		{Case: "d", From: matrixAllowed, To: matrixUndecided},
+	})
+
+	expected := &snapshotDiff{
+		Flips: []snapshotFlip{
+			{Case: "b", From: matrixUndecided, To: matrixAllowed},
+			{Case: "d", From: matrixAllowed, To: matrixDenied},
+		},
+		Approved: []snapshotFlip{
+			{Case: "e", From: matrixAllowed, To: matrixUndecided},
+		},
+		Added:   []string{"added"},
+		Removed: []string{"removed"},
+	}
+
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("expected %+v, got %+v", expected, diff)
+	}
+}
+
+func TestCompareAuthorizationSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/snapshot.json"
+
+	backend, err := newRBACBackend(rbacManifests...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := expandAll([]testItem{{
+		name:    "snapshot",
+		request: req().ns("teapot").verb("get", "delete").res("pods").user("test-user").setGroups([]string{readOnlyGroup}),
+	}})
+
+	snapshot, err := takeAuthorizationSnapshot(context.Background(), backend, cases, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"user=test-user groups=ReadOnly namespace=teapot verb=get resource=pods":    matrixAllowed,
+		"user=test-user groups=ReadOnly namespace=teapot verb=delete resource=pods": matrixUndecided,
+	}
+	if !reflect.DeepEqual(snapshot.Decisions, expected) {
+		t.Fatalf("expected decisions %v, got %v", expected, snapshot.Decisions)
+	}
+
+	// the first comparison stores the snapshot
+	diff, err := compareAuthorizationSnapshot(path, "", snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Flips) > 0 {
+		t.Fatalf("unexpected flips: %s", diff)
+	}
+
+	changed := &authorizationSnapshot{Decisions: map[string]string{
+		"user=test-user groups=ReadOnly namespace=teapot verb=get resource=pods":    matrixAllowed,
+		"user=test-user groups=ReadOnly namespace=teapot verb=delete resource=pods": matrixAllowed,
+	}}
+
+	diff, err = compareAuthorizationSnapshot(path, "", changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Flips) != 1 || diff.Flips[0].To != matrixAllowed {
+		t.Fatalf("expected one flip to allowed, got %s", diff)
+	}
+
+	written, err := readAuthorizationSnapshot(path + ".new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(written, changed) {
+		t.Errorf("expected new snapshot %v, got %v", changed, written)
+	}
+
+	approvals := dir + "/approved.yaml"
+	err = os.WriteFile(approvals, []byte(`
+- case: user=test-user groups=ReadOnly namespace=teapot verb=delete resource=pods
+  from: undecided
+  to: allowed
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err = compareAuthorizationSnapshot(path, approvals, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Flips) != 0 || len(diff.Approved) != 1 {
+		t.Errorf("expected the flip to be approved, got %s", diff)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const nodePoolLabel = "node.kubernetes.io/node-pool"
+
+// parseMaxInFlight parses a max-in-flight budget which is either an absolute
+// number of nodes (e.g. 2) or a percentage of the node pool (e.g. 25%).
+func parseMaxInFlight(value string) (intstr.IntOrString, error) {
+	maxInFlight := intstr.Parse(value)
+	if maxInFlight.Type == intstr.String && !strings.HasSuffix(maxInFlight.StrVal, "%") {
+		return maxInFlight, fmt.Errorf("invalid max-in-flight %q: must be a number or a percentage", value)
+	}
+
+	budget, err := intstr.GetScaledValueFromIntOrPercent(&maxInFlight, 100, true)
+	if err != nil {
+		return maxInFlight, fmt.Errorf("invalid max-in-flight %q: %v", value, err)
+	}
+
+	if budget <= 0 {
+		return maxInFlight, fmt.Errorf("invalid max-in-flight %q: must be greater than zero", value)
+	}
+
+	return maxInFlight, nil
+}
+
+// nodePool returns the node pool of a node.
+func nodePool(node *Node) string {
+	return node.Node.Labels[nodePoolLabel]
+}
+
+// nodeReady returns true if the node hasn't been marked for decommissioning
+// yet.
+func nodeReady(node *Node) bool {
+	return node.Node.Labels["lifecycle-status"] == "ready"
+}
+
+// groupSizes returns the number of nodes in each group.
+func groupSizes(source clusterSource, groupBy groupFunc) (map[string]int, error) {
+	nodes, err := source.Nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]int)
+	for _, node := range nodes {
+		sizes[groupBy(&Node{Node: node})]++
+	}
+
+	return sizes, nil
+}
+
+// nextBatch returns the ready candidate nodes which should be marked for
+// decommissioning next. Nodes are decommissioned in batches per group: as
+// long as any candidate node of a group is still being decommissioned, the
+// next batch of that group is held back. A batch contains at most
+// maxInFlight nodes, scaled to the size of the group and rounded up to at
+// least one node.
+func nextBatch(candidates []*Node, groupSizes map[string]int, strategy *strategy) ([]*Node, error) {
+	var inFlight, ready []*Node
+	for _, node := range candidates {
+		if nodeReady(node) {
+			ready = append(ready, node)
+		} else {
+			inFlight = append(inFlight, node)
+		}
+	}
+	strategy.sortNodes(ready)
+
+	if strategy.oneZoneAtATime {
+		zone, ok := strategy.activeZone(inFlight, ready)
+		if !ok {
+			return nil, nil
+		}
+
+		var inZone []*Node
+		for _, node := range ready {
+			if nodeZone(node) == zone {
+				inZone = append(inZone, node)
+			}
+		}
+		ready = inZone
+	}
+
+	groupsInFlight := make(map[string]int)
+	for _, node := range inFlight {
+		groupsInFlight[strategy.groupBy(node)]++
+	}
+
+	var batch []*Node
+	groupsInBatch := make(map[string]int)
+	for _, node := range ready {
+		group := strategy.groupBy(node)
+		if groupsInFlight[group] > 0 {
+			continue
+		}
+
+		budget, err := intstr.GetScaledValueFromIntOrPercent(&strategy.maxInFlight, groupSizes[group], true)
+		if err != nil {
+			return nil, err
+		}
+
+		if budget < 1 {
+			budget = 1
+		}
+
+		if groupsInBatch[group] >= budget {
+			continue
+		}
+
+		groupsInBatch[group]++
+		batch = append(batch, node)
+	}
+
+	return batch, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func testCandidate(name, pool, lifecycleStatus string) *Node {
+	node := testNode(name, lifecycleStatus)
+	node.Labels[nodePoolLabel] = pool
+	return &Node{Node: node}
+}
+
+func nodeNames(nodes []*Node) []string {
+	names := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		names = append(names, node.Node.Name)
+	}
+	return names
+}
+
+func TestParseMaxInFlight(t *testing.T) {
+	for _, tc := range []struct {
+		value      string
+		valid      bool
+		percentage bool
+	}{
+		{value: "1", valid: true},
+		{value: "25%", valid: true, percentage: true},
+		{value: "0", valid: false},
+		{value: "0%", valid: false},
+		{value: "-1", valid: false},
+		{value: "abc", valid: false},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			maxInFlight, err := parseMaxInFlight(tc.value)
+			if tc.valid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatalf("expected error")
+			}
+			if tc.valid && (maxInFlight.Type == intstr.String) != tc.percentage {
+				t.Errorf("unexpected type of %q: %v", tc.value, maxInFlight.Type)
+			}
+		})
+	}
+}
+
+func TestNextBatch(t *testing.T) {
+	candidates := []*Node{
+		testCandidate("a-3", "pool-a", "ready"),
+		testCandidate("a-1", "pool-a", "ready"),
+		testCandidate("a-2", "pool-a", "ready"),
+		testCandidate("b-1", "pool-b", "ready"),
+		testCandidate("b-2", "pool-b", "decommission-pending"),
+		testCandidate("c-1", "pool-c", "ready"),
+	}
+	poolSizes := map[string]int{
+		"pool-a": 10,
+		"pool-b": 2,
+		"pool-c": 1,
+	}
+
+	for _, tc := range []struct {
+		name        string
+		maxInFlight intstr.IntOrString
+		expected    []string
+	}{
+		{
+			name:        "absolute budget",
+			maxInFlight: intstr.FromInt32(2),
+			expected:    []string{"a-1", "a-2", "c-1"},
+		},
+		{
+			name:        "percentage budget is rounded up",
+			maxInFlight: intstr.FromString("25%"),
+			expected:    []string{"a-1", "a-2", "a-3", "c-1"},
+		},
+		{
+			name:        "percentage budget is at least one node",
+			maxInFlight: intstr.FromString("1%"),
+			expected:    []string{"a-1", "c-1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			strategy, err := newStrategy(groupByNodePool, orderByName, tc.maxInFlight, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			batch, err := nextBatch(candidates, poolSizes, strategy)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if names := nodeNames(batch); !reflect.DeepEqual(names, tc.expected) {
+				t.Errorf("expected batch %v, got %v", tc.expected, names)
+			}
+		})
+	}
+}
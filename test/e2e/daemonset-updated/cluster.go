@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	policylisters "k8s.io/client-go/listers/policy/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// clusterSource provides the cluster state needed to find and decommission
+// nodes with old daemonset pods. Returned objects are shared and must not be
+// modified.
+type clusterSource interface {
+	Nodes() ([]*v1.Node, error)
+	Pods() ([]*v1.Pod, error)
+	DaemonSets() ([]*appsv1.DaemonSet, error)
+	ControllerRevisions() ([]*appsv1.ControllerRevision, error)
+	PodDisruptionBudgets() ([]*policyv1.PodDisruptionBudget, error)
+}
+
+// informerSource is a clusterSource backed by shared informers. Changes to
+// any of the watched resources are signalled on the Changes channel.
+type informerSource struct {
+	factories  []informers.SharedInformerFactory
+	nodes      corelisters.NodeLister
+	pods       corelisters.PodLister
+	daemonsets appslisters.DaemonSetLister
+	revisions  appslisters.ControllerRevisionLister
+	pdbs       policylisters.PodDisruptionBudgetLister
+	informers  []cache.SharedIndexInformer
+	changes    chan struct{}
+}
+
+// newInformerSource creates an informerSource. Call Start to start the
+// informers and wait for the caches to be synced.
+func newInformerSource(client kubernetes.Interface, resync time.Duration) (*informerSource, error) {
+	// Completed pods don't consume any capacity on a node, so they don't
+	// need to be cached.
+	podSelector := fields.AndSelectors(
+		fields.OneTermNotEqualSelector("status.phase", string(v1.PodSucceeded)),
+		fields.OneTermNotEqualSelector("status.phase", string(v1.PodFailed)),
+	).String()
+
+	factory := informers.NewSharedInformerFactory(client, resync)
+	podFactory := informers.NewSharedInformerFactoryWithOptions(client, resync, informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+		opts.FieldSelector = podSelector
+	}))
+
+	source := &informerSource{
+		factories:  []informers.SharedInformerFactory{factory, podFactory},
+		nodes:      factory.Core().V1().Nodes().Lister(),
+		pods:       podFactory.Core().V1().Pods().Lister(),
+		daemonsets: factory.Apps().V1().DaemonSets().Lister(),
+		revisions:  factory.Apps().V1().ControllerRevisions().Lister(),
+		pdbs:       factory.Policy().V1().PodDisruptionBudgets().Lister(),
+		changes:    make(chan struct{}, 1),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { source.notify() },
+		UpdateFunc: func(interface{}, interface{}) { source.notify() },
+		DeleteFunc: func(interface{}) { source.notify() },
+	}
+
+	source.informers = []cache.SharedIndexInformer{
+		factory.Core().V1().Nodes().Informer(),
+		podFactory.Core().V1().Pods().Informer(),
+		factory.Apps().V1().DaemonSets().Informer(),
+		factory.Apps().V1().ControllerRevisions().Informer(),
+		factory.Policy().V1().PodDisruptionBudgets().Informer(),
+	}
+
+	for _, informer := range source.informers {
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return nil, err
+		}
+	}
+
+	return source, nil
+}
+
+// SetWatchErrorHandler sets a handler called whenever an informer fails to
+// list or watch its resource. It must be called before Start.
+func (s *informerSource) SetWatchErrorHandler(handler func(err error)) error {
+	for _, informer := range s.informers {
+		err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+			cache.DefaultWatchErrorHandler(r, err)
+			handler(err)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start starts the informers and waits until their caches are synced.
+func (s *informerSource) Start(ctx context.Context) error {
+	for _, factory := range s.factories {
+		factory.Start(ctx.Done())
+	}
+
+	for _, factory := range s.factories {
+		for informerType, ok := range factory.WaitForCacheSync(ctx.Done()) {
+			if !ok {
+				return fmt.Errorf("failed to sync informer cache for %v", informerType)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Changes returns a channel which receives a value whenever any of the
+// watched resources changed. Multiple changes are coalesced into a single
+// notification.
+func (s *informerSource) Changes() <-chan struct{} {
+	return s.changes
+}
+
+func (s *informerSource) notify() {
+	select {
+	case s.changes <- struct{}{}:
+	default:
+	}
+}
+
+func (s *informerSource) Nodes() ([]*v1.Node, error) {
+	return s.nodes.List(labels.Everything())
+}
+
+func (s *informerSource) Pods() ([]*v1.Pod, error) {
+	return s.pods.List(labels.Everything())
+}
+
+func (s *informerSource) DaemonSets() ([]*appsv1.DaemonSet, error) {
+	return s.daemonsets.List(labels.Everything())
+}
+
+func (s *informerSource) ControllerRevisions() ([]*appsv1.ControllerRevision, error) {
+	return s.revisions.List(labels.Everything())
+}
+
+func (s *informerSource) PodDisruptionBudgets() ([]*policyv1.PodDisruptionBudget, error) {
+	return s.pdbs.List(labels.Everything())
+}
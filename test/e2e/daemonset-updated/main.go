@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"time"
 
@@ -15,45 +20,129 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
 )
 
 func main() {
+	dryRun := flag.Bool("dry-run", false, "Print the decommission plan and exit without modifying any nodes.")
+	output := flag.String("output", outputTable, "Output format of the plan printed in dry-run mode (table or json).")
+	maxInFlightFlag := flag.String("max-in-flight", "100%", "Maximum number of nodes per node pool to decommission at once, either absolute (e.g. 2) or a percentage of the pool (e.g. 25%).")
+	groupBy := flag.String("group-by", groupByNodePool, "Grouping of nodes the max-in-flight budget is applied to (node-pool, zone or node-pool-zone).")
+	orderBy := flag.String("order-by", orderByName, "Order in which nodes of a group are decommissioned (name or oldest-first).")
+	oneZoneAtATime := flag.Bool("one-zone-at-a-time", false, "Only decommission nodes of a single availability zone at a time.")
+	checkPDBs := flag.Bool("check-pdbs", true, "Defer decommissioning of nodes whose pods can't be evicted without violating a PodDisruptionBudget.")
+	reportPDBsOnly := flag.Bool("report-pdbs-only", false, "Only log the nodes whose pods can't be evicted without violating a PodDisruptionBudget instead of deferring them.")
+	rollingUpdates := flag.String("rolling-updates", rollingUpdateReport, "Handling of RollingUpdate daemonsets with a stalled rollout: ignore, report or recycle the nodes blocking the rollout.")
+	stallThreshold := flag.Duration("stall-threshold", 10*time.Minute, "Duration after which a pending or unready pod of a RollingUpdate daemonset is considered stuck.")
+	interval := flag.Duration("interval", 30*time.Second, "Maximum interval between reconciliations if no changes are observed.")
+	timeout := flag.Duration("timeout", 0, "Deadline for all nodes with old daemonset pods to be decommissioned (0 means no deadline).")
+	summaryFile := flag.String("summary-file", "", "Path of a file the JSON summary of the run is written to.")
+	metricsAddress := flag.String("metrics-address", "", "Address to serve Prometheus metrics on /metrics and health probes on /healthz and /readyz (e.g. :7979), disabled if empty.")
+	flag.Parse()
+
+	maxInFlight, err := parseMaxInFlight(*maxInFlightFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	strategy, err := newStrategy(*groupBy, *orderBy, maxInFlight, *oneZoneAtATime)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rollingUpdateConfig, err := newRollingUpdateConfig(*rollingUpdates, *stallThreshold)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	kubeClient, err := newClient()
 	if err != nil {
 		log.Fatalf("Failed to setup Kubernetes client: %v", err)
 	}
 
-	for {
-		ctx := context.Background()
-		candidates, err := candidateNodes(ctx, kubeClient)
-		if err != nil {
-			log.Printf("Failed to get candidate nodes: %v", err)
-			continue
-		}
+	source, err := newInformerSource(kubeClient, *interval)
+	if err != nil {
+		log.Fatalf("Failed to setup informers: %v", err)
+	}
 
-		if len(candidates) == 0 {
-			log.Printf("No nodes with old daemonset pods found, exiting")
-			break
+	var rolloutMetrics *metrics
+	if *metricsAddress != "" && !*dryRun {
+		rolloutMetrics = newMetrics(*interval)
+		if err := source.SetWatchErrorHandler(func(error) { rolloutMetrics.observeWatchError() }); err != nil {
+			log.Fatalf("Failed to setup informers: %v", err)
 		}
 
-		decomissioningNodes := 0
-		for _, node := range candidates {
-			if node.Node.Labels["lifecycle-status"] != "ready" {
-				decomissioningNodes++
-				continue
+		go func() {
+			log.Printf("Serving metrics on %s", *metricsAddress)
+			if err := http.ListenAndServe(*metricsAddress, rolloutMetrics.handler()); err != nil {
+				log.Printf("Failed to serve metrics: %v", err)
 			}
+		}()
+	}
 
-			if err := decommissionNode(ctx, kubeClient, node); err != nil {
-				log.Printf("Failed to decommission node %s: %v", node.Node.Name, err)
-			}
-			log.Printf("Marked node %s for decommissioning", node.Node.Name)
-			decomissioningNodes++
+	start := time.Now()
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if *timeout > 0 && !*dryRun {
+		ctx, cancel = context.WithTimeout(context.Background(), *timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	if err := source.Start(ctx); err != nil {
+		if ctx.Err() == nil {
+			log.Fatalf("Failed to start informers: %v", err)
+		}
+		log.Printf("Deadline reached before informers were synced: %v", err)
+		finish(*summaryFile, newTracker(start).summary(time.Now(), false))
+	}
+	rolloutMetrics.setReady()
+
+	reconciler := &reconciler{
+		client:         kubeClient,
+		source:         source,
+		strategy:       strategy,
+		checkPDBs:      *checkPDBs,
+		reportPDBsOnly: *reportPDBsOnly,
+		rollingUpdates: rollingUpdateConfig,
+		metrics:        rolloutMetrics,
+		dryRun:         *dryRun,
+	}
+
+	if *dryRun {
+		round, err := reconciler.Reconcile(ctx)
+		if err != nil {
+			log.Fatalf("Failed to get candidate nodes: %v", err)
 		}
 
-		log.Printf("Waiting for %d nodes with old daemonset pods to decommission", decomissioningNodes)
-		time.Sleep(30 * time.Second)
+		if err := writePlan(os.Stdout, *output, buildPlan(round)); err != nil {
+			log.Fatalf("Failed to write plan: %v", err)
+		}
+		return
 	}
 
+	summary := run(ctx, reconciler, source.Changes(), *interval)
+	if summary.Result != resultSuccess {
+		log.Printf("Deadline reached with %d nodes with old daemonset pods left", len(summary.Stuck))
+	}
+
+	cancel()
+	finish(*summaryFile, summary)
+}
+
+// finish writes the summary to summaryFile, if set, and exits with the exit
+// code matching the result.
+func finish(summaryFile string, summary *Summary) {
+	if summaryFile != "" {
+		if err := writeSummary(summaryFile, summary); err != nil {
+			log.Printf("Failed to write summary: %v", err)
+		}
+	}
+
+	os.Exit(summary.ExitCode())
 }
 
 // newClient will try to create an in-cluster client if possible, otherwise create one with configuration from $KUBECONFIG or $HOME/.kube/config
@@ -86,34 +175,92 @@ func newClient() (kubernetes.Interface, error) {
 }
 
 type Node struct {
-	Pods []v1.Pod
-	Node *v1.Node
+	Pods      []v1.Pod
+	OldPods   []OldPod
+	StuckPods []StuckPod
+	Node      *v1.Node
+}
+
+// OldPod is a DaemonSet pod which doesn't match the current revision of
+// its DaemonSet.
+type OldPod struct {
+	Pod                 *v1.Pod
+	DaemonSet           dsID
+	PodGeneration       int64
+	DaemonSetGeneration int64
+	// PodRevisionHash and DaemonSetRevisionHash are set if the pod was
+	// detected as old based on the ControllerRevision hash.
+	PodRevisionHash       string
+	DaemonSetRevisionHash string
 }
 
-func candidateNodes(ctx context.Context, client kubernetes.Interface) ([]*Node, error) {
-	nodeMapping, err := nodeMapping(ctx, client)
+// SkippedPod is a pod of an OnDelete DaemonSet which couldn't be checked
+// because its revision is unknown.
+type SkippedPod struct {
+	Pod       *v1.Pod
+	DaemonSet dsID
+	Reason    string
+}
+
+// candidateNodes returns the nodes with old pods of OnDelete daemonsets, the
+// pods which couldn't be checked and the stalled RollingUpdate daemonsets.
+// In recycle mode, the nodes blocking the stalled daemonsets are candidates
+// as well.
+func candidateNodes(source clusterSource, rollingUpdates *rollingUpdateConfig) (*Round, error) {
+	nodeMapping, err := nodeMapping(source)
 	if err != nil {
 		return nil, err
 	}
 
-	daemonsets, err := onDeleteDaemonsets(ctx, client)
+	daemonsets, err := onDeleteDaemonsets(source)
 	if err != nil {
 		return nil, err
 	}
 
-	candidates := make([]*Node, 0, len(nodeMapping))
+	round := &Round{
+		Candidates: make([]*Node, 0, len(nodeMapping)),
+	}
+
+	if rollingUpdates != nil && rollingUpdates.mode != rollingUpdateIgnore {
+		round.Stalled, err = stalledDaemonSets(source, nodeMapping, rollingUpdates)
+		if err != nil {
+			return nil, err
+		}
+	}
+	recycle := rollingUpdates != nil && rollingUpdates.mode == rollingUpdateRecycle
+
 	for _, node := range nodeMapping {
-		for _, p := range node.Pods {
-			if oldDaemonsetPod(p, daemonsets) {
-				candidates = append(candidates, node)
+		for i := range node.Pods {
+			oldPod, skipped := oldDaemonsetPod(&node.Pods[i], daemonsets)
+			if oldPod != nil {
+				node.OldPods = append(node.OldPods, *oldPod)
+			}
+			if skipped != nil {
+				round.Skipped = append(round.Skipped, *skipped)
 			}
 		}
+
+		if len(node.OldPods) > 0 || (recycle && len(node.StuckPods) > 0) {
+			round.Candidates = append(round.Candidates, node)
+		}
 	}
 
-	return candidates, nil
+	sort.Slice(round.Skipped, func(i, j int) bool {
+		if round.Skipped[i].Pod.Namespace != round.Skipped[j].Pod.Namespace {
+			return round.Skipped[i].Pod.Namespace < round.Skipped[j].Pod.Namespace
+		}
+		return round.Skipped[i].Pod.Name < round.Skipped[j].Pod.Name
+	})
+
+	return round, nil
 }
 
-func oldDaemonsetPod(pod v1.Pod, onDeleteDaemonsets map[dsID]int64) bool {
+// oldDaemonsetPod checks if the pod belongs to an OnDelete daemonset and
+// doesn't match its current revision. Pods are compared by their
+// controller-revision-hash label, with the deprecated pod-template-generation
+// label as a fallback. If neither can be used, the pod is returned as
+// skipped.
+func oldDaemonsetPod(pod *v1.Pod, onDeleteDaemonsets map[dsID]daemonSetVersion) (*OldPod, *SkippedPod) {
 	for _, owner := range pod.ObjectMeta.OwnerReferences {
 		if owner.Kind != "DaemonSet" {
 			continue
@@ -125,44 +272,74 @@ func oldDaemonsetPod(pod v1.Pod, onDeleteDaemonsets map[dsID]int64) bool {
 			UID:       owner.UID,
 		}
 
-		podGenStr, ok := pod.Labels["pod-template-generation"]
+		version, ok := onDeleteDaemonsets[dsID]
 		if !ok {
 			continue
 		}
 
+		podHash := pod.Labels[appsv1.DefaultDaemonSetUniqueLabelKey]
+		if podHash != "" && version.RevisionHash != "" {
+			if podHash == version.RevisionHash {
+				return nil, nil
+			}
+			return &OldPod{
+				Pod:                   pod,
+				DaemonSet:             dsID,
+				PodRevisionHash:       podHash,
+				DaemonSetRevisionHash: version.RevisionHash,
+			}, nil
+		}
+
+		podGenStr, ok := pod.Labels["pod-template-generation"]
+		if !ok {
+			return nil, &SkippedPod{
+				Pod:       pod,
+				DaemonSet: dsID,
+				Reason:    "revision of daemonset or pod unknown and pod has no pod-template-generation label",
+			}
+		}
+
 		podGen, err := strconv.ParseInt(podGenStr, 10, 64)
 		if err != nil {
-			continue
+			return nil, &SkippedPod{
+				Pod:       pod,
+				DaemonSet: dsID,
+				Reason:    fmt.Sprintf("invalid pod-template-generation label %q", podGenStr),
+			}
 		}
 
-		if gen, ok := onDeleteDaemonsets[dsID]; ok && podGen != gen {
-			return true
+		if podGen != version.Generation {
+			return &OldPod{
+				Pod:                 pod,
+				DaemonSet:           dsID,
+				PodGeneration:       podGen,
+				DaemonSetGeneration: version.Generation,
+			}, nil
 		}
 	}
 
-	return false
+	return nil, nil
 }
 
-func nodeMapping(ctx context.Context, client kubernetes.Interface) (map[string]*Node, error) {
-	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+func nodeMapping(source clusterSource) (map[string]*Node, error) {
+	nodes, err := source.Nodes()
 	if err != nil {
 		return nil, err
 	}
 
 	nodeMapping := map[string]*Node{}
-	for _, node := range nodes.Items {
-		n := node
+	for _, node := range nodes {
 		nodeMapping[node.Name] = &Node{
-			Node: &n,
+			Node: node.DeepCopy(),
 		}
 	}
 
-	pods, err := client.CoreV1().Pods(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	pods, err := source.Pods()
 	if err != nil {
 		return nil, err
 	}
 
-	for _, pod := range pods.Items {
+	for _, pod := range pods {
 		if node, ok := nodeMapping[pod.Spec.NodeName]; ok {
 			// filter out failed/completed pods as they don't
 			// consume any capacity on a node.
@@ -170,7 +347,7 @@ func nodeMapping(ctx context.Context, client kubernetes.Interface) (map[string]*
 			case v1.PodSucceeded, v1.PodFailed:
 				continue
 			}
-			node.Pods = append(node.Pods, pod)
+			node.Pods = append(node.Pods, *pod)
 		}
 	}
 
@@ -183,36 +360,130 @@ type dsID struct {
 	UID       types.UID
 }
 
-func onDeleteDaemonsets(ctx context.Context, client kubernetes.Interface) (map[dsID]int64, error) {
-	onDeleteDaemonsets := make(map[dsID]int64, 0)
-	daemonsets, err := client.AppsV1().DaemonSets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+// daemonSetVersion identifies the current version of a daemonset.
+type daemonSetVersion struct {
+	Generation int64
+	// RevisionHash is the hash of the daemonset's current
+	// ControllerRevision, empty if it isn't known.
+	RevisionHash string
+}
+
+func onDeleteDaemonsets(source clusterSource) (map[dsID]daemonSetVersion, error) {
+	onDeleteDaemonsets := make(map[dsID]daemonSetVersion, 0)
+	daemonsets, err := source.DaemonSets()
 	if err != nil {
 		return nil, err
 	}
 
-	for _, ds := range daemonsets.Items {
+	revisions, err := source.ControllerRevisions()
+	if err != nil {
+		return nil, err
+	}
+
+	currentRevisions := make(map[types.UID]*appsv1.ControllerRevision)
+	for _, revision := range revisions {
+		owner := metav1.GetControllerOf(revision)
+		if owner == nil || owner.Kind != "DaemonSet" {
+			continue
+		}
+
+		if current, ok := currentRevisions[owner.UID]; !ok || revision.Revision > current.Revision {
+			currentRevisions[owner.UID] = revision
+		}
+	}
+
+	for _, ds := range daemonsets {
 		if ds.Spec.UpdateStrategy.Type == appsv1.OnDeleteDaemonSetStrategyType {
+			version := daemonSetVersion{
+				Generation: ds.Generation,
+			}
+
+			// the current revision is only known once the daemonset
+			// controller has observed the latest generation.
+			if revision, ok := currentRevisions[ds.UID]; ok && ds.Status.ObservedGeneration >= ds.Generation {
+				version.RevisionHash = revision.Labels[appsv1.DefaultDaemonSetUniqueLabelKey]
+			}
+
 			onDeleteDaemonsets[dsID{
 				Name:      ds.Name,
 				Namespace: ds.Namespace,
 				UID:       ds.UID,
-			}] = ds.Generation
+			}] = version
 		}
 	}
 
 	return onDeleteDaemonsets, nil
 }
 
+// decommissionNode marks a node for decommissioning by labelling and
+// tainting it. The node is patched instead of updated, so that concurrent
+// changes to other fields are preserved. The taint and the label are only
+// added if they are missing, so that marking a node multiple times is safe.
 func decommissionNode(ctx context.Context, client kubernetes.Interface, node *Node) error {
-	taint := v1.Taint{
-		Key:    "decommission-pending",
-		Value:  "spot-replacement",
-		Effect: v1.TaintEffectNoSchedule,
+	current := node.Node
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if current == nil {
+			var err error
+			current, err = client.CoreV1().Nodes().Get(ctx, node.Node.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+		}
+
+		patch, err := decommissionPatch(current)
+		// refetch the node if the patch conflicts
+		current = nil
+		if err != nil || patch == nil {
+			return err
+		}
+
+		_, err = client.CoreV1().Nodes().Patch(ctx, node.Node.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+}
+
+// decommissionPatch returns the patch marking the node for
+// decommissioning, or nil if the node is already marked. The patch
+// includes the node's resourceVersion, so it fails with a conflict if the
+// node was modified in the meantime.
+func decommissionPatch(node *v1.Node) ([]byte, error) {
+	metadata := map[string]interface{}{
+		"resourceVersion": node.ResourceVersion,
+	}
+	if node.Labels["lifecycle-status"] != "decommission-pending" {
+		metadata["labels"] = map[string]string{
+			"lifecycle-status": "decommission-pending",
+		}
 	}
 
-	node.Node.Labels["lifecycle-status"] = "decommission-pending"
-	node.Node.Spec.Taints = append(node.Node.Spec.Taints, taint)
+	patch := map[string]interface{}{
+		"metadata": metadata,
+	}
+
+	if !hasTaint(node, decommissionTaint.Key) {
+		// taints have no merge key, so the patch has to contain the
+		// full list.
+		patch["spec"] = map[string]interface{}{
+			"taints": append(append([]v1.Taint{}, node.Spec.Taints...), decommissionTaint),
+		}
+	} else if len(metadata) == 1 {
+		return nil, nil
+	}
+
+	return json.Marshal(patch)
+}
 
-	_, err := client.CoreV1().Nodes().Update(ctx, node.Node, metav1.UpdateOptions{})
-	return err
+var decommissionTaint = v1.Taint{
+	Key:    "decommission-pending",
+	Value:  "spot-replacement",
+	Effect: v1.TaintEffectNoSchedule,
+}
+
+func hasTaint(node *v1.Node, key string) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == key {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func countTaints(node *v1.Node, key string) int {
+	count := 0
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == key {
+			count++
+		}
+	}
+	return count
+}
+
+func TestDecommissionNodeIsIdempotent(t *testing.T) {
+	node := testNode("node-a", "ready")
+	node.Spec.Taints = []v1.Taint{{Key: "dedicated", Value: "test", Effect: v1.TaintEffectNoSchedule}}
+	client := fake.NewSimpleClientset(node)
+
+	for i := 0; i < 3; i++ {
+		current, err := client.CoreV1().Nodes().Get(context.Background(), "node-a", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if err := decommissionNode(context.Background(), client, &Node{Node: current}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// also marking a stale copy of the node must not duplicate the taint.
+	if err := decommissionNode(context.Background(), client, &Node{Node: node}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated, err := client.CoreV1().Nodes().Get(context.Background(), "node-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if updated.Labels["lifecycle-status"] != "decommission-pending" {
+		t.Errorf("expected lifecycle-status label to be set, got %v", updated.Labels)
+	}
+	if count := countTaints(updated, decommissionTaint.Key); count != 1 {
+		t.Errorf("expected a single decommission taint, got %d: %v", count, updated.Spec.Taints)
+	}
+	if count := countTaints(updated, "dedicated"); count != 1 {
+		t.Errorf("expected existing taints to be preserved, got %v", updated.Spec.Taints)
+	}
+}
+
+func TestDecommissionNodeRetriesOnConflict(t *testing.T) {
+	node := testNode("node-a", "ready")
+	client := fake.NewSimpleClientset(node)
+
+	conflicts := 0
+	client.PrependReactor("patch", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts < 2 {
+			conflicts++
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "nodes"}, "node-a", nil)
+		}
+		return false, nil, nil
+	})
+
+	if err := decommissionNode(context.Background(), client, &Node{Node: node}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	gets := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "get" {
+			gets++
+		}
+	}
+	if gets != conflicts {
+		t.Errorf("expected the node to be refetched after each of the %d conflicts, got %d gets", conflicts, gets)
+	}
+
+	updated, err := client.CoreV1().Nodes().Get(context.Background(), "node-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count := countTaints(updated, decommissionTaint.Key); count != 1 {
+		t.Errorf("expected a single decommission taint, got %v", updated.Spec.Taints)
+	}
+}
+
+func TestDecommissionPatch(t *testing.T) {
+	node := testNode("node-a", "decommission-pending")
+	node.Spec.Taints = []v1.Taint{decommissionTaint}
+
+	patch, err := decommissionPatch(node)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if patch != nil {
+		t.Errorf("expected no patch for a node which is already marked, got %s", patch)
+	}
+}
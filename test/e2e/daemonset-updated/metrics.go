@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "check_daemonset_updated"
+	// staleReconcileIntervals is the number of reconcile intervals without a
+	// successful reconciliation after which the liveness probe fails.
+	staleReconcileIntervals = 3
+)
+
+// metrics exposes the progress of the rollout as Prometheus metrics. All
+// methods are safe to call on a nil *metrics.
+type metrics struct {
+	registry               *prometheus.Registry
+	candidateNodes         prometheus.Gauge
+	pendingNodes           prometheus.Gauge
+	deferredNodes          prometheus.Gauge
+	stalePods              *prometheus.GaugeVec
+	stalledDaemonSets      prometheus.Gauge
+	apiErrors              *prometheus.CounterVec
+	decommissionActions    *prometheus.CounterVec
+	lastReconcileTimestamp prometheus.Gauge
+	ready                  atomic.Bool
+	// lastReconcile is the time of the last successful reconciliation, or of
+	// the sync of the informer caches before the first one, in unix nanoseconds.
+	lastReconcile   atomic.Int64
+	maxReconcileAge time.Duration
+}
+
+// newMetrics returns the metrics of a rollout reconciled at least every
+// interval. The liveness probe fails if no reconciliation succeeded for
+// staleReconcileIntervals intervals.
+func newMetrics(interval time.Duration) *metrics {
+	m := &metrics{
+		maxReconcileAge: staleReconcileIntervals * interval,
+		registry:        prometheus.NewRegistry(),
+		candidateNodes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "candidate_nodes",
+			Help:      "Number of nodes with old daemonset pods.",
+		}),
+		pendingNodes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "nodes_pending_decommission",
+			Help:      "Number of candidate nodes marked for decommissioning.",
+		}),
+		deferredNodes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "deferred_nodes",
+			Help:      "Number of candidate nodes deferred because of PodDisruptionBudgets.",
+		}),
+		stalePods: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "stale_pods",
+			Help:      "Number of old pods per daemonset.",
+		}, []string{"namespace", "daemonset"}),
+		stalledDaemonSets: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "stalled_daemonsets",
+			Help:      "Number of RollingUpdate daemonsets with a stalled rollout.",
+		}),
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_errors_total",
+			Help:      "Number of failed requests to the Kubernetes API.",
+		}, []string{"operation"}),
+		decommissionActions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "decommission_actions_total",
+			Help:      "Number of attempts to mark nodes for decommissioning.",
+		}, []string{"result"}),
+		lastReconcileTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_reconcile_timestamp_seconds",
+			Help:      "Unix timestamp of the last successful reconciliation.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.candidateNodes,
+		m.pendingNodes,
+		m.deferredNodes,
+		m.stalePods,
+		m.stalledDaemonSets,
+		m.apiErrors,
+		m.decommissionActions,
+		m.lastReconcileTimestamp,
+	)
+
+	return m
+}
+
+// observeRound updates the gauges from the result of a reconciliation.
+func (m *metrics) observeRound(round *Round) {
+	if m == nil {
+		return
+	}
+
+	pending := 0
+	m.stalePods.Reset()
+	for _, node := range round.Candidates {
+		if !nodeReady(node) {
+			pending++
+		}
+
+		for _, pod := range node.OldPods {
+			m.stalePods.WithLabelValues(pod.DaemonSet.Namespace, pod.DaemonSet.Name).Inc()
+		}
+	}
+
+	m.candidateNodes.Set(float64(len(round.Candidates)))
+	m.pendingNodes.Set(float64(pending + len(round.Batch)))
+	m.deferredNodes.Set(float64(len(round.Deferred)))
+	m.stalledDaemonSets.Set(float64(len(round.Stalled)))
+	m.lastReconcileTimestamp.SetToCurrentTime()
+	m.lastReconcile.Store(time.Now().UnixNano())
+}
+
+// observeDecommission counts an attempt to mark a node for decommissioning.
+func (m *metrics) observeDecommission(err error) {
+	if m == nil {
+		return
+	}
+
+	if err != nil {
+		m.decommissionActions.WithLabelValues("error").Inc()
+		m.apiErrors.WithLabelValues("patch-node").Inc()
+		return
+	}
+	m.decommissionActions.WithLabelValues("success").Inc()
+}
+
+// observeWatchError counts a failed list or watch request of an informer.
+func (m *metrics) observeWatchError() {
+	if m == nil {
+		return
+	}
+	m.apiErrors.WithLabelValues("watch").Inc()
+}
+
+// setReady marks the process as ready once the informer caches are synced.
+func (m *metrics) setReady() {
+	if m == nil {
+		return
+	}
+	m.lastReconcile.CompareAndSwap(0, time.Now().UnixNano())
+	m.ready.Store(true)
+}
+
+// handler returns the handler serving the metrics on /metrics, the liveness
+// probe on /healthz and the readiness probe on /readyz. The liveness probe
+// fails once the last successful reconciliation is older than the maximum
+// age, which doesn't apply before the informer caches are synced.
+func (m *metrics) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		if last := m.lastReconcile.Load(); last != 0 {
+			if age := time.Since(time.Unix(0, last)); age > m.maxReconcileAge {
+				http.Error(w, fmt.Sprintf("last successful reconciliation %s ago", age.Round(time.Second)), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if !m.ready.Load() {
+			http.Error(w, "informer caches not synced", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	return mux
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+func get(t *testing.T, server *httptest.Server, path string) (int, string) {
+	t.Helper()
+
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics(time.Minute)
+	server := httptest.NewServer(m.handler())
+	defer server.Close()
+
+	if status, _ := get(t, server, "/healthz"); status != http.StatusOK {
+		t.Errorf("expected /healthz to return %d, got %d", http.StatusOK, status)
+	}
+	if status, _ := get(t, server, "/readyz"); status != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz to return %d before the caches are synced, got %d", http.StatusServiceUnavailable, status)
+	}
+
+	m.setReady()
+	if status, _ := get(t, server, "/readyz"); status != http.StatusOK {
+		t.Errorf("expected /readyz to return %d, got %d", http.StatusOK, status)
+	}
+
+	ds := testDaemonSet("coredns", 2, appsv1.OnDeleteDaemonSetStrategyType)
+	id := dsID{Name: ds.Name, Namespace: ds.Namespace, UID: ds.UID}
+	nodeA := testCandidate("node-a", "pool", "ready")
+	nodeA.OldPods = []OldPod{{DaemonSet: id}}
+	nodeB := testCandidate("node-b", "pool", "decommission-pending")
+	nodeB.OldPods = []OldPod{{DaemonSet: id}}
+
+	m.observeRound(&Round{
+		Candidates: []*Node{nodeA, nodeB},
+		Batch:      []*Node{nodeA},
+	})
+	m.observeDecommission(nil)
+	m.observeDecommission(errors.New("conflict"))
+	m.observeWatchError()
+
+	_, body := get(t, server, "/metrics")
+	for _, expected := range []string{
+		"check_daemonset_updated_candidate_nodes 2",
+		"check_daemonset_updated_nodes_pending_decommission 2",
+		`check_daemonset_updated_stale_pods{daemonset="coredns",namespace="kube-system"} 2`,
+		`check_daemonset_updated_decommission_actions_total{result="success"} 1`,
+		`check_daemonset_updated_decommission_actions_total{result="error"} 1`,
+		`check_daemonset_updated_api_errors_total{operation="patch-node"} 1`,
+		`check_daemonset_updated_api_errors_total{operation="watch"} 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+
+	if status, _ := get(t, server, "/healthz"); status != http.StatusOK {
+		t.Errorf("expected /healthz to return %d after a reconciliation, got %d", http.StatusOK, status)
+	}
+
+	// no successful reconciliation for more than three intervals
+	m.lastReconcile.Store(time.Now().Add(-4 * time.Minute).UnixNano())
+	if status, body := get(t, server, "/healthz"); status != http.StatusServiceUnavailable || !strings.Contains(body, "last successful reconciliation 4m0s ago") {
+		t.Errorf("expected /healthz to return %d for a stale reconciliation, got %d: %s", http.StatusServiceUnavailable, status, body)
+	}
+
+	// metrics are optional
+	var disabled *metrics
+	disabled.observeRound(&Round{})
+	disabled.observeDecommission(nil)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// pdbChecker checks if the pods of a node can be evicted without violating
+// any PodDisruptionBudget. The disruptions of all nodes admitted by the
+// checker are accumulated, so that a batch of nodes as a whole doesn't
+// exceed the allowed disruptions.
+type pdbChecker struct {
+	budgets []*pdbBudget
+}
+
+type pdbBudget struct {
+	pdb       *policyv1.PodDisruptionBudget
+	selector  labels.Selector
+	remaining int32
+}
+
+func newPDBChecker(source clusterSource) (*pdbChecker, error) {
+	pdbs, err := source.PodDisruptionBudgets()
+	if err != nil {
+		return nil, err
+	}
+
+	checker := &pdbChecker{}
+	for _, pdb := range pdbs {
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector of PodDisruptionBudget %s/%s: %v", pdb.Namespace, pdb.Name, err)
+		}
+
+		checker.budgets = append(checker.budgets, &pdbBudget{
+			pdb:       pdb,
+			selector:  selector,
+			remaining: pdb.Status.DisruptionsAllowed,
+		})
+	}
+
+	return checker, nil
+}
+
+// admit returns the reasons why the node can't be decommissioned without
+// violating a PodDisruptionBudget. If there are none, the disruptions
+// caused by evicting the node's pods are subtracted from the budgets.
+func (c *pdbChecker) admit(node *Node) []string {
+	disruptions := make(map[*pdbBudget]int32)
+	for i := range node.Pods {
+		pod := &node.Pods[i]
+		if !evictablePod(pod) {
+			continue
+		}
+
+		for _, budget := range c.budgets {
+			if budget.pdb.Namespace == pod.Namespace && budget.selector.Matches(labels.Set(pod.Labels)) {
+				disruptions[budget]++
+			}
+		}
+	}
+
+	var reasons []string
+	for _, budget := range c.budgets {
+		if needed, ok := disruptions[budget]; ok && needed > budget.remaining {
+			reasons = append(reasons, fmt.Sprintf("evicting %d pod(s) would violate PodDisruptionBudget %s/%s (%d disruption(s) allowed)", needed, budget.pdb.Namespace, budget.pdb.Name, budget.remaining))
+		}
+	}
+
+	if len(reasons) > 0 {
+		return reasons
+	}
+
+	for budget, needed := range disruptions {
+		budget.remaining -= needed
+	}
+
+	return nil
+}
+
+// evictablePod returns true if the pod would be evicted when the node is
+// drained. DaemonSet pods and static pods are not evicted and terminating
+// pods are already gone from the perspective of a PodDisruptionBudget.
+func evictablePod(pod *v1.Pod) bool {
+	if pod.DeletionTimestamp != nil {
+		return false
+	}
+
+	if _, ok := pod.Annotations[v1.MirrorPodAnnotationKey]; ok {
+		return false
+	}
+
+	for _, owner := range pod.OwnerReferences {
+		if owner.Kind == "DaemonSet" {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func testPDB(name string, disruptionsAllowed int32, matchLabels map[string]string) *policyv1.PodDisruptionBudget {
+	return &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: matchLabels},
+		},
+		Status: policyv1.PodDisruptionBudgetStatus{
+			DisruptionsAllowed: disruptionsAllowed,
+		},
+	}
+}
+
+func testAppPod(name, nodeName, app string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels: map[string]string{
+				"application": app,
+			},
+		},
+		Spec: v1.PodSpec{
+			NodeName: nodeName,
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+		},
+	}
+}
+
+func TestDecommissionBatchChecksPDBs(t *testing.T) {
+	ds := testDaemonSet("coredns", 2, appsv1.OnDeleteDaemonSetStrategyType)
+
+	client, source := testSource(t,
+		testNode("node-a", "ready"),
+		testNode("node-b", "ready"),
+		testNode("node-c", "ready"),
+		ds,
+		testDaemonSetPod("coredns-a", "node-a", ds, 1),
+		testDaemonSetPod("coredns-b", "node-b", ds, 1),
+		testDaemonSetPod("coredns-c", "node-c", ds, 1),
+		// node-a can be drained, after that the budget of the api
+		// is used up so node-b has to wait. The database on node-c
+		// can't be disrupted at all.
+		testAppPod("api-a", "node-a", "api"),
+		testAppPod("api-b", "node-b", "api"),
+		testAppPod("db-c", "node-c", "db"),
+		testPDB("api", 1, map[string]string{"application": "api"}),
+		testPDB("db", 0, map[string]string{"application": "db"}),
+	)
+
+	strategy, err := newStrategy(groupByNodePool, orderByName, intstr.FromString("100%"), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r := &reconciler{client: client, source: source, strategy: strategy, checkPDBs: true, dryRun: true}
+	round, err := r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if names := nodeNames(round.Batch); len(names) != 1 || names[0] != "node-a" {
+		t.Errorf("expected batch [node-a], got %v", names)
+	}
+
+	deferred := make(map[string][]string)
+	for _, node := range round.Deferred {
+		deferred[node.Node.Node.Name] = node.Reasons
+	}
+	if len(deferred) != 2 || len(deferred["node-b"]) != 1 || len(deferred["node-c"]) != 1 {
+		t.Errorf("expected node-b and node-c to be deferred, got %v", deferred)
+	}
+
+	// only reported, the nodes are decommissioned anyway
+	r.reportPDBsOnly = true
+	round, err = r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(round.Batch) != 3 || len(round.Deferred) != 0 || len(round.Disrupting) != 2 {
+		t.Errorf("expected all nodes in the batch and 2 of them reported, got %v and %d", nodeNames(round.Batch), len(round.Disrupting))
+	}
+	if plan := buildPlan(round); len(plan.Nodes) != 3 || len(plan.Nodes[2].Reasons) != 1 {
+		t.Errorf("expected the reasons of node-c in the plan, got %+v", plan.Nodes)
+	}
+
+	r.checkPDBs = false
+	r.reportPDBsOnly = false
+	round, err = r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(round.Batch) != 3 || len(round.Deferred) != 0 {
+		t.Errorf("expected all nodes in the batch without PDB checks, got %v", nodeNames(round.Batch))
+	}
+}
+
+func TestEvictablePod(t *testing.T) {
+	ds := testDaemonSet("coredns", 2, appsv1.OnDeleteDaemonSetStrategyType)
+	if evictablePod(testDaemonSetPod("coredns-a", "node-a", ds, 1)) {
+		t.Errorf("daemonset pods must not be evictable")
+	}
+
+	mirror := testAppPod("static", "node-a", "static")
+	mirror.Annotations = map[string]string{v1.MirrorPodAnnotationKey: "hash"}
+	if evictablePod(mirror) {
+		t.Errorf("static pods must not be evictable")
+	}
+
+	if !evictablePod(testAppPod("api", "node-a", "api")) {
+		t.Errorf("application pods must be evictable")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+
+	actionDecommission = "decommission"
+	actionDefer        = "defer"
+	actionHold         = "hold"
+	actionWait         = "wait-for-decommission"
+)
+
+// Plan describes which nodes would be decommissioned and why.
+type Plan struct {
+	Nodes             []PlanNode         `json:"nodes"`
+	SkippedPods       []PlanPod          `json:"skippedPods,omitempty"`
+	StalledDaemonSets []StalledDaemonSet `json:"stalledDaemonSets,omitempty"`
+}
+
+// PlanNode is a single candidate node in a Plan. Reasons are the reasons the
+// node is deferred, or would be deferred if PodDisruptionBudgets are only
+// reported.
+type PlanNode struct {
+	Name            string    `json:"name"`
+	LifecycleStatus string    `json:"lifecycleStatus"`
+	Action          string    `json:"action"`
+	Reasons         []string  `json:"reasons,omitempty"`
+	Pods            []PlanPod `json:"pods"`
+}
+
+// PlanPod is an old DaemonSet pod, or a stuck pod of a stalled DaemonSet,
+// which makes a node a candidate for decommissioning.
+type PlanPod struct {
+	Namespace             string `json:"namespace"`
+	Name                  string `json:"name"`
+	DaemonSet             string `json:"daemonSet"`
+	PodGeneration         int64  `json:"podGeneration,omitempty"`
+	DaemonSetGeneration   int64  `json:"daemonSetGeneration,omitempty"`
+	PodRevisionHash       string `json:"podRevisionHash,omitempty"`
+	DaemonSetRevisionHash string `json:"daemonSetRevisionHash,omitempty"`
+	Stuck                 string `json:"stuck,omitempty"`
+	Skipped               string `json:"skipped,omitempty"`
+}
+
+// buildPlan converts the candidate nodes of a round into a Plan sorted by
+// node name. Only the nodes of the next batch are marked for
+// decommissioning, the other ready nodes are either deferred or held back
+// until a later batch.
+func buildPlan(round *Round) *Plan {
+	plan := &Plan{
+		Nodes:             make([]PlanNode, 0, len(round.Candidates)),
+		StalledDaemonSets: round.Stalled,
+	}
+
+	for _, pod := range round.Skipped {
+		plan.SkippedPods = append(plan.SkippedPods, PlanPod{
+			Namespace: pod.Pod.Namespace,
+			Name:      pod.Pod.Name,
+			DaemonSet: pod.DaemonSet.Name,
+			Skipped:   pod.Reason,
+		})
+	}
+
+	inBatch := make(map[string]bool, len(round.Batch))
+	for _, node := range round.Batch {
+		inBatch[node.Node.Name] = true
+	}
+
+	deferred := make(map[string][]string, len(round.Deferred))
+	for _, node := range round.Deferred {
+		deferred[node.Node.Node.Name] = node.Reasons
+	}
+
+	disrupting := make(map[string][]string, len(round.Disrupting))
+	for _, node := range round.Disrupting {
+		disrupting[node.Node.Node.Name] = node.Reasons
+	}
+
+	for _, node := range round.Candidates {
+		planNode := PlanNode{
+			Name:            node.Node.Name,
+			LifecycleStatus: node.Node.Labels["lifecycle-status"],
+			Action:          actionWait,
+			Pods:            make([]PlanPod, 0, len(node.OldPods)+len(node.StuckPods)),
+		}
+
+		switch {
+		case inBatch[node.Node.Name]:
+			planNode.Action = actionDecommission
+			planNode.Reasons = disrupting[node.Node.Name]
+		case deferred[node.Node.Name] != nil:
+			planNode.Action = actionDefer
+			planNode.Reasons = deferred[node.Node.Name]
+		case nodeReady(node):
+			planNode.Action = actionHold
+		}
+
+		for _, pod := range node.OldPods {
+			planNode.Pods = append(planNode.Pods, PlanPod{
+				Namespace:             pod.Pod.Namespace,
+				Name:                  pod.Pod.Name,
+				DaemonSet:             pod.DaemonSet.Name,
+				PodGeneration:         pod.PodGeneration,
+				DaemonSetGeneration:   pod.DaemonSetGeneration,
+				PodRevisionHash:       pod.PodRevisionHash,
+				DaemonSetRevisionHash: pod.DaemonSetRevisionHash,
+			})
+		}
+
+		for _, pod := range node.StuckPods {
+			planNode.Pods = append(planNode.Pods, PlanPod{
+				Namespace: pod.Pod.Namespace,
+				Name:      pod.Pod.Name,
+				DaemonSet: pod.DaemonSet.Name,
+				Stuck:     pod.Reason,
+			})
+		}
+
+		sort.Slice(planNode.Pods, func(i, j int) bool {
+			if planNode.Pods[i].Namespace != planNode.Pods[j].Namespace {
+				return planNode.Pods[i].Namespace < planNode.Pods[j].Namespace
+			}
+			return planNode.Pods[i].Name < planNode.Pods[j].Name
+		})
+
+		plan.Nodes = append(plan.Nodes, planNode)
+	}
+
+	sort.Slice(plan.Nodes, func(i, j int) bool {
+		return plan.Nodes[i].Name < plan.Nodes[j].Name
+	})
+
+	return plan
+}
+
+// writePlan writes the plan to w in the specified output format.
+func writePlan(w io.Writer, output string, plan *Plan) error {
+	switch output {
+	case outputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	case outputTable:
+		return writePlanTable(w, plan)
+	default:
+		return fmt.Errorf("unknown output format %q", output)
+	}
+}
+
+func writePlanTable(w io.Writer, plan *Plan) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tLIFECYCLE-STATUS\tACTION\tPOD\tDAEMONSET\tPOD-REVISION\tDAEMONSET-REVISION\tSTUCK")
+	for _, node := range plan.Nodes {
+		for _, pod := range node.Pods {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s/%s\t%s\t%s\t%s\t%s\n",
+				node.Name,
+				node.LifecycleStatus,
+				node.Action,
+				pod.Namespace,
+				pod.Name,
+				pod.DaemonSet,
+				revision(pod.PodRevisionHash, pod.PodGeneration),
+				revision(pod.DaemonSetRevisionHash, pod.DaemonSetGeneration),
+				orDash(pod.Stuck),
+			)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, node := range plan.Nodes {
+		deferred := "deferred"
+		if node.Action != actionDefer {
+			deferred = "would be deferred"
+		}
+		for _, reason := range node.Reasons {
+			if _, err := fmt.Fprintf(w, "Node %s %s: %s\n", node.Name, deferred, reason); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, pod := range plan.SkippedPods {
+		if _, err := fmt.Fprintf(w, "Pod %s/%s of daemonset %s skipped: %s\n", pod.Namespace, pod.Name, pod.DaemonSet, pod.Skipped); err != nil {
+			return err
+		}
+	}
+
+	for _, ds := range plan.StalledDaemonSets {
+		if _, err := fmt.Fprintf(w, "DaemonSet %s/%s stalled (%d desired, %d updated, %d available), blocked by nodes: %s\n", ds.Namespace, ds.Name, ds.DesiredNumberScheduled, ds.UpdatedNumberScheduled, ds.NumberAvailable, strings.Join(ds.BlockingNodes, ", ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revision formats the revision hash, or the generation if the hash is
+// unknown.
+func revision(hash string, generation int64) string {
+	if hash != "" {
+		return hash
+	}
+	if generation != 0 {
+		return fmt.Sprintf("generation %d", generation)
+	}
+	return "-"
+}
+
+// orDash formats the value, or returns a dash for the zero value.
+func orDash[T comparable](value T) string {
+	var zero T
+	if value == zero {
+		return "-"
+	}
+	return fmt.Sprint(value)
+}
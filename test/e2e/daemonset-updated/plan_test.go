@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func testNode(name, lifecycleStatus string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"lifecycle-status": lifecycleStatus,
+			},
+		},
+	}
+}
+
+func testDaemonSet(name string, generation int64, strategy appsv1.DaemonSetUpdateStrategyType) *appsv1.DaemonSet {
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       name,
+			Namespace:  "kube-system",
+			UID:        types.UID(name + "-uid"),
+			Generation: generation,
+		},
+		Spec: appsv1.DaemonSetSpec{
+			UpdateStrategy: appsv1.DaemonSetUpdateStrategy{
+				Type: strategy,
+			},
+		},
+	}
+}
+
+func testDaemonSetPod(name, nodeName string, ds *appsv1.DaemonSet, generation int64) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ds.Namespace,
+			Labels: map[string]string{
+				"pod-template-generation": strconv.FormatInt(generation, 10),
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					Kind: "DaemonSet",
+					Name: ds.Name,
+					UID:  ds.UID,
+				},
+			},
+		},
+		Spec: v1.PodSpec{
+			NodeName: nodeName,
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+		},
+	}
+}
+
+func TestBuildPlan(t *testing.T) {
+	onDelete := testDaemonSet("coredns", 3, appsv1.OnDeleteDaemonSetStrategyType)
+	rolling := testDaemonSet("kube-proxy", 5, appsv1.RollingUpdateDaemonSetStrategyType)
+
+	nodeB := testNode("node-b", "decommission-pending")
+	nodeB.Labels[nodePoolLabel] = "other"
+
+	_, source := testSource(t, []runtime.Object{
+		testNode("node-a", "ready"),
+		nodeB,
+		testNode("node-c", "ready"),
+		onDelete,
+		rolling,
+		testDaemonSetPod("coredns-a", "node-a", onDelete, 2),
+		testDaemonSetPod("coredns-b", "node-b", onDelete, 1),
+		testDaemonSetPod("coredns-c", "node-c", onDelete, 3),
+		testDaemonSetPod("kube-proxy-c", "node-c", rolling, 4),
+	}...)
+
+	round, err := candidateNodes(source, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	strategy, err := newStrategy(groupByNodePool, orderByName, intstr.FromString("100%"), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	round.Batch, err = nextBatch(round.Candidates, map[string]int{"": 2, "other": 1}, strategy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	plan := buildPlan(round)
+	expected := []PlanNode{
+		{
+			Name:            "node-a",
+			LifecycleStatus: "ready",
+			Action:          actionDecommission,
+			Pods: []PlanPod{
+				{Namespace: "kube-system", Name: "coredns-a", DaemonSet: "coredns", PodGeneration: 2, DaemonSetGeneration: 3},
+			},
+		},
+		{
+			Name:            "node-b",
+			LifecycleStatus: "decommission-pending",
+			Action:          actionWait,
+			Pods: []PlanPod{
+				{Namespace: "kube-system", Name: "coredns-b", DaemonSet: "coredns", PodGeneration: 1, DaemonSetGeneration: 3},
+			},
+		},
+	}
+
+	actual, _ := json.Marshal(plan.Nodes)
+	want, _ := json.Marshal(expected)
+	if string(actual) != string(want) {
+		t.Errorf("unexpected plan:\n got: %s\nwant: %s", actual, want)
+	}
+}
+
+func TestWritePlan(t *testing.T) {
+	plan := &Plan{
+		Nodes: []PlanNode{
+			{
+				Name:            "node-a",
+				LifecycleStatus: "ready",
+				Action:          actionDecommission,
+				Pods: []PlanPod{
+					{Namespace: "kube-system", Name: "coredns-a", DaemonSet: "coredns", PodGeneration: 2, DaemonSetGeneration: 3},
+				},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writePlan(&buf, outputTable, plan); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "kube-system/coredns-a") {
+		t.Errorf("table output is missing the pod: %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := writePlan(&buf, outputJSON, plan); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var decoded Plan
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid json output: %v", err)
+	}
+	if len(decoded.Nodes) != 1 || decoded.Nodes[0].Action != actionDecommission {
+		t.Errorf("unexpected json output: %s", buf.String())
+	}
+
+	if err := writePlan(&buf, "yaml", plan); err == nil {
+		t.Errorf("expected error for unknown output format")
+	}
+}
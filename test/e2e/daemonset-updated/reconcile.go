@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Round is the result of a single reconciliation.
+type Round struct {
+	// Candidates are all nodes with old daemonset pods or, in recycle
+	// mode, blocking the rollout of a stalled daemonset.
+	Candidates []*Node
+	// Stalled are the RollingUpdate daemonsets with a stalled rollout.
+	Stalled []StalledDaemonSet
+	// Skipped are the OnDelete daemonset pods which couldn't be checked.
+	Skipped []SkippedPod
+	// Batch are the candidate nodes which are marked for decommissioning
+	// in this round.
+	Batch []*Node
+	// Deferred are the candidate nodes which would have been part of the
+	// batch but can't be decommissioned yet.
+	Deferred []DeferredNode
+	// Disrupting are the nodes of the batch which would have been deferred,
+	// if PodDisruptionBudgets are only reported.
+	Disrupting []DeferredNode
+	// Failed are the nodes of the batch which couldn't be marked for
+	// decommissioning.
+	Failed []FailedNode
+}
+
+// DeferredNode is a node whose decommissioning was deferred.
+type DeferredNode struct {
+	Node    *Node
+	Reasons []string
+}
+
+// FailedNode is a node which couldn't be marked for decommissioning.
+type FailedNode struct {
+	Node *Node
+	Err  error
+}
+
+// Reconciler decommissions the next batch of nodes with old daemonset pods.
+type Reconciler interface {
+	Reconcile(ctx context.Context) (*Round, error)
+}
+
+type reconciler struct {
+	client         kubernetes.Interface
+	source         clusterSource
+	strategy       *strategy
+	checkPDBs      bool
+	reportPDBsOnly bool
+	rollingUpdates *rollingUpdateConfig
+	metrics        *metrics
+	dryRun         bool
+
+	// marked are the nodes marked for decommissioning which might not be
+	// reflected in the source yet.
+	marked map[string]struct{}
+}
+
+// Reconcile finds all candidate nodes and marks the next batch of them for
+// decommissioning. In dry-run mode the nodes are not modified.
+func (r *reconciler) Reconcile(ctx context.Context) (*Round, error) {
+	round, err := r.nextRound()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.dryRun {
+		return round, nil
+	}
+
+	for _, skipped := range round.Skipped {
+		log.Printf("Skipped pod %s/%s of daemonset %s: %s", skipped.Pod.Namespace, skipped.Pod.Name, skipped.DaemonSet.Name, skipped.Reason)
+	}
+
+	for _, ds := range round.Stalled {
+		log.Printf("Rollout of daemonset %s/%s is stalled (%d desired, %d updated, %d available), blocked by nodes: %s", ds.Namespace, ds.Name, ds.DesiredNumberScheduled, ds.UpdatedNumberScheduled, ds.NumberAvailable, strings.Join(ds.BlockingNodes, ", "))
+	}
+
+	for _, deferred := range round.Deferred {
+		log.Printf("Deferring decommissioning of node %s: %s", deferred.Node.Node.Name, strings.Join(deferred.Reasons, "; "))
+	}
+
+	for _, disrupting := range round.Disrupting {
+		log.Printf("Decommissioning node %s although it would be deferred: %s", disrupting.Node.Node.Name, strings.Join(disrupting.Reasons, "; "))
+	}
+
+	batch := round.Batch
+	round.Batch = nil
+	for _, node := range batch {
+		err := decommissionNode(ctx, r.client, node)
+		r.metrics.observeDecommission(err)
+		if err != nil {
+			log.Printf("Failed to decommission node %s: %v", node.Node.Name, err)
+			round.Failed = append(round.Failed, FailedNode{Node: node, Err: err})
+			continue
+		}
+		log.Printf("Marked node %s for decommissioning", node.Node.Name)
+		round.Batch = append(round.Batch, node)
+
+		if r.marked == nil {
+			r.marked = make(map[string]struct{})
+		}
+		r.marked[node.Node.Name] = struct{}{}
+	}
+
+	r.metrics.observeRound(round)
+
+	return round, nil
+}
+
+// nextRound returns all candidate nodes and the subset of them which should
+// be marked for decommissioning next. If checkPDBs is set, nodes whose pods
+// can't be evicted without violating a PodDisruptionBudget are deferred
+// instead, or only reported if reportPDBsOnly is set.
+func (r *reconciler) nextRound() (*Round, error) {
+	round, err := candidateNodes(r.source, r.rollingUpdates)
+	if err != nil {
+		return nil, err
+	}
+
+	// the source can lag behind the nodes marked in a previous round,
+	// they must not be marked again.
+	stillMarked := make(map[string]struct{}, len(r.marked))
+	for _, node := range round.Candidates {
+		if _, ok := r.marked[node.Node.Name]; ok && nodeReady(node) {
+			node.Node.Labels["lifecycle-status"] = "decommission-pending"
+			stillMarked[node.Node.Name] = struct{}{}
+		}
+	}
+	r.marked = stillMarked
+
+	sizes, err := groupSizes(r.source, r.strategy.groupBy)
+	if err != nil {
+		return nil, err
+	}
+
+	batch, err := nextBatch(round.Candidates, sizes, r.strategy)
+	if err != nil {
+		return nil, err
+	}
+	round.Batch = batch
+
+	if !r.checkPDBs || len(batch) == 0 {
+		return round, nil
+	}
+
+	checker, err := newPDBChecker(r.source)
+	if err != nil {
+		return nil, err
+	}
+
+	round.Batch = nil
+	for _, node := range batch {
+		if reasons := checker.admit(node); len(reasons) > 0 {
+			if !r.reportPDBsOnly {
+				round.Deferred = append(round.Deferred, DeferredNode{Node: node, Reasons: reasons})
+				continue
+			}
+			round.Disrupting = append(round.Disrupting, DeferredNode{Node: node, Reasons: reasons})
+		}
+		round.Batch = append(round.Batch, node)
+	}
+
+	return round, nil
+}
+
+// minReconcileInterval is the minimum time between two reconciliations, so
+// that frequent changes on large clusters don't lead to busy reconciling.
+const minReconcileInterval = 5 * time.Second
+
+// errorBackoff returns the backoff used after failed reconciliations.
+func errorBackoff(interval time.Duration) wait.Backoff {
+	return wait.Backoff{
+		Duration: minReconcileInterval,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    math.MaxInt32,
+		Cap:      10 * interval,
+	}
+}
+
+// run reconciles whenever a change is signalled on changes, but at least
+// every interval, until no candidate nodes are left or ctx is done. After
+// failed reconciliations it backs off exponentially. It returns a summary of
+// the progress of all candidate nodes.
+func run(ctx context.Context, reconciler Reconciler, changes <-chan struct{}, interval time.Duration) *Summary {
+	tracker := newTracker(time.Now())
+	backoff := errorBackoff(interval)
+
+	var last time.Time
+	for {
+		if wait := minReconcileInterval - time.Since(last); wait > 0 && !last.IsZero() {
+			select {
+			case <-ctx.Done():
+				return tracker.summary(time.Now(), false)
+			case <-time.After(wait):
+			}
+		}
+		last = time.Now()
+
+		waitForChanges := changes
+		next := interval
+
+		round, err := reconciler.Reconcile(ctx)
+		switch {
+		case err != nil:
+			next = backoff.Step()
+			waitForChanges = nil
+			log.Printf("Failed to get candidate nodes, retrying in %s: %v", next, err)
+		case len(round.Candidates) == 0:
+			tracker.observe(round, time.Now())
+			if len(round.Skipped) > 0 {
+				log.Printf("No nodes with old daemonset pods found, but %d daemonset pods couldn't be checked, exiting", len(round.Skipped))
+			} else {
+				log.Printf("No nodes with old daemonset pods found, exiting")
+			}
+			return tracker.summary(time.Now(), true)
+		default:
+			tracker.observe(round, time.Now())
+			if len(round.Failed) > 0 {
+				next = backoff.Step()
+				waitForChanges = nil
+				log.Printf("Failed to decommission %d nodes, retrying in %s", len(round.Failed), next)
+			} else {
+				backoff = errorBackoff(interval)
+			}
+			if len(round.Deferred) > 0 {
+				log.Printf("Waiting for %d nodes with old daemonset pods to decommission, %d of them deferred", len(round.Candidates), len(round.Deferred))
+			} else {
+				log.Printf("Waiting for %d nodes with old daemonset pods to decommission", len(round.Candidates))
+			}
+		}
+
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return tracker.summary(time.Now(), false)
+		case <-waitForChanges:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testSource returns a fake clientset with the objects and an informer
+// source on top of it with synced caches.
+func testSource(t *testing.T, objects ...runtime.Object) (kubernetes.Interface, *informerSource) {
+	t.Helper()
+
+	client := fake.NewSimpleClientset(objects...)
+	source, err := newInformerSource(client, 0)
+	if err != nil {
+		t.Fatalf("failed to create informer source: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	if err := source.Start(ctx); err != nil {
+		t.Fatalf("failed to start informer source: %v", err)
+	}
+
+	return client, source
+}
+
+func TestReconcile(t *testing.T) {
+	ds := testDaemonSet("coredns", 2, appsv1.OnDeleteDaemonSetStrategyType)
+
+	client, source := testSource(t,
+		testNode("node-a", "ready"),
+		testNode("node-b", "ready"),
+		ds,
+		testDaemonSetPod("coredns-a", "node-a", ds, 1),
+		testDaemonSetPod("coredns-b", "node-b", ds, 1),
+	)
+
+	strategy, err := newStrategy(groupByNodePool, orderByName, intstr.FromInt32(1), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r := &reconciler{client: client, source: source, strategy: strategy}
+
+	round, err := r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if names := nodeNames(round.Batch); len(names) != 1 || names[0] != "node-a" {
+		t.Fatalf("expected batch [node-a], got %v", names)
+	}
+
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "node-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if node.Labels["lifecycle-status"] != "decommission-pending" {
+		t.Errorf("expected node-a to be marked for decommissioning, got labels %v", node.Labels)
+	}
+
+	// the next batch is held back, even before the informer has
+	// observed the update of node-a.
+	round, err = r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(round.Batch) != 0 {
+		t.Errorf("expected no batch while node-a is decommissioning, got %v", nodeNames(round.Batch))
+	}
+
+	// once node-a is gone, node-b is decommissioned.
+	if err := client.CoreV1().Nodes().Delete(context.Background(), "node-a", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitForCondition(func() bool {
+		nodes, _ := source.Nodes()
+		return len(nodes) == 1
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	round, err = r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if names := nodeNames(round.Batch); len(names) != 1 || names[0] != "node-b" {
+		t.Errorf("expected batch [node-b], got %v", names)
+	}
+}
+
+type fakeReconciler struct {
+	rounds []*Round
+	calls  int
+}
+
+func (r *fakeReconciler) Reconcile(context.Context) (*Round, error) {
+	round := r.rounds[r.calls]
+	r.calls++
+	return round, nil
+}
+
+func TestRunStopsWithoutCandidates(t *testing.T) {
+	reconciler := &fakeReconciler{
+		rounds: []*Round{
+			{Candidates: []*Node{{Node: &v1.Node{}}}},
+			{},
+		},
+	}
+
+	changes := make(chan struct{}, 1)
+	changes <- struct{}{}
+
+	done := make(chan struct{})
+	go func() {
+		run(context.Background(), reconciler, changes, time.Hour)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * minReconcileInterval):
+		t.Fatalf("run didn't stop after all candidates were gone")
+	}
+
+	if reconciler.calls != 2 {
+		t.Errorf("expected 2 reconciliations, got %d", reconciler.calls)
+	}
+}
+
+func waitForCondition(condition func() bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for !condition() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// exitSuccess means all nodes with old daemonset pods are gone.
+	exitSuccess = 0
+	// exitTimeout means the deadline was reached before any of the
+	// candidate nodes was decommissioned.
+	exitTimeout = 2
+	// exitPartialFailure means the deadline was reached after some, but
+	// not all, candidate nodes were decommissioned.
+	exitPartialFailure = 3
+
+	resultSuccess        = "success"
+	resultTimeout        = "timeout"
+	resultPartialFailure = "partial-failure"
+)
+
+// Summary is the machine-readable report of a run.
+type Summary struct {
+	Result          string       `json:"result"`
+	StartTime       time.Time    `json:"startTime"`
+	EndTime         time.Time    `json:"endTime"`
+	DurationSeconds float64      `json:"durationSeconds"`
+	Decommissioned  []NodeReport `json:"decommissioned"`
+	Stuck           []NodeReport `json:"stuck"`
+}
+
+// NodeReport describes the decommissioning of a single node. The duration
+// is measured from the time the node was marked for decommissioning, or
+// first seen if it was already marked, until it was gone or the run ended.
+type NodeReport struct {
+	Name             string     `json:"name"`
+	MarkedAt         *time.Time `json:"markedAt,omitempty"`
+	DecommissionedAt *time.Time `json:"decommissionedAt,omitempty"`
+	DurationSeconds  float64    `json:"durationSeconds"`
+	LastError        string     `json:"lastError,omitempty"`
+}
+
+// ExitCode returns the process exit code matching the result.
+func (s *Summary) ExitCode() int {
+	switch s.Result {
+	case resultSuccess:
+		return exitSuccess
+	case resultPartialFailure:
+		return exitPartialFailure
+	default:
+		return exitTimeout
+	}
+}
+
+// writeSummary writes the summary as JSON to the file at path.
+func writeSummary(path string, summary *Summary) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// tracker keeps track of the progress of all candidate nodes seen during a
+// run.
+type tracker struct {
+	start time.Time
+	nodes map[string]*nodeProgress
+}
+
+type nodeProgress struct {
+	firstSeen time.Time
+	marked    time.Time
+	gone      time.Time
+	lastError string
+}
+
+func newTracker(start time.Time) *tracker {
+	return &tracker{
+		start: start,
+		nodes: make(map[string]*nodeProgress),
+	}
+}
+
+// observe records the outcome of a reconciliation round.
+func (t *tracker) observe(round *Round, now time.Time) {
+	candidates := make(map[string]struct{}, len(round.Candidates))
+	for _, node := range round.Candidates {
+		candidates[node.Node.Name] = struct{}{}
+
+		progress, ok := t.nodes[node.Node.Name]
+		if !ok {
+			progress = &nodeProgress{firstSeen: now}
+			t.nodes[node.Node.Name] = progress
+		}
+
+		if progress.marked.IsZero() && !nodeReady(node) {
+			progress.marked = now
+		}
+	}
+
+	for _, node := range round.Batch {
+		if progress, ok := t.nodes[node.Node.Name]; ok {
+			progress.marked = now
+			progress.lastError = ""
+		}
+	}
+
+	for _, failed := range round.Failed {
+		if progress, ok := t.nodes[failed.Node.Node.Name]; ok {
+			progress.lastError = failed.Err.Error()
+		}
+	}
+
+	for name, progress := range t.nodes {
+		if _, ok := candidates[name]; !ok && progress.gone.IsZero() {
+			progress.gone = now
+		}
+	}
+}
+
+// summary returns the summary of the run. completed is true if no candidate
+// nodes were left at the end of the run.
+func (t *tracker) summary(now time.Time, completed bool) *Summary {
+	summary := &Summary{
+		StartTime:       t.start,
+		EndTime:         now,
+		DurationSeconds: now.Sub(t.start).Seconds(),
+		Decommissioned:  []NodeReport{},
+		Stuck:           []NodeReport{},
+	}
+
+	for name, progress := range t.nodes {
+		report := NodeReport{
+			Name:      name,
+			LastError: progress.lastError,
+		}
+
+		since := progress.firstSeen
+		if !progress.marked.IsZero() {
+			marked := progress.marked
+			report.MarkedAt = &marked
+			since = marked
+		}
+
+		if progress.gone.IsZero() {
+			report.DurationSeconds = now.Sub(since).Seconds()
+			summary.Stuck = append(summary.Stuck, report)
+			continue
+		}
+
+		gone := progress.gone
+		report.DecommissionedAt = &gone
+		report.DurationSeconds = gone.Sub(since).Seconds()
+		summary.Decommissioned = append(summary.Decommissioned, report)
+	}
+
+	sort.Slice(summary.Decommissioned, func(i, j int) bool {
+		return summary.Decommissioned[i].Name < summary.Decommissioned[j].Name
+	})
+	sort.Slice(summary.Stuck, func(i, j int) bool {
+		return summary.Stuck[i].Name < summary.Stuck[j].Name
+	})
+
+	switch {
+	case completed:
+		summary.Result = resultSuccess
+	case len(summary.Decommissioned) > 0:
+		summary.Result = resultPartialFailure
+	default:
+		summary.Result = resultTimeout
+	}
+
+	return summary
+}
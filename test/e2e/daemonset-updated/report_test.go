@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTrackerSummary(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	nodeA := testCandidate("node-a", "pool", "ready")
+	nodeB := testCandidate("node-b", "pool", "ready")
+	nodeC := testCandidate("node-c", "pool", "decommission-pending")
+
+	tracker := newTracker(start)
+	tracker.observe(&Round{
+		Candidates: []*Node{nodeA, nodeB, nodeC},
+		Batch:      []*Node{nodeA},
+		Failed:     []FailedNode{{Node: nodeB, Err: errors.New("conflict")}},
+	}, start.Add(time.Minute))
+
+	tracker.observe(&Round{
+		Candidates: []*Node{nodeB},
+	}, start.Add(5*time.Minute))
+
+	summary := tracker.summary(start.Add(10*time.Minute), false)
+	if summary.Result != resultPartialFailure || summary.ExitCode() != exitPartialFailure {
+		t.Errorf("expected partial failure, got %s", summary.Result)
+	}
+
+	if len(summary.Decommissioned) != 2 || summary.Decommissioned[0].Name != "node-a" || summary.Decommissioned[1].Name != "node-c" {
+		t.Fatalf("unexpected decommissioned nodes: %+v", summary.Decommissioned)
+	}
+	if summary.Decommissioned[0].DurationSeconds != (4 * time.Minute).Seconds() {
+		t.Errorf("unexpected duration of node-a: %v", summary.Decommissioned[0].DurationSeconds)
+	}
+
+	if len(summary.Stuck) != 1 || summary.Stuck[0].Name != "node-b" {
+		t.Fatalf("unexpected stuck nodes: %+v", summary.Stuck)
+	}
+	if summary.Stuck[0].MarkedAt != nil || summary.Stuck[0].LastError != "conflict" {
+		t.Errorf("unexpected report of node-b: %+v", summary.Stuck[0])
+	}
+	if summary.Stuck[0].DurationSeconds != (9 * time.Minute).Seconds() {
+		t.Errorf("unexpected duration of node-b: %v", summary.Stuck[0].DurationSeconds)
+	}
+}
+
+func TestSummaryResult(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tracker := newTracker(start)
+	tracker.observe(&Round{Candidates: []*Node{testCandidate("node-a", "pool", "ready")}}, start)
+
+	if summary := tracker.summary(start.Add(time.Minute), false); summary.ExitCode() != exitTimeout {
+		t.Errorf("expected timeout, got %s", summary.Result)
+	}
+
+	tracker.observe(&Round{}, start.Add(2*time.Minute))
+	if summary := tracker.summary(start.Add(2*time.Minute), true); summary.ExitCode() != exitSuccess {
+		t.Errorf("expected success, got %s", summary.Result)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func testControllerRevision(ds *appsv1.DaemonSet, hash string, revision int64) *appsv1.ControllerRevision {
+	return &appsv1.ControllerRevision{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ds.Name + "-" + hash,
+			Namespace: ds.Namespace,
+			Labels: map[string]string{
+				appsv1.DefaultDaemonSetUniqueLabelKey: hash,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					Kind:       "DaemonSet",
+					Name:       ds.Name,
+					UID:        ds.UID,
+					Controller: ptr.To(true),
+				},
+			},
+		},
+		Revision: revision,
+	}
+}
+
+func TestOldPodsByControllerRevision(t *testing.T) {
+	ds := testDaemonSet("coredns", 3, appsv1.OnDeleteDaemonSetStrategyType)
+	ds.Status.ObservedGeneration = 3
+
+	current := testDaemonSetPod("coredns-a", "node-a", ds, 1)
+	current.Labels[appsv1.DefaultDaemonSetUniqueLabelKey] = "new"
+
+	old := testDaemonSetPod("coredns-b", "node-b", ds, 3)
+	old.Labels[appsv1.DefaultDaemonSetUniqueLabelKey] = "old"
+
+	// without a hash the generation is used as a fallback.
+	fallback := testDaemonSetPod("coredns-c", "node-c", ds, 2)
+
+	noGeneration := testDaemonSetPod("coredns-d", "node-d", ds, 3)
+	delete(noGeneration.Labels, "pod-template-generation")
+
+	invalidGeneration := testDaemonSetPod("coredns-e", "node-e", ds, 3)
+	invalidGeneration.Labels["pod-template-generation"] = "latest"
+
+	_, source := testSource(t,
+		testNode("node-a", "ready"),
+		testNode("node-b", "ready"),
+		testNode("node-c", "ready"),
+		testNode("node-d", "ready"),
+		testNode("node-e", "ready"),
+		ds,
+		testControllerRevision(ds, "old", 1),
+		testControllerRevision(ds, "new", 2),
+		current,
+		old,
+		fallback,
+		noGeneration,
+		invalidGeneration,
+	)
+
+	round, err := candidateNodes(source, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	plan := buildPlan(round)
+	if len(plan.Nodes) != 2 {
+		t.Fatalf("expected 2 candidates, got %+v", plan.Nodes)
+	}
+
+	if node := plan.Nodes[0]; node.Name != "node-b" || node.Pods[0].PodRevisionHash != "old" || node.Pods[0].DaemonSetRevisionHash != "new" {
+		t.Errorf("expected node-b to be detected by its revision hash, got %+v", node)
+	}
+
+	if node := plan.Nodes[1]; node.Name != "node-c" || node.Pods[0].PodGeneration != 2 || node.Pods[0].DaemonSetGeneration != 3 {
+		t.Errorf("expected node-c to be detected by its generation, got %+v", node)
+	}
+
+	if len(plan.SkippedPods) != 2 || plan.SkippedPods[0].Name != "coredns-d" || plan.SkippedPods[1].Name != "coredns-e" {
+		t.Errorf("expected coredns-d and coredns-e to be skipped, got %+v", plan.SkippedPods)
+	}
+}
+
+func TestRevisionHashRequiresObservedGeneration(t *testing.T) {
+	ds := testDaemonSet("coredns", 3, appsv1.OnDeleteDaemonSetStrategyType)
+	ds.Status.ObservedGeneration = 2
+
+	_, source := testSource(t, ds, testControllerRevision(ds, "old", 1))
+
+	versions, err := onDeleteDaemonsets(source)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	version := versions[dsID{Name: ds.Name, Namespace: ds.Namespace, UID: ds.UID}]
+	if version.RevisionHash != "" || version.Generation != 3 {
+		t.Errorf("expected the revision to be ignored until the latest generation is observed, got %+v", version)
+	}
+}
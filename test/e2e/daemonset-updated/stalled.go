@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	rollingUpdateIgnore  = "ignore"
+	rollingUpdateReport  = "report"
+	rollingUpdateRecycle = "recycle"
+)
+
+// rollingUpdateConfig configures the handling of RollingUpdate daemonsets
+// whose rollout is stalled.
+type rollingUpdateConfig struct {
+	// mode is one of ignore, report or recycle. In recycle mode the
+	// nodes blocking the rollout become candidates for decommissioning.
+	mode string
+	// stallThreshold is the duration after which a pending or unready
+	// daemonset pod is considered stuck.
+	stallThreshold time.Duration
+	now            func() time.Time
+}
+
+func newRollingUpdateConfig(mode string, stallThreshold time.Duration) (*rollingUpdateConfig, error) {
+	switch mode {
+	case rollingUpdateIgnore, rollingUpdateReport, rollingUpdateRecycle:
+	default:
+		return nil, fmt.Errorf("unknown rolling update mode %q, must be one of: %s, %s, %s", mode, rollingUpdateIgnore, rollingUpdateReport, rollingUpdateRecycle)
+	}
+
+	return &rollingUpdateConfig{
+		mode:           mode,
+		stallThreshold: stallThreshold,
+		now:            time.Now,
+	}, nil
+}
+
+// StalledDaemonSet is a RollingUpdate daemonset whose rollout doesn't make
+// progress because some of its pods are stuck.
+type StalledDaemonSet struct {
+	Namespace              string   `json:"namespace"`
+	Name                   string   `json:"name"`
+	DesiredNumberScheduled int32    `json:"desiredNumberScheduled"`
+	UpdatedNumberScheduled int32    `json:"updatedNumberScheduled"`
+	NumberAvailable        int32    `json:"numberAvailable"`
+	BlockingNodes          []string `json:"blockingNodes"`
+}
+
+// StuckPod is a pod of a stalled daemonset which is pending or not ready
+// for longer than the stall threshold.
+type StuckPod struct {
+	Pod       *v1.Pod
+	DaemonSet dsID
+	Reason    string
+}
+
+// rolloutIncomplete returns true if not all pods of the daemonset are
+// updated and available.
+func rolloutIncomplete(ds *appsv1.DaemonSet) bool {
+	if ds.Spec.UpdateStrategy.Type != appsv1.RollingUpdateDaemonSetStrategyType {
+		return false
+	}
+
+	// the status doesn't reflect the latest spec yet
+	if ds.Status.ObservedGeneration < ds.Generation {
+		return false
+	}
+
+	return ds.Status.UpdatedNumberScheduled < ds.Status.DesiredNumberScheduled ||
+		ds.Status.NumberAvailable < ds.Status.DesiredNumberScheduled
+}
+
+// stalledDaemonSets returns the RollingUpdate daemonsets with an incomplete
+// rollout and stuck pods. The stuck pods are added to the nodes they block.
+func stalledDaemonSets(source clusterSource, nodeMapping map[string]*Node, config *rollingUpdateConfig) ([]StalledDaemonSet, error) {
+	daemonsets, err := source.DaemonSets()
+	if err != nil {
+		return nil, err
+	}
+
+	incomplete := make(map[dsID]*appsv1.DaemonSet)
+	for _, ds := range daemonsets {
+		if rolloutIncomplete(ds) {
+			incomplete[dsID{Name: ds.Name, Namespace: ds.Namespace, UID: ds.UID}] = ds
+		}
+	}
+
+	if len(incomplete) == 0 {
+		return nil, nil
+	}
+
+	pods, err := source.Pods()
+	if err != nil {
+		return nil, err
+	}
+
+	now := config.now()
+	blocking := make(map[dsID]map[string]struct{})
+	for _, pod := range pods {
+		owner := metav1.GetControllerOf(pod)
+		if owner == nil || owner.Kind != "DaemonSet" {
+			continue
+		}
+
+		id := dsID{Name: owner.Name, Namespace: pod.Namespace, UID: owner.UID}
+		if _, ok := incomplete[id]; !ok {
+			continue
+		}
+
+		reason, stuck := stuckPod(pod, config.stallThreshold, now)
+		if !stuck {
+			continue
+		}
+
+		nodeName := daemonsetPodNode(pod)
+		node, ok := nodeMapping[nodeName]
+		if !ok {
+			continue
+		}
+
+		node.StuckPods = append(node.StuckPods, StuckPod{Pod: pod, DaemonSet: id, Reason: reason})
+		if blocking[id] == nil {
+			blocking[id] = make(map[string]struct{})
+		}
+		blocking[id][nodeName] = struct{}{}
+	}
+
+	stalled := make([]StalledDaemonSet, 0, len(blocking))
+	for id, nodes := range blocking {
+		ds := incomplete[id]
+		stalled = append(stalled, StalledDaemonSet{
+			Namespace:              ds.Namespace,
+			Name:                   ds.Name,
+			DesiredNumberScheduled: ds.Status.DesiredNumberScheduled,
+			UpdatedNumberScheduled: ds.Status.UpdatedNumberScheduled,
+			NumberAvailable:        ds.Status.NumberAvailable,
+			BlockingNodes:          sortedKeys(nodes),
+		})
+	}
+
+	sort.Slice(stalled, func(i, j int) bool {
+		if stalled[i].Namespace != stalled[j].Namespace {
+			return stalled[i].Namespace < stalled[j].Namespace
+		}
+		return stalled[i].Name < stalled[j].Name
+	})
+
+	return stalled, nil
+}
+
+// stuckPod returns true and the reason if the pod has been pending or not
+// ready for longer than threshold.
+func stuckPod(pod *v1.Pod, threshold time.Duration, now time.Time) (string, bool) {
+	if pod.DeletionTimestamp != nil {
+		return "", false
+	}
+
+	since := pod.CreationTimestamp.Time
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type != v1.PodReady {
+			continue
+		}
+
+		if condition.Status == v1.ConditionTrue {
+			return "", false
+		}
+
+		if !condition.LastTransitionTime.IsZero() {
+			since = condition.LastTransitionTime.Time
+		}
+	}
+
+	if now.Sub(since) < threshold {
+		return "", false
+	}
+
+	if pod.Status.Phase == v1.PodPending {
+		return fmt.Sprintf("pending since %s", since.UTC().Format(time.RFC3339)), true
+	}
+	return fmt.Sprintf("not ready since %s", since.UTC().Format(time.RFC3339)), true
+}
+
+// daemonsetPodNode returns the node of a daemonset pod. Pods which are not
+// scheduled yet are bound to their node by a node affinity on the node's
+// name.
+func daemonsetPodNode(pod *v1.Pod) string {
+	if pod.Spec.NodeName != "" {
+		return pod.Spec.NodeName
+	}
+
+	if pod.Spec.Affinity == nil || pod.Spec.Affinity.NodeAffinity == nil || pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return ""
+	}
+
+	for _, term := range pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		for _, field := range term.MatchFields {
+			if field.Key == metav1.ObjectNameField && field.Operator == v1.NodeSelectorOpIn && len(field.Values) == 1 {
+				return field.Values[0]
+			}
+		}
+	}
+
+	return ""
+}
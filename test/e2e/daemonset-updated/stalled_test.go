@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
+)
+
+func testRollingUpdateDaemonSet(name string, desired, updated, available int32) *appsv1.DaemonSet {
+	ds := testDaemonSet(name, 2, appsv1.RollingUpdateDaemonSetStrategyType)
+	ds.Status = appsv1.DaemonSetStatus{
+		ObservedGeneration:     2,
+		DesiredNumberScheduled: desired,
+		UpdatedNumberScheduled: updated,
+		NumberAvailable:        available,
+	}
+	return ds
+}
+
+func testStuckPod(name, nodeName string, ds *appsv1.DaemonSet, phase v1.PodPhase, since time.Time) *v1.Pod {
+	pod := testDaemonSetPod(name, nodeName, ds, ds.Generation)
+	pod.OwnerReferences[0].Controller = ptr.To(true)
+	pod.CreationTimestamp = metav1.NewTime(since)
+	pod.Status.Phase = phase
+	pod.Status.Conditions = []v1.PodCondition{
+		{Type: v1.PodReady, Status: v1.ConditionFalse, LastTransitionTime: metav1.NewTime(since)},
+	}
+	return pod
+}
+
+func TestStalledDaemonSets(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	stalledDS := testRollingUpdateDaemonSet("node-exporter", 3, 2, 1)
+	progressingDS := testRollingUpdateDaemonSet("kube-proxy", 3, 2, 2)
+	completeDS := testRollingUpdateDaemonSet("fluent-bit", 3, 3, 3)
+
+	// pending pods of daemonsets are not bound to a node, but are
+	// scheduled onto it by a node affinity.
+	pendingPod := testStuckPod("node-exporter-b", "", stalledDS, v1.PodPending, now.Add(-time.Hour))
+	pendingPod.Spec.Affinity = &v1.Affinity{
+		NodeAffinity: &v1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+				NodeSelectorTerms: []v1.NodeSelectorTerm{
+					{
+						MatchFields: []v1.NodeSelectorRequirement{
+							{Key: metav1.ObjectNameField, Operator: v1.NodeSelectorOpIn, Values: []string{"node-b"}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	client, source := testSource(t,
+		testNode("node-a", "ready"),
+		testNode("node-b", "ready"),
+		testNode("node-c", "ready"),
+		stalledDS,
+		progressingDS,
+		completeDS,
+		testStuckPod("node-exporter-a", "node-a", stalledDS, v1.PodRunning, now.Add(-time.Hour)),
+		pendingPod,
+		// not stuck for long enough yet
+		testStuckPod("kube-proxy-c", "node-c", progressingDS, v1.PodRunning, now.Add(-time.Minute)),
+		testStuckPod("fluent-bit-c", "node-c", completeDS, v1.PodRunning, now.Add(-time.Hour)),
+	)
+
+	config, err := newRollingUpdateConfig(rollingUpdateReport, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	config.now = func() time.Time { return now }
+
+	round, err := candidateNodes(source, config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(round.Candidates) != 0 {
+		t.Errorf("expected no candidates in report mode, got %v", nodeNames(round.Candidates))
+	}
+
+	stalled := round.Stalled
+	if len(stalled) != 1 || stalled[0].Name != "node-exporter" {
+		t.Fatalf("expected node-exporter to be stalled, got %+v", stalled)
+	}
+	if blocking := stalled[0].BlockingNodes; len(blocking) != 2 || blocking[0] != "node-a" || blocking[1] != "node-b" {
+		t.Errorf("expected node-a and node-b to block the rollout, got %v", blocking)
+	}
+
+	config.mode = rollingUpdateRecycle
+	strategy, err := newStrategy(groupByNodePool, orderByName, intstr.FromString("100%"), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r := &reconciler{client: client, source: source, strategy: strategy, rollingUpdates: config}
+	round, err = r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if names := nodeNames(round.Batch); len(names) != 2 || names[0] != "node-a" || names[1] != "node-b" {
+		t.Errorf("expected the blocking nodes to be recycled, got %v", names)
+	}
+}
+
+func TestNewRollingUpdateConfig(t *testing.T) {
+	if _, err := newRollingUpdateConfig("restart", time.Minute); err == nil {
+		t.Errorf("expected error for unknown mode")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	groupByNodePool     = "node-pool"
+	groupByZone         = "zone"
+	groupByNodePoolZone = "node-pool-zone"
+
+	orderByName   = "name"
+	orderByOldest = "oldest-first"
+)
+
+// groupFunc returns the key of the group a node belongs to. The
+// max-in-flight budget is applied per group.
+type groupFunc func(node *Node) string
+
+// lessFunc defines the order in which the nodes of a group are
+// decommissioned.
+type lessFunc func(a, b *Node) bool
+
+var groupings = map[string]groupFunc{
+	groupByNodePool: nodePool,
+	groupByZone:     nodeZone,
+	groupByNodePoolZone: func(node *Node) string {
+		return nodePool(node) + "/" + nodeZone(node)
+	},
+}
+
+var orderings = map[string]lessFunc{
+	orderByName: func(a, b *Node) bool {
+		return a.Node.Name < b.Node.Name
+	},
+	orderByOldest: func(a, b *Node) bool {
+		if a.Node.CreationTimestamp.Equal(&b.Node.CreationTimestamp) {
+			return a.Node.Name < b.Node.Name
+		}
+		return a.Node.CreationTimestamp.Before(&b.Node.CreationTimestamp)
+	},
+}
+
+// strategy defines how candidate nodes are grouped, ordered and batched for
+// decommissioning.
+type strategy struct {
+	groupBy     groupFunc
+	less        lessFunc
+	maxInFlight intstr.IntOrString
+	// oneZoneAtATime limits decommissioning to nodes of a single zone
+	// until all of the candidate nodes in that zone are gone.
+	oneZoneAtATime bool
+}
+
+// newStrategy creates a strategy from the names of a grouping and an
+// ordering.
+func newStrategy(groupBy, orderBy string, maxInFlight intstr.IntOrString, oneZoneAtATime bool) (*strategy, error) {
+	group, ok := groupings[groupBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown grouping %q, must be one of: %s", groupBy, strings.Join(sortedKeys(groupings), ", "))
+	}
+
+	less, ok := orderings[orderBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown ordering %q, must be one of: %s", orderBy, strings.Join(sortedKeys(orderings), ", "))
+	}
+
+	return &strategy{
+		groupBy:        group,
+		less:           less,
+		maxInFlight:    maxInFlight,
+		oneZoneAtATime: oneZoneAtATime,
+	}, nil
+}
+
+// nodeZone returns the availability zone of a node.
+func nodeZone(node *Node) string {
+	return node.Node.Labels[v1.LabelTopologyZone]
+}
+
+// activeZone returns the only zone where nodes may be decommissioned when
+// decommissioning one zone at a time. If nodes are already being
+// decommissioned in a zone, that zone stays active until they are gone,
+// otherwise the zone of the first ready node is picked. ok is false if nodes
+// are being decommissioned in more than one zone.
+func (s *strategy) activeZone(inFlight, ready []*Node) (zone string, ok bool) {
+	zones := make(map[string]struct{})
+	for _, node := range inFlight {
+		zones[nodeZone(node)] = struct{}{}
+	}
+
+	switch len(zones) {
+	case 0:
+		if len(ready) == 0 {
+			return "", false
+		}
+		return nodeZone(ready[0]), true
+	case 1:
+		for zone := range zones {
+			return zone, true
+		}
+	}
+
+	return "", false
+}
+
+// sortNodes sorts the nodes according to the strategy's ordering.
+func (s *strategy) sortNodes(nodes []*Node) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return s.less(nodes[i], nodes[j])
+	})
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
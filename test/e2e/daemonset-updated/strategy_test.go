@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func testZonalCandidate(name, pool, zone, lifecycleStatus string, age time.Duration) *Node {
+	node := testCandidate(name, pool, lifecycleStatus)
+	node.Node.Labels[v1.LabelTopologyZone] = zone
+	node.Node.CreationTimestamp = metav1.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(-age))
+	return node
+}
+
+func TestNewStrategy(t *testing.T) {
+	if _, err := newStrategy("rack", orderByName, intstr.FromInt32(1), false); err == nil {
+		t.Errorf("expected error for unknown grouping")
+	}
+	if _, err := newStrategy(groupByZone, "random", intstr.FromInt32(1), false); err == nil {
+		t.Errorf("expected error for unknown ordering")
+	}
+}
+
+func TestNextBatchStrategies(t *testing.T) {
+	ready := []*Node{
+		testZonalCandidate("a", "pool-a", "eu-central-1a", "ready", 1*time.Hour),
+		testZonalCandidate("b", "pool-a", "eu-central-1b", "ready", 3*time.Hour),
+		testZonalCandidate("c", "pool-b", "eu-central-1b", "ready", 2*time.Hour),
+		testZonalCandidate("d", "pool-b", "eu-central-1c", "ready", 4*time.Hour),
+	}
+
+	for _, tc := range []struct {
+		name           string
+		candidates     []*Node
+		groupBy        string
+		orderBy        string
+		oneZoneAtATime bool
+		expected       []string
+	}{
+		{
+			name:       "group by zone",
+			candidates: ready,
+			groupBy:    groupByZone,
+			orderBy:    orderByName,
+			expected:   []string{"a", "b", "d"},
+		},
+		{
+			name:       "group by zone oldest first",
+			candidates: ready,
+			groupBy:    groupByZone,
+			orderBy:    orderByOldest,
+			expected:   []string{"d", "b", "a"},
+		},
+		{
+			name:       "group by node pool and zone",
+			candidates: ready,
+			groupBy:    groupByNodePoolZone,
+			orderBy:    orderByName,
+			expected:   []string{"a", "b", "c", "d"},
+		},
+		{
+			name:           "one zone at a time picks the zone of the first node",
+			candidates:     ready,
+			groupBy:        groupByNodePool,
+			orderBy:        orderByOldest,
+			oneZoneAtATime: true,
+			expected:       []string{"d"},
+		},
+		{
+			name: "one zone at a time keeps the zone of nodes in flight",
+			candidates: append([]*Node{
+				testZonalCandidate("e", "pool-c", "eu-central-1b", "decommission-pending", 5*time.Hour),
+			}, ready...),
+			groupBy:        groupByNodePool,
+			orderBy:        orderByName,
+			oneZoneAtATime: true,
+			expected:       []string{"b", "c"},
+		},
+		{
+			name: "one zone at a time holds back while multiple zones are in flight",
+			candidates: append([]*Node{
+				testZonalCandidate("e", "pool-c", "eu-central-1a", "decommission-pending", 5*time.Hour),
+				testZonalCandidate("f", "pool-c", "eu-central-1b", "decommission-pending", 5*time.Hour),
+			}, ready...),
+			groupBy:        groupByNodePool,
+			orderBy:        orderByName,
+			oneZoneAtATime: true,
+			expected:       []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			strategy, err := newStrategy(tc.groupBy, tc.orderBy, intstr.FromInt32(1), tc.oneZoneAtATime)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			sizes := make(map[string]int)
+			for _, node := range tc.candidates {
+				sizes[strategy.groupBy(node)]++
+			}
+
+			batch, err := nextBatch(tc.candidates, sizes, strategy)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if names := nodeNames(batch); !reflect.DeepEqual(names, tc.expected) {
+				t.Errorf("expected batch %v, got %v", tc.expected, names)
+			}
+		})
+	}
+}
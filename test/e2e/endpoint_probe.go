@@ -0,0 +1,388 @@
+package e2e
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// endpointDiagnosisTimeout is the timeout of the check of an endpoint after a
+// wait for it timed out.
+const endpointDiagnosisTimeout = 30 * time.Second
+
+// phases of an endpoint probe, in the order they are checked
+const (
+	endpointPhaseDNS         = "dns"
+	endpointPhaseConnect     = "connect"
+	endpointPhaseTLS         = "tls"
+	endpointPhaseCertificate = "certificate"
+	endpointPhaseHTTP        = "http"
+)
+
+// endpointProbe checks an endpoint phase by phase, so that a failure can be
+// attributed to a missing DNS record, an unreachable load balancer, a failed
+// TLS handshake, a certificate not valid for the hostname or an unexpected
+// HTTP response. The hostname is resolved by the probe, and the request can
+// be sent to every resolved address, e.g. of all ALB nodes.
+type endpointProbe struct {
+	// resolver resolves the hostname, the default resolver if nil.
+	resolver *net.Resolver
+	// rootCAs verify the certificate, the system roots if nil.
+	rootCAs *x509.CertPool
+	// allAddresses sends the request to every resolved address instead of
+	// only the first one.
+	allAddresses bool
+	// insecure skips verifying the certificate.
+	insecure    bool
+	dialTimeout time.Duration
+	backoff     wait.Backoff
+
+	// http checks the HTTP response.
+	http *httpProbe
+}
+
+// newEndpointProbe returns a probe of the first resolved address of an
+// endpoint, expecting a status code matching status.
+func newEndpointProbe(status func(code int) bool) *endpointProbe {
+	return &endpointProbe{
+		dialTimeout: probeRequestTimeout,
+		backoff: wait.Backoff{
+			Duration: time.Second,
+			Factor:   1.5,
+			Jitter:   0.1,
+			Steps:    math.MaxInt32,
+			Cap:      10 * time.Second,
+		},
+		http: newHTTPProbe(status),
+	}
+}
+
+// withResolver resolves the hostname with the resolver, e.g. of a DNS stub.
+func (p *endpointProbe) withResolver(resolver *net.Resolver) *endpointProbe {
+	p.resolver = resolver
+	return p
+}
+
+// withRootCAs verifies the certificate with the root CAs.
+func (p *endpointProbe) withRootCAs(rootCAs *x509.CertPool) *endpointProbe {
+	p.rootCAs = rootCAs
+	return p
+}
+
+// withAllAddresses sends the request to every resolved address.
+func (p *endpointProbe) withAllAddresses() *endpointProbe {
+	p.allAddresses = true
+	return p
+}
+
+// withInsecureTLS skips verifying the certificate, e.g. of a load balancer
+// hostname the certificate isn't valid for.
+func (p *endpointProbe) withInsecureTLS() *endpointProbe {
+	p.insecure = true
+	return p
+}
+
+// withBackoff sets the delays between the checks of wait.
+func (p *endpointProbe) withBackoff(backoff wait.Backoff) *endpointProbe {
+	p.backoff = backoff
+	return p
+}
+
+// withHTTP checks the HTTP response with the probe. Its transport and
+// backoff are not used.
+func (p *endpointProbe) withHTTP(probe *httpProbe) *endpointProbe {
+	p.http = probe
+	return p
+}
+
+// phaseResult is the result of a phase of an endpoint probe.
+type phaseResult struct {
+	phase   string
+	latency time.Duration
+	// detail describes the phase, e.g. the resolved addresses.
+	detail string
+	err    error
+}
+
+func (r phaseResult) String() string {
+	result := "ok"
+	if r.err != nil {
+		result = fmt.Sprintf("failed: %v", r.err)
+	}
+	if r.detail != "" {
+		result = fmt.Sprintf("%s: %s", result, r.detail)
+	}
+	return fmt.Sprintf("%s %s (%s)", r.phase, result, r.latency.Round(time.Millisecond))
+}
+
+// endpointTarget is the result of the phases after DNS for an address. The
+// phases after the first failed one are skipped.
+type endpointTarget struct {
+	address string
+	phases  []phaseResult
+}
+
+// failed returns the first failed phase, nil if all phases succeeded.
+func (t *endpointTarget) failed() *phaseResult {
+	for i := range t.phases {
+		if t.phases[i].err != nil {
+			return &t.phases[i]
+		}
+	}
+	return nil
+}
+
+// endpointReport is the result of an endpoint probe.
+type endpointReport struct {
+	url     string
+	dns     phaseResult
+	targets []endpointTarget
+}
+
+// verdict returns the first failed phase and its error, of DNS or of any of
+// the targets. The phase is empty if the endpoint is healthy.
+func (r *endpointReport) verdict() (string, error) {
+	if r.dns.err != nil {
+		return r.dns.phase, r.dns.err
+	}
+	for _, target := range r.targets {
+		if failed := target.failed(); failed != nil {
+			return failed.phase, fmt.Errorf("%s: %w", target.address, failed.err)
+		}
+	}
+	return "", nil
+}
+
+func (r *endpointReport) String() string {
+	var b strings.Builder
+	b.WriteString(r.url)
+	if phase, err := r.verdict(); err != nil {
+		fmt.Fprintf(&b, ": %s failed: %v", phase, err)
+	} else {
+		b.WriteString(": ok")
+	}
+
+	fmt.Fprintf(&b, "\n  %s", r.dns)
+	for _, target := range r.targets {
+		fmt.Fprintf(&b, "\n  %s:", target.address)
+		for _, phase := range target.phases {
+			fmt.Fprintf(&b, "\n    %s", phase)
+		}
+	}
+	return b.String()
+}
+
+// endpointError is returned if the endpoint wasn't healthy before the probe
+// was done. It has the report of the last check.
+type endpointError struct {
+	err    error
+	report *endpointReport
+}
+
+func (e *endpointError) Error() string {
+	return fmt.Sprintf("%v, last check: %s", e.err, e.report)
+}
+
+func (e *endpointError) Unwrap() error {
+	return e.err
+}
+
+// wait checks the endpoint until all phases succeed for all targets or ctx is
+// done. If the endpoint isn't healthy, the error is an *endpointError.
+func (p *endpointProbe) wait(ctx context.Context, req *http.Request) (*endpointReport, error) {
+	backoff := p.backoff
+	for {
+		report := p.check(ctx, req)
+		if _, err := report.verdict(); err == nil {
+			return report, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return report, &endpointError{err: ctx.Err(), report: report}
+		case <-time.After(backoff.Step()):
+		}
+	}
+}
+
+// check checks the endpoint once.
+func (p *endpointProbe) check(ctx context.Context, req *http.Request) *endpointReport {
+	report := &endpointReport{url: req.URL.String()}
+	hostname := req.URL.Hostname()
+
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	addresses, dns := p.resolve(ctx, hostname)
+	report.dns = dns
+	if dns.err != nil {
+		return report
+	}
+	if !p.allAddresses {
+		addresses = addresses[:1]
+	}
+
+	for _, address := range addresses {
+		report.targets = append(report.targets, p.checkTarget(ctx, req, net.JoinHostPort(address, port)))
+	}
+	return report
+}
+
+// resolve returns the addresses of the hostname.
+func (p *endpointProbe) resolve(ctx context.Context, hostname string) ([]string, phaseResult) {
+	result := phaseResult{phase: endpointPhaseDNS}
+	start := time.Now()
+
+	resolver := p.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	addresses, err := resolver.LookupHost(ctx, hostname)
+	result.latency = time.Since(start)
+	switch {
+	case err != nil:
+		result.err = err
+	case len(addresses) == 0:
+		result.err = fmt.Errorf("no addresses for %s", hostname)
+	default:
+		result.detail = strings.Join(addresses, ", ")
+	}
+	return addresses, result
+}
+
+// checkTarget checks the phases after DNS with the request sent to the
+// address.
+func (p *endpointProbe) checkTarget(ctx context.Context, req *http.Request, address string) endpointTarget {
+	target := endpointTarget{address: address}
+	dialer := &net.Dialer{Timeout: p.dialTimeout}
+
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	target.phases = append(target.phases, phaseResult{phase: endpointPhaseConnect, latency: time.Since(start), err: err})
+	if err != nil {
+		return target
+	}
+
+	if req.URL.Scheme == "https" {
+		hostname := req.URL.Hostname()
+
+		start = time.Now()
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: hostname,
+			// the certificate is verified separately, so that a
+			// certificate not valid for the hostname can be told
+			// apart from an untrusted one
+			InsecureSkipVerify: true,
+		})
+		err = tlsConn.HandshakeContext(ctx)
+		target.phases = append(target.phases, phaseResult{phase: endpointPhaseTLS, latency: time.Since(start), err: err})
+		if err != nil {
+			conn.Close()
+			return target
+		}
+
+		if !p.insecure {
+			start = time.Now()
+			certificate, err := p.verifyCertificate(tlsConn.ConnectionState(), hostname)
+			target.phases = append(target.phases, phaseResult{phase: endpointPhaseCertificate, latency: time.Since(start), detail: certificate, err: err})
+			if err != nil {
+				tlsConn.Close()
+				return target
+			}
+		}
+		conn = tlsConn
+	}
+
+	// the connection is used for the request, so that it's sent to the
+	// address after the checks above
+	used := false
+	transport := &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			if used {
+				return nil, errors.New("connection to the target already used")
+			}
+			used = true
+			return conn, nil
+		},
+		DialTLSContext: func(context.Context, string, string) (net.Conn, error) {
+			if used {
+				return nil, errors.New("connection to the target already used")
+			}
+			used = true
+			return conn, nil
+		},
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+	defer conn.Close()
+
+	httpProbe := *p.http
+	client := *p.http.client
+	client.Transport = transport
+	httpProbe.client = &client
+
+	_, attempt := httpProbe.attempt(ctx, req)
+	result := phaseResult{phase: endpointPhaseHTTP, latency: attempt.latency, err: attempt.err}
+	if attempt.status != 0 {
+		result.detail = fmt.Sprintf("status %d", attempt.status)
+	}
+	if attempt.err != nil {
+		result.err = fmt.Errorf("%s: %w", attempt.class, attempt.err)
+	}
+	target.phases = append(target.phases, result)
+	return target
+}
+
+// verifyCertificate verifies the certificate chain of the connection with the
+// root CAs, and that the certificate is valid for the hostname. It returns
+// the subject and the DNS names of the certificate.
+func (p *endpointProbe) verifyCertificate(state tls.ConnectionState, hostname string) (string, error) {
+	if len(state.PeerCertificates) == 0 {
+		return "", errors.New("no certificate")
+	}
+	leaf := state.PeerCertificates[0]
+	detail := fmt.Sprintf("%s, DNS names: %s", leaf.Subject, strings.Join(leaf.DNSNames, ", "))
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: p.rootCAs, Intermediates: intermediates}); err != nil {
+		return detail, err
+	}
+
+	if err := leaf.VerifyHostname(hostname); err != nil {
+		return detail, err
+	}
+	return detail, nil
+}
+
+// diagnoseEndpoint checks the endpoint of the request once for every resolved
+// address, so that the error of a wait which timed out tells which phase
+// failed where. It takes at most endpointDiagnosisTimeout, or until the
+// context of the request is done.
+func diagnoseEndpoint(req *http.Request, status func(code int) bool, insecure bool) *endpointReport {
+	ctx, cancel := context.WithTimeout(req.Context(), endpointDiagnosisTimeout)
+	defer cancel()
+
+	probe := newEndpointProbe(status).withAllAddresses()
+	if insecure {
+		probe.withInsecureTLS()
+	}
+	return probe.check(ctx, req)
+}
@@ -0,0 +1,283 @@
+package e2e
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newDNSStub starts a DNS server answering A and AAAA queries with the IPv4
+// and IPv6 addresses of the records, and returns a resolver using it. Other
+// names don't exist.
+func newDNSStub(t *testing.T, records map[string][]string) *net.Resolver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if rsp, err := dnsStubResponse(buf[:n], records); err == nil {
+				conn.WriteTo(rsp, addr)
+			}
+		}
+	}()
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func dnsStubResponse(query []byte, records map[string][]string) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, ok := records[strings.TrimSuffix(question.Name.String(), ".")]
+	header.Response = true
+	header.Authoritative = true
+	if !ok {
+		header.RCode = dnsmessage.RCodeNameError
+	}
+
+	builder := dnsmessage.NewBuilder(nil, header)
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		resourceHeader := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}
+		switch {
+		case question.Type == dnsmessage.TypeA && ip.To4() != nil:
+			a := dnsmessage.AResource{}
+			copy(a.A[:], ip.To4())
+			if err := builder.AResource(resourceHeader, a); err != nil {
+				return nil, err
+			}
+		case question.Type == dnsmessage.TypeAAAA && ip.To4() == nil:
+			aaaa := dnsmessage.AAAAResource{}
+			copy(aaaa.AAAA[:], ip.To16())
+			if err := builder.AAAAResource(resourceHeader, aaaa); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return builder.Finish()
+}
+
+func TestEndpointProbe(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, r.Host)
+	}))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	port := func(server *httptest.Server) string {
+		return server.Listener.Addr().(*net.TCPAddr).AddrPort().String()[len("127.0.0.1:"):]
+	}
+
+	// the certificate of the test server is valid for example.com. The test
+	// servers only listen on 127.0.0.1, so connecting to the port on ::1
+	// fails on every OS, with or without IPv6.
+	resolver := newDNSStub(t, map[string][]string{
+		"example.com":       {"127.0.0.1"},
+		"other.example.org": {"127.0.0.1"},
+		"alb.example.com":   {"127.0.0.1", "::1"},
+	})
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+
+	for _, tc := range []struct {
+		name     string
+		url      string
+		untrust  bool
+		insecure bool
+		all      bool
+		body     string
+		phase    string
+		err      string
+		targets  int
+	}{{
+		name:    "healthy",
+		url:     "https://example.com:" + port(server) + "/",
+		body:    "example.com:" + port(server),
+		targets: 1,
+	}, {
+		name:  "missing record",
+		url:   "https://missing.example.com:" + port(server) + "/",
+		phase: endpointPhaseDNS,
+		err:   "no such host",
+	}, {
+		name:    "connection refused",
+		url:     "https://example.com:" + port(closed) + "/",
+		phase:   endpointPhaseConnect,
+		err:     "connection refused",
+		targets: 1,
+	}, {
+		name:    "no TLS",
+		url:     "https://example.com:" + port(plain) + "/",
+		phase:   endpointPhaseTLS,
+		targets: 1,
+	}, {
+		name:    "untrusted certificate",
+		url:     "https://example.com:" + port(server) + "/",
+		untrust: true,
+		phase:   endpointPhaseCertificate,
+		err:     "x509: certificate signed by unknown authority",
+		targets: 1,
+	}, {
+		name:    "hostname not in the certificate",
+		url:     "https://other.example.org:" + port(server) + "/",
+		phase:   endpointPhaseCertificate,
+		err:     "x509: certificate is valid for",
+		targets: 1,
+	}, {
+		name:     "certificate not verified",
+		url:      "https://other.example.org:" + port(server) + "/",
+		untrust:  true,
+		insecure: true,
+		targets:  1,
+	}, {
+		name:    "unexpected status",
+		url:     "https://example.com:" + port(server) + "/missing",
+		phase:   endpointPhaseHTTP,
+		err:     "status: unexpected status code 404",
+		targets: 1,
+	}, {
+		name:    "plain HTTP",
+		url:     "http://example.com:" + port(plain) + "/",
+		phase:   endpointPhaseHTTP,
+		err:     "status: unexpected status code 404",
+		targets: 1,
+	}, {
+		name:    "all addresses",
+		url:     "https://alb.example.com:" + port(server) + "/",
+		all:     true,
+		phase:   endpointPhaseConnect,
+		err:     "[::1]:" + port(server),
+		targets: 2,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", tc.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			probe := newEndpointProbe(isSuccess).withResolver(resolver)
+			if !tc.untrust {
+				probe.withRootCAs(rootCAs)
+			}
+			if tc.insecure {
+				probe.withInsecureTLS()
+			}
+			if tc.all {
+				probe.withAllAddresses()
+			}
+			if tc.body != "" {
+				probe.withHTTP(newHTTPProbe(isSuccess).withBody(bodyEquals(tc.body)))
+			}
+
+			report := probe.check(context.Background(), req)
+			phase, err := report.verdict()
+			if phase != tc.phase {
+				t.Errorf("expected %q to fail, got %q: %v\n%s", tc.phase, phase, err, report)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Errorf("expected error containing %q, got %v", tc.err, err)
+			}
+			if len(report.targets) != tc.targets {
+				t.Errorf("expected %d targets, got %d\n%s", tc.targets, len(report.targets), report)
+			}
+		})
+	}
+}
+
+func TestEndpointProbeWait(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://missing.example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = newEndpointProbe(isSuccess).
+		withResolver(newDNSStub(t, nil)).
+		withBackoff(testProbeBackoff).
+		wait(ctx, req)
+
+	var endpointErr *endpointError
+	if !errors.As(err, &endpointErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+	if phase, _ := endpointErr.report.verdict(); phase != endpointPhaseDNS {
+		t.Errorf("expected the DNS phase to fail, got %s", endpointErr.report)
+	}
+}
+
+func TestWaitForResponseReturnResponseDiagnosis(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = waitForResponseReturnResponse(req, 50*time.Millisecond, isSuccess, false)
+	var probeErr *probeError
+	if !errors.As(err, &probeErr) {
+		t.Fatalf("expected a probe error, got %v", err)
+	}
+	address := server.Listener.Addr().String()
+	if msg := err.Error(); !strings.Contains(msg, "endpoint check after the timeout: "+server.URL+": http failed: "+address+": status: unexpected status code 503") {
+		t.Errorf("expected the endpoint check in the error, got:\n%s", msg)
+	}
+}
@@ -0,0 +1,333 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// probeRequestTimeout is the timeout of a single probe request.
+	probeRequestTimeout = 10 * time.Second
+	// probeHistorySize is the number of attempts kept for diagnostics.
+	probeHistorySize = 20
+
+	// error classes of failed probe attempts
+	probeErrorCanceled   = "canceled"
+	probeErrorTimeout    = "timeout"
+	probeErrorDNS        = "dns"
+	probeErrorConnection = "connection"
+	probeErrorTLS        = "tls"
+	probeErrorRequest    = "request"
+	probeErrorStatus     = "status"
+	probeErrorHeader     = "header"
+	probeErrorBody       = "body"
+)
+
+// httpProbe polls an HTTP endpoint until the response matches all its
+// matchers. Only the status code is checked by default.
+type httpProbe struct {
+	client  *http.Client
+	backoff wait.Backoff
+
+	status func(code int) bool
+	header func(header http.Header) error
+	body   func(body []byte) error
+}
+
+// newHTTPProbe returns a probe expecting a status code matching status. It
+// doesn't follow redirects and retries every second, backing off to at most
+// every 10 seconds. Every attempt resolves the hostname and connects again,
+// so that a stale or draining load balancer node isn't probed repeatedly.
+func newHTTPProbe(status func(code int) bool) *httpProbe {
+	return &httpProbe{
+		client: &http.Client{
+			Transport: &http.Transport{DisableKeepAlives: true},
+			Timeout:   probeRequestTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		backoff: wait.Backoff{
+			Duration: time.Second,
+			Factor:   1.5,
+			Jitter:   0.1,
+			Steps:    math.MaxInt32,
+			Cap:      10 * time.Second,
+		},
+		status: status,
+	}
+}
+
+// withTransport sends the requests with the round tripper. Unlike the
+// transport of the probe, it may reuse connections between attempts, e.g.
+// createHTTPRoundTripper only closes idle connections every 3 seconds. Its
+// idle connections aren't closed by the probe, as it may be shared.
+func (p *httpProbe) withTransport(rt http.RoundTripper) *httpProbe {
+	p.client.Transport = rt
+	return p
+}
+
+// withInsecureTLS skips verifying the certificate of the endpoint.
+func (p *httpProbe) withInsecureTLS() *httpProbe {
+	return p.withTransport(&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true})
+}
+
+// withRedirects follows redirects instead of checking the redirect response.
+func (p *httpProbe) withRedirects() *httpProbe {
+	p.client.CheckRedirect = nil
+	return p
+}
+
+// withRequestTimeout sets the timeout of every request.
+func (p *httpProbe) withRequestTimeout(timeout time.Duration) *httpProbe {
+	p.client.Timeout = timeout
+	return p
+}
+
+// withBackoff sets the delays between attempts. The last delay is repeated
+// once the steps are exhausted.
+func (p *httpProbe) withBackoff(backoff wait.Backoff) *httpProbe {
+	p.backoff = backoff
+	return p
+}
+
+// withHeader expects the response headers to match.
+func (p *httpProbe) withHeader(header func(http.Header) error) *httpProbe {
+	p.header = header
+	return p
+}
+
+// withBody expects the response body to match.
+func (p *httpProbe) withBody(body func([]byte) error) *httpProbe {
+	p.body = body
+	return p
+}
+
+// headerEquals expects the response header key to have the value.
+func headerEquals(key, value string) func(http.Header) error {
+	return func(header http.Header) error {
+		if actual := header.Get(key); actual != value {
+			return fmt.Errorf("expected header %s to be %q, got %q", key, value, actual)
+		}
+		return nil
+	}
+}
+
+// bodyEquals expects the response body to be the content.
+func bodyEquals(content string) func([]byte) error {
+	return func(body []byte) error {
+		if string(body) != content {
+			return fmt.Errorf("expected body %q, got %q", content, truncate(string(body), 100))
+		}
+		return nil
+	}
+}
+
+// bodyContains expects the response body to contain the content.
+func bodyContains(content string) func([]byte) error {
+	return func(body []byte) error {
+		if !bytes.Contains(body, []byte(content)) {
+			return fmt.Errorf("expected body to contain %q, got %q", content, truncate(string(body), 100))
+		}
+		return nil
+	}
+}
+
+// probeAttempt is a single request of a probe.
+type probeAttempt struct {
+	start   time.Time
+	latency time.Duration
+	// status is the status code, 0 if there was no response.
+	status int
+	// class is the class of the error, empty if the response matched.
+	class string
+	err   error
+}
+
+func (a probeAttempt) String() string {
+	result := "ok"
+	if a.err != nil {
+		result = fmt.Sprintf("%s: %v", a.class, a.err)
+	}
+	return fmt.Sprintf("%s status=%d latency=%s %s", a.start.UTC().Format(time.RFC3339), a.status, a.latency.Round(time.Millisecond), result)
+}
+
+// probeError is returned if no response matched before the probe was done.
+// It has the last attempts of the probe.
+type probeError struct {
+	url      string
+	err      error
+	elapsed  time.Duration
+	total    int
+	attempts []probeAttempt
+}
+
+func (e *probeError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s didn't match after %d attempts in %s: %v", e.url, e.total, e.elapsed.Round(time.Second), e.err)
+	if last := e.last(); last != nil && last.err != nil {
+		fmt.Fprintf(&b, ", last attempt failed with %s: %v", last.class, last.err)
+	}
+	if len(e.attempts) < e.total {
+		fmt.Fprintf(&b, "\nlast %d attempts:", len(e.attempts))
+	}
+	for _, attempt := range e.attempts {
+		fmt.Fprintf(&b, "\n  %s", attempt)
+	}
+	return b.String()
+}
+
+// Unwrap returns the reason the probe was done and the error of the last
+// attempt.
+func (e *probeError) Unwrap() []error {
+	errs := []error{e.err}
+	if last := e.last(); last != nil && last.err != nil {
+		errs = append(errs, last.err)
+	}
+	return errs
+}
+
+func (e *probeError) last() *probeAttempt {
+	if len(e.attempts) == 0 {
+		return nil
+	}
+	return &e.attempts[len(e.attempts)-1]
+}
+
+// wait sends the request until the response matches or ctx is done. The
+// body of the returned response is read already and can be read again. If no
+// response matched, the error is a *probeError.
+func (p *httpProbe) wait(ctx context.Context, req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	backoff := p.backoff
+	probeErr := &probeError{url: req.URL.String()}
+
+	for {
+		rsp, attempt := p.attempt(ctx, req)
+		if attempt.err == nil {
+			return rsp, nil
+		}
+
+		// an attempt interrupted by the end of the probe tells nothing
+		// about the endpoint, unless it's the only one
+		if ctx.Err() == nil || probeErr.total == 0 {
+			probeErr.total++
+			probeErr.attempts = append(probeErr.attempts, attempt)
+			if len(probeErr.attempts) > probeHistorySize {
+				probeErr.attempts = probeErr.attempts[1:]
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			probeErr.err = ctx.Err()
+			probeErr.elapsed = time.Since(start)
+			return nil, probeErr
+		case <-time.After(backoff.Step()):
+		}
+	}
+}
+
+// waitTimeout sends the request until the response matches or the timeout
+// is reached.
+func (p *httpProbe) waitTimeout(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	return p.wait(ctx, req)
+}
+
+// attempt sends the request once and checks the response. The body is always
+// read and closed.
+func (p *httpProbe) attempt(ctx context.Context, req *http.Request) (*http.Response, probeAttempt) {
+	attempt := probeAttempt{start: time.Now()}
+
+	fail := func(class string, err error) (*http.Response, probeAttempt) {
+		attempt.class = class
+		attempt.err = err
+		attempt.latency = time.Since(attempt.start)
+		return nil, attempt
+	}
+
+	rsp, err := p.client.Do(req.Clone(ctx))
+	if err != nil {
+		return fail(classifyProbeError(err), err)
+	}
+	attempt.status = rsp.StatusCode
+
+	body, err := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		return fail(classifyProbeError(err), err)
+	}
+	rsp.Body = io.NopCloser(bytes.NewReader(body))
+
+	if !p.status(rsp.StatusCode) {
+		return fail(probeErrorStatus, fmt.Errorf("unexpected status code %d", rsp.StatusCode))
+	}
+	if p.header != nil {
+		if err := p.header(rsp.Header); err != nil {
+			return fail(probeErrorHeader, err)
+		}
+	}
+	if p.body != nil {
+		if err := p.body(body); err != nil {
+			return fail(probeErrorBody, err)
+		}
+	}
+
+	attempt.latency = time.Since(attempt.start)
+	return rsp, attempt
+}
+
+// classifyProbeError returns the class of an error sending a request.
+func classifyProbeError(err error) string {
+	var (
+		dnsErr         *net.DNSError
+		certErr        *tls.CertificateVerificationError
+		hostnameErr    x509.HostnameError
+		unknownAuthErr x509.UnknownAuthorityError
+		invalidErr     x509.CertificateInvalidError
+		recordErr      tls.RecordHeaderError
+		alertErr       tls.AlertError
+		netErr         net.Error
+		opErr          *net.OpError
+	)
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return probeErrorCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return probeErrorTimeout
+	case errors.As(err, &dnsErr):
+		return probeErrorDNS
+	case errors.As(err, &certErr), errors.As(err, &hostnameErr), errors.As(err, &unknownAuthErr),
+		errors.As(err, &invalidErr), errors.As(err, &recordErr), errors.As(err, &alertErr):
+		return probeErrorTLS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return probeErrorTimeout
+	case errors.As(err, &opErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return probeErrorConnection
+	default:
+		return probeErrorRequest
+	}
+}
+
+// truncate shortens s to at most n bytes.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,208 @@
+package e2e
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// testProbeBackoff retries quickly, so that the tests don't wait.
+var testProbeBackoff = wait.Backoff{Duration: time.Millisecond}
+
+func TestHTTPProbe(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			fmt.Fprint(w, "old backend")
+		default:
+			w.Header().Set("X-Backend", "new")
+			fmt.Fprint(w, "new backend")
+		}
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsp, err := newHTTPProbe(isSuccess).
+		withBackoff(testProbeBackoff).
+		withHeader(headerEquals("X-Backend", "new")).
+		withBody(bodyEquals("new backend")).
+		waitTimeout(req, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 3 {
+		t.Errorf("expected 3 requests, got %d", requests.Load())
+	}
+
+	// the body can be read again
+	body, err := getBody(rsp)
+	if err != nil || body != "new backend" {
+		t.Errorf("expected the body of the matching response, got %q: %v", body, err)
+	}
+}
+
+func TestHTTPProbeTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "wrong backend")
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/path", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err = newHTTPProbe(isSuccess).withBackoff(testProbeBackoff).withBody(bodyContains("right")).wait(ctx, req)
+
+	var probeErr *probeError
+	if !errors.As(err, &probeErr) {
+		t.Fatalf("expected a probe error, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the probe to time out, got %v", err)
+	}
+	if probeErr.total < 2 || len(probeErr.attempts) > probeHistorySize || len(probeErr.attempts) > probeErr.total {
+		t.Errorf("unexpected history of %d attempts: %v", probeErr.total, probeErr.attempts)
+	}
+
+	last := probeErr.last()
+	if last.status != http.StatusOK || last.class != probeErrorBody || last.latency <= 0 {
+		t.Errorf("expected the last attempt to fail the body check, got %s", last)
+	}
+	if msg := err.Error(); !strings.Contains(msg, server.URL+"/path didn't match") || !strings.Contains(msg, `expected body to contain "right", got "wrong backend"`) {
+		t.Errorf("unexpected error message:\n%s", msg)
+	}
+}
+
+func TestHTTPProbeConnections(t *testing.T) {
+	var connections atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keepAlive := &http.Transport{}
+	defer keepAlive.CloseIdleConnections()
+
+	for _, tc := range []struct {
+		name        string
+		probe       *httpProbe
+		connections int32
+	}{
+		{name: "default transport", probe: newHTTPProbe(isSuccess), connections: 3},
+		// the connections of a caller's transport are left alone
+		{name: "transport keeping connections alive", probe: newHTTPProbe(isSuccess).withTransport(keepAlive), connections: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			connections.Store(0)
+			for range 3 {
+				if _, attempt := tc.probe.attempt(context.Background(), req); attempt.class != probeErrorStatus {
+					t.Fatalf("expected a status error, got %s", attempt)
+				}
+			}
+			if n := connections.Load(); n != tc.connections {
+				t.Errorf("expected %d connections, got %d", tc.connections, n)
+			}
+		})
+	}
+}
+
+func TestClassifyProbeError(t *testing.T) {
+	tlsServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tlsServer.Config.ErrorLog = log.New(io.Discard, "", 0)
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	for _, tc := range []struct {
+		name    string
+		url     string
+		timeout time.Duration
+		class   string
+	}{
+		{name: "untrusted certificate", url: tlsServer.URL, timeout: probeRequestTimeout, class: probeErrorTLS},
+		{name: "connection refused", url: closed.URL, timeout: probeRequestTimeout, class: probeErrorConnection},
+		// only the slow server is expected to time out
+		{name: "request timeout", url: slow.URL, timeout: 50 * time.Millisecond, class: probeErrorTimeout},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", tc.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			probe := newHTTPProbe(isSuccess).withRequestTimeout(tc.timeout)
+			if _, attempt := probe.attempt(context.Background(), req); attempt.class != tc.class {
+				t.Errorf("expected %s error, got %s", tc.class, attempt)
+			}
+		})
+	}
+
+	if class := classifyProbeError(context.Canceled); class != probeErrorCanceled {
+		t.Errorf("expected canceled, got %s", class)
+	}
+}
+
+func TestGetAndWaitResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/other", http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// redirects are not followed
+	rsp, err := getAndWaitResponse(http.DefaultTransport, req, time.Second, http.StatusTemporaryRedirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location := rsp.Header.Get("Location"); location != "/other" {
+		t.Errorf("expected the redirect to /other, got %q", location)
+	}
+
+	if _, err := getAndWaitResponse(http.DefaultTransport, req, 10*time.Millisecond, http.StatusOK); err == nil {
+		t.Error("expected the wait for 200 to time out")
+	}
+}
@@ -496,22 +496,17 @@ rBackend: Path("/backend") -> inlineContent("%s") -> <shunt>;`,
 		Expect(resp.StatusCode).To(Or(Equal(201), Equal(202)))
 		resp.Body.Close()
 
-		cnt := map[int]int{
-			201: 0,
-			202: 0,
-		}
-		for i := 0; i < 100; i++ {
-			resp, err = waitForResponseReturnResponse(req, 10*time.Minute, func(code int) bool {
-				return code > 200 && code < 203
-			}, false)
-			framework.ExpectNoError(err)
-			resp.Body.Close()
-			cnt[resp.StatusCode]++
-		}
-		res201 := cnt[201] > 40 && cnt[201] < 60
-		res202 := cnt[202] > 40 && cnt[202] < 60
-		Expect(res201).To(BeTrue())
-		Expect(res202).To(BeTrue())
+		rt, quit := createHTTPRoundTripper()
+		defer func() {
+			quit <- struct{}{}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+		split, err := measureTrafficSplit(ctx, rt, req, trafficSplitRequests, func(code int) bool {
+			return code > 200 && code < 203
+		})
+		framework.ExpectNoError(err)
+		framework.ExpectNoError(split.verify(map[string]float64{"blue": 0.5, "green": 0.5}, trafficSplitConfidence))
 	})
 
 	It("Should create gradual traffic routes [RouteGroup] [Zalando]", func() {
@@ -570,7 +565,17 @@ rBackend: Path("/blue-green") -> status(202) -> inlineContent("%s") -> <shunt>;`
 		framework.ExpectNoError(e2epod.WaitForPodNameRunningInNamespace(context.TODO(), f.ClientSet, pod.Name, pod.Namespace))
 		framework.ExpectNoError(e2epod.WaitForPodNameRunningInNamespace(context.TODO(), f.ClientSet, pod2.Name, pod2.Namespace))
 
-		// RouteGroup
+		// RouteGroup, the backends respond with their name
+		weightedBackends := []rgv1.RouteGroupBackendReference{
+			{
+				BackendName: expectedResponse,
+				Weight:      80,
+			},
+			{
+				BackendName: expectedResponse2,
+				Weight:      20,
+			},
+		}
 		By("Creating a routegroup with name " + serviceName + "-" + serviceName2 + " in namespace " + ns + " with hostname " + hostName)
 		rg := createRouteGroupWithBackends(serviceName+"-"+serviceName2, hostName, ns, labels, nil,
 			[]rgv1.RouteGroupBackend{
@@ -603,16 +608,7 @@ rBackend: Path("/blue-green") -> status(202) -> inlineContent("%s") -> <shunt>;`
 				},
 			}, rgv1.RouteGroupRouteSpec{
 				PathSubtree: "/blue-green",
-				Backends: []rgv1.RouteGroupBackendReference{
-					{
-						BackendName: expectedResponse,
-						Weight:      80,
-					},
-					{
-						BackendName: expectedResponse2,
-						Weight:      20,
-					},
-				},
+				Backends:    weightedBackends,
 			})
 		rgCreate, err := cs.ZalandoV1().RouteGroups(ns).Create(context.TODO(), rg, metav1.CreateOptions{})
 		framework.ExpectNoError(err)
@@ -637,25 +633,17 @@ rBackend: Path("/blue-green") -> status(202) -> inlineContent("%s") -> <shunt>;`
 
 		// checking blue-green routes are ~80/20 match
 		By("checking the response for a request to /blue-green we know if we got the correct weights for our backends")
-		req, err = http.NewRequest("GET", "https://"+hostName+"/blue-green", nil)
+		rt, quit := createHTTPRoundTripper()
+		defer func() {
+			quit <- struct{}{}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+		split, err := measureTrafficSplit(ctx, rt, req, trafficSplitRequests, func(code int) bool {
+			return code > 200 && code < 203
+		})
 		framework.ExpectNoError(err)
-		cnt := map[int]int{
-			201: 0,
-			202: 0,
-		}
-		for i := 0; i < 100; i++ {
-			resp, err = waitForResponseReturnResponse(req, 10*time.Minute, func(code int) bool {
-				return code > 200 && code < 203
-			}, false)
-			framework.ExpectNoError(err)
-			resp.Body.Close()
-			cnt[resp.StatusCode]++
-		}
-		// +/- 5 for 80/20
-		res201 := cnt[201] > 75 && cnt[201] < 85
-		res202 := cnt[202] > 15 && cnt[202] < 25
-		Expect(res201).To(BeTrue(), "201 count should be between 75 and 85, got %d", cnt[201])
-		Expect(res202).To(BeTrue(), "202 count should be between 15 and 25, got %d", cnt[202])
+		framework.ExpectNoError(split.verify(routeGroupTrafficWeights(weightedBackends), trafficSplitConfidence))
 	})
 
 	It("Should create NLB routegroup [RouteGroup] [Zalando]", func() {
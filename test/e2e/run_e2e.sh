@@ -143,7 +143,11 @@ if [ "$create_cluster" = true ]; then
 
     # rotate nodes with old daemonset pods and update strategy onDelete
     # This is important to ensure we e2e test against e.g. latest coredns daemonset
-    ./check-daemonset-updated
+    # Nodes blocked by a PodDisruptionBudget are only logged instead of deferred,
+    # so that a PDB without allowed disruptions can't stall the update. If nodes
+    # with old pods are left after the timeout, it fails with the summary of the
+    # stuck nodes.
+    ./check-daemonset-updated --report-pdbs-only --timeout=60m
 
     # Wait for the resources to be ready after the update
     # TODO: make a feature of CLM --wait-for-kube-system
@@ -0,0 +1,155 @@
+package e2e
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	rgv1 "github.com/szuecs/routegroup-client/apis/zalando.org/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// trafficSplitFalseFailureRate is the probability that a run of the e2e
+	// tests fails a traffic split check, although the traffic is split as
+	// configured.
+	trafficSplitFalseFailureRate = 0.001
+	// trafficSplitChecks is the number of splits between two backends which
+	// are checked per run, by the blue-green and the gradual RouteGroup
+	// tests.
+	trafficSplitChecks = 2
+	// trafficSplitConfidence is the probability that the observed share of
+	// a backend is within the interval of its configured weight, if the
+	// traffic is split as configured. The false failure rate is split evenly
+	// between the checks.
+	trafficSplitConfidence = 1 - trafficSplitFalseFailureRate/trafficSplitChecks
+	// trafficSplitMargin is the maximum margin of the interval of an 80/20
+	// split, the one of the previous checks of 100 requests.
+	trafficSplitMargin = 0.04
+)
+
+// trafficSplitRequests is the number of requests measuring a split, so that
+// the interval of an 80/20 split is at most trafficSplitMargin. These are
+// 1212 requests, with an interval of ±4.0% for an 80/20 split and ±5.0% for
+// a 50/50 split.
+var trafficSplitRequests = requestsForMargin(0.2, trafficSplitMargin, trafficSplitConfidence)
+
+// requestsForMargin returns the number of requests needed for the interval of
+// the share with the confidence to be at most margin.
+func requestsForMargin(share, margin, confidence float64) int {
+	z := confidenceZ(confidence)
+	return int(math.Ceil(z * z * share * (1 - share) / (margin * margin)))
+}
+
+// confidenceZ returns the margin of the normal approximation of the binomial
+// distribution with the confidence, in standard deviations.
+func confidenceZ(confidence float64) float64 {
+	return math.Sqrt2 * math.Erfinv(confidence)
+}
+
+// trafficSplit is the observed split of requests between backends, which are
+// identified by their response body.
+type trafficSplit struct {
+	total  int
+	counts map[string]int
+}
+
+// measureTrafficSplit sends the request n times with the round tripper, e.g.
+// of createHTTPRoundTripper, and counts the responses by body. Every request
+// is retried until the status code matches, so that a failed request isn't
+// counted for any backend. The connections of the round tripper are reused,
+// so that the requests don't need a TLS handshake each.
+func measureTrafficSplit(ctx context.Context, rt http.RoundTripper, req *http.Request, n int, status func(code int) bool) (*trafficSplit, error) {
+	probe := newHTTPProbe(status).
+		withTransport(rt).
+		withBackoff(wait.Backoff{Duration: 100 * time.Millisecond, Factor: 2, Steps: math.MaxInt32, Cap: 5 * time.Second})
+
+	split := &trafficSplit{counts: map[string]int{}}
+	for range n {
+		rsp, err := probe.wait(ctx, req)
+		if err != nil {
+			return split, fmt.Errorf("request %d of %d failed: %w", split.total+1, n, err)
+		}
+		body, err := getBody(rsp)
+		if err != nil {
+			return split, err
+		}
+		split.counts[strings.TrimSpace(body)]++
+		split.total++
+	}
+	return split, nil
+}
+
+func (s *trafficSplit) String() string {
+	backends := slices.Sorted(maps.Keys(s.counts))
+	split := make([]string, 0, len(backends))
+	for _, backend := range backends {
+		split = append(split, fmt.Sprintf("%q: %d (%.1f%%)", backend, s.counts[backend], s.share(backend)*100))
+	}
+	return fmt.Sprintf("%d requests, %s", s.total, strings.Join(split, ", "))
+}
+
+// share returns the observed share of requests of the backend.
+func (s *trafficSplit) share(backend string) float64 {
+	if s.total == 0 {
+		return 0
+	}
+	return float64(s.counts[backend]) / float64(s.total)
+}
+
+// verify checks that the observed share of every backend is within the
+// confidence interval of its share of the weights, and that no other backend
+// responded. The weights don't need to add up to 1 or 100.
+func (s *trafficSplit) verify(weights map[string]float64, confidence float64) error {
+	var sum float64
+	for backend, weight := range weights {
+		if weight < 0 {
+			return fmt.Errorf("negative weight %v of backend %q", weight, backend)
+		}
+		sum += weight
+	}
+	if sum == 0 {
+		return errors.New("no backend with a weight")
+	}
+	if s.total == 0 {
+		return errors.New("no requests")
+	}
+
+	z := confidenceZ(confidence)
+
+	var errs []error
+	for _, backend := range slices.Sorted(maps.Keys(weights)) {
+		expected := weights[backend] / sum
+		margin := z * math.Sqrt(expected*(1-expected)/float64(s.total))
+		if observed := s.share(backend); math.Abs(observed-expected) > margin {
+			errs = append(errs, fmt.Errorf("backend %q got %.1f%% of the requests, expected %.1f%% ± %.1f%%",
+				backend, observed*100, expected*100, margin*100))
+		}
+	}
+	for _, backend := range slices.Sorted(maps.Keys(s.counts)) {
+		if _, ok := weights[backend]; !ok {
+			errs = append(errs, fmt.Errorf("unexpected backend %q got %d requests", truncate(backend, 100), s.counts[backend]))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("traffic split of %s doesn't match the weights with %v%% confidence:\n%w", s, confidence*100, err)
+	}
+	return nil
+}
+
+// routeGroupTrafficWeights returns the weights of the backends of a route by
+// backend name.
+func routeGroupTrafficWeights(backends []rgv1.RouteGroupBackendReference) map[string]float64 {
+	weights := make(map[string]float64, len(backends))
+	for _, backend := range backends {
+		weights[backend.BackendName] += float64(backend.Weight)
+	}
+	return weights
+}
@@ -0,0 +1,162 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	rgv1 "github.com/szuecs/routegroup-client/apis/zalando.org/v1"
+)
+
+func TestMeasureTrafficSplit(t *testing.T) {
+	// every 4th request goes to green, after the first one failed
+	var requests, connections atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		switch {
+		case n == 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case n%4 == 0:
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(w, "green")
+		default:
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, "blue")
+		}
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/blue-green", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt, quit := createHTTPRoundTripper()
+	defer func() {
+		quit <- struct{}{}
+	}()
+
+	split, err := measureTrafficSplit(context.Background(), rt, req, trafficSplitRequests, func(code int) bool {
+		return code > 200 && code < 203
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if green := trafficSplitRequests / 4; split.total != trafficSplitRequests || split.counts["green"] != green || split.counts["blue"] != trafficSplitRequests-green {
+		t.Fatalf("expected 3/4 blue and 1/4 green responses, got %s", split)
+	}
+	// the connections are only closed by the round tripper every 3 seconds
+	if n := connections.Load(); n > 10 {
+		t.Errorf("expected the connections to be reused, got %d for %d requests", n, requests.Load())
+	}
+
+	for _, tc := range []struct {
+		name    string
+		weights map[string]float64
+		err     string
+	}{
+		{name: "configured weights", weights: map[string]float64{"blue": 75, "green": 25}},
+		{name: "close weights", weights: map[string]float64{"blue": 0.72, "green": 0.28}},
+		{name: "other weights", weights: map[string]float64{"blue": 50, "green": 50}, err: `backend "blue" got 75.0% of the requests, expected 50.0% ± 5.0%`},
+		{name: "missing backend", weights: map[string]float64{"blue": 1}, err: `unexpected backend "green" got 303 requests`},
+		{name: "backend without traffic", weights: map[string]float64{"blue": 3, "green": 1, "red": 0}},
+		{name: "no traffic", weights: map[string]float64{"blue": 0}, err: "no backend with a weight"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := split.verify(tc.weights, trafficSplitConfidence)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Errorf("expected the split to match, got %v", err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Errorf("expected error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestTrafficSplitInterval(t *testing.T) {
+	// the accepted shares are within the bounds of the previous checks of
+	// 100 requests, 41-59% for 50/50 and 76-84% for 80/20
+	for _, tc := range []struct {
+		weights map[string]float64
+		blue    float64
+		matches bool
+	}{
+		{weights: map[string]float64{"blue": 50, "green": 50}, blue: 0.46, matches: true},
+		{weights: map[string]float64{"blue": 50, "green": 50}, blue: 0.56, matches: false},
+		{weights: map[string]float64{"blue": 80, "green": 20}, blue: 0.77, matches: true},
+		{weights: map[string]float64{"blue": 80, "green": 20}, blue: 0.845, matches: false},
+	} {
+		blue := int(tc.blue * float64(trafficSplitRequests))
+		split := &trafficSplit{total: trafficSplitRequests, counts: map[string]int{"blue": blue, "green": trafficSplitRequests - blue}}
+		if err := split.verify(tc.weights, trafficSplitConfidence); (err == nil) != tc.matches {
+			t.Errorf("%v with %.0f%% blue: expected match %t, got %v", tc.weights, tc.blue*100, tc.matches, err)
+		}
+	}
+}
+
+func TestTrafficSplitRequests(t *testing.T) {
+	if trafficSplitConfidence != 0.9995 {
+		t.Errorf("expected a confidence of 99.95%% per check, got %v", trafficSplitConfidence)
+	}
+	if trafficSplitRequests != 1212 {
+		t.Errorf("expected 1212 requests, got %d", trafficSplitRequests)
+	}
+
+	// the fewest requests with an 80/20 interval within the margin
+	margin := func(n int) float64 {
+		return confidenceZ(trafficSplitConfidence) * math.Sqrt(0.8*0.2/float64(n))
+	}
+	if m := margin(trafficSplitRequests); m > trafficSplitMargin {
+		t.Errorf("expected a margin of at most %v, got %v", trafficSplitMargin, m)
+	}
+	if m := margin(trafficSplitRequests - 1); m <= trafficSplitMargin {
+		t.Errorf("expected %d requests to be enough for a margin of %v", trafficSplitRequests-1, m)
+	}
+}
+
+func TestMeasureTrafficSplitCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	split, err := measureTrafficSplit(ctx, http.DefaultTransport, req, 10, isSuccess)
+	if err == nil || !strings.Contains(err.Error(), "request 1 of 10 failed") {
+		t.Errorf("expected the first request to fail, got %v", err)
+	}
+	if split.total != 0 {
+		t.Errorf("expected no responses to be counted, got %s", split)
+	}
+}
+
+func TestTrafficWeights(t *testing.T) {
+	weights := routeGroupTrafficWeights([]rgv1.RouteGroupBackendReference{
+		{BackendName: "blue", Weight: 80},
+		{BackendName: "green", Weight: 20},
+	})
+	if expected := map[string]float64{"blue": 80, "green": 20}; !maps.Equal(weights, expected) {
+		t.Errorf("expected %v, got %v", expected, weights)
+	}
+}
@@ -3,11 +3,10 @@ package e2e
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"net/url"
@@ -558,42 +557,27 @@ func createServiceTypeClusterIP(serviceName string, labels map[string]string, po
 	}
 }
 
+// waitForSuccessfulResponse waits until a GET of hostname over HTTP, following
+// redirects, returns 200.
 func waitForSuccessfulResponse(hostname string, timeout time.Duration) error {
-	client := http.Client{
-		Transport: &http.Transport{},
-		Timeout:   10 * time.Second,
-	}
-
-	url, err := url.Parse(hostname)
+	req, err := newProbeRequest(hostname, "http")
 	if err != nil {
 		return err
 	}
 
-	url.Scheme = "http"
-
-	host := url.String()
+	_, err = newHTTPProbe(isSuccess).withRedirects().waitTimeout(req, timeout)
+	return err
+}
 
-	req, err := http.NewRequest("GET", host, nil)
+// newProbeRequest returns a GET request of hostname with the scheme.
+func newProbeRequest(hostname, scheme string) (*http.Request, error) {
+	url, err := url.Parse(hostname)
 	if err != nil {
-		return err
-	}
-
-	timeoutEnd := time.Now().UTC().Add(timeout)
-
-	for time.Now().UTC().Before(timeoutEnd) {
-		resp, err := client.Do(req)
-		if err != nil {
-			time.Sleep(10 * time.Second)
-			continue
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode == http.StatusOK {
-			return nil
-		}
+		return nil, err
 	}
+	url.Scheme = scheme
 
-	return fmt.Errorf("%s was not reachable after %s", host, timeout)
+	return http.NewRequest("GET", url.String(), nil)
 }
 
 func isRedirect(code int) bool {
@@ -608,91 +592,36 @@ func isNotFound(code int) bool {
 	return code == http.StatusNotFound
 }
 
+// waitForResponse waits until a GET of hostname with the scheme returns a
+// status code matching expectedCode. Redirects are not followed.
 func waitForResponse(hostname, scheme string, timeout time.Duration, expectedCode func(int) bool, insecure bool) error {
-	localTimeout := 10 * time.Second
-	if timeout < localTimeout {
-		localTimeout = timeout
-	}
-	url, err := url.Parse(hostname)
-	if err != nil {
-		return err
-	}
-
-	url.Scheme = scheme
-
-	host := url.String()
-
-	req, err := http.NewRequest("GET", host, nil)
+	req, err := newProbeRequest(hostname, scheme)
 	if err != nil {
 		return err
 	}
 
-	timeoutEnd := time.Now().UTC().Add(timeout)
-
-	for time.Now().UTC().Before(timeoutEnd) {
-		t := &http.Transport{}
-		if insecure {
-			t = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
-		}
-		client := http.Client{
-			Transport: t,
-			Timeout:   localTimeout,
-			CheckRedirect: func(r *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
-		}
-
-		resp, err := client.Do(req)
-		if err != nil {
-			time.Sleep(localTimeout)
-			continue
-		}
-		defer resp.Body.Close()
-
-		if expectedCode(resp.StatusCode) {
-			return nil
-		}
-	}
-
-	return fmt.Errorf("%s was not reachable after %s", host, timeout)
+	_, err = waitForResponseReturnResponse(req, timeout, expectedCode, insecure)
+	return err
 }
 
+// waitForResponseReturnResponse waits until the request returns a status code
+// matching expectedCode and returns the response. Redirects are not followed.
+// If it times out, the error has the DNS, TLS and HTTP results of every
+// address of the endpoint. Checking the endpoint takes up to
+// endpointDiagnosisTimeout after the timeout, unless the context of the
+// request is done before.
 func waitForResponseReturnResponse(req *http.Request, timeout time.Duration, expectedCode func(int) bool, insecure bool) (*http.Response, error) {
-	localTimeout := 10 * time.Second
-	if timeout < localTimeout {
-		localTimeout = timeout
+	probe := newHTTPProbe(expectedCode).withRequestTimeout(min(probeRequestTimeout, timeout))
+	if insecure {
+		probe.withInsecureTLS()
 	}
-	timeoutEnd := time.Now().UTC().Add(timeout)
 
-	for time.Now().UTC().Before(timeoutEnd) {
-		t := &http.Transport{}
-		if insecure {
-			t = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
-		}
-		client := http.Client{
-			Transport: t,
-			Timeout:   localTimeout,
-			CheckRedirect: func(r *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
-		}
-
-		resp, err := client.Do(req)
-		if err != nil {
-			framework.Logf("%s localtimeout", req.URL.String())
-			time.Sleep(localTimeout)
-			continue
-		}
-		//framework.Logf("%s , header Foo: '%s', status code: %d", req.URL.String(), req.Header.Get("Foo"), resp.StatusCode)
-		if expectedCode(resp.StatusCode) {
-			return resp, nil
-		}
-		resp.Body.Close()
-		time.Sleep(time.Second)
-		client.CloseIdleConnections()
+	rsp, err := probe.waitTimeout(req, timeout)
+	var probeErr *probeError
+	if errors.As(err, &probeErr) {
+		return nil, fmt.Errorf("%w\nendpoint check after the timeout: %s", err, diagnoseEndpoint(req, expectedCode, insecure))
 	}
-
-	return nil, fmt.Errorf("%s was not reachable after %s", req.URL.String(), timeout)
+	return rsp, err
 }
 
 func waitForReplicas(deploymentName, namespace string, kubeClient clientset.Interface, timeout time.Duration, desiredReplicas int) {
@@ -952,35 +881,14 @@ func createHTTPRoundTripper() (http.RoundTripper, chan<- struct{}) {
 	return tr, ch
 }
 
-func getAndWaitResponse(rt http.RoundTripper, req *http.Request, timeout time.Duration, expectedStatusCode int) (resp *http.Response, err error) {
-	d := 1 * time.Second
-	if timeout < d {
-		d = timeout - 1
-	}
-	timeoutCH := make(chan struct{})
-	go func() {
-		time.Sleep(timeout)
-		timeoutCH <- struct{}{}
-	}()
-
-	for {
-		resp, err = rt.RoundTrip(req)
-		if err == nil && resp.StatusCode == expectedStatusCode {
-			return
-		}
-		if err != nil {
-			log.Printf("Failed to do rountrip: %v", err)
-		}
-
-		select {
-		case <-timeoutCH:
-			log.Printf("timeout to GET %s", req.URL)
-			return
-		case <-time.After(d):
-			log.Printf("retry to GET %s", req.URL)
-			continue
-		}
-	}
+// getAndWaitResponse waits until the request sent with the round tripper
+// returns the expected status code and returns the response.
+func getAndWaitResponse(rt http.RoundTripper, req *http.Request, timeout time.Duration, expectedStatusCode int) (*http.Response, error) {
+	return newHTTPProbe(func(code int) bool { return code == expectedStatusCode }).
+		withTransport(rt).
+		withRequestTimeout(min(probeRequestTimeout, timeout)).
+		withBackoff(wait.Backoff{Duration: min(time.Second, timeout)}).
+		waitTimeout(req, timeout)
 }
 
 func getBody(resp *http.Response) (string, error) {
@@ -1077,3 +985,30 @@ func E2ES3AWSIAMBucket() string {
 func E2EAWSIAMRole() string {
 	return getenv("AWS_IAM_ROLE", "")
 }
+
+// E2EAuthorizationMatrix returns the path of a YAML or JSON file with the
+// authorization test matrix. If empty, testdata/authorization-matrix.yaml is
+// used.
+func E2EAuthorizationMatrix() string {
+	return getenv("AUTHORIZATION_MATRIX", "")
+}
+
+// E2ERBACCoverageReport returns the path the RBAC rule coverage report of
+// the authorization tests is written to, as JSON if it has a .json extension
+// and as Markdown otherwise. If empty, no report is written.
+func E2ERBACCoverageReport() string {
+	return getenv("RBAC_COVERAGE_REPORT", "")
+}
+
+// E2EAuthorizationSnapshot returns the path of the snapshot of authorization
+// decisions the current decisions are compared with. If the file doesn't
+// exist yet, it's created. If empty, no snapshot is taken.
+func E2EAuthorizationSnapshot() string {
+	return getenv("AUTHORIZATION_SNAPSHOT", "")
+}
+
+// E2EAuthorizationSnapshotApprovals returns the path of a YAML or JSON file
+// listing the approved changes of authorization decisions.
+func E2EAuthorizationSnapshotApprovals() string {
+	return getenv("AUTHORIZATION_SNAPSHOT_APPROVALS", "")
+}
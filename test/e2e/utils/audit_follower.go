@@ -0,0 +1,258 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/audit"
+	"k8s.io/client-go/rest"
+)
+
+// ErrAuditLogTruncated is returned by an AuditLogOpener if the log is shorter
+// than the requested offset, e.g. because it was rotated.
+var ErrAuditLogTruncated = errors.New("audit log truncated")
+
+// AuditLogOpener opens an audit log at a byte offset.
+type AuditLogOpener func(ctx context.Context, offset int64) (io.ReadCloser, error)
+
+// ReaderAuditLog returns an opener of the log returned by open, which skips
+// the bytes before the offset.
+func ReaderAuditLog(open func() (io.ReadCloser, error)) AuditLogOpener {
+	return func(_ context.Context, offset int64) (io.ReadCloser, error) {
+		log, err := open()
+		if err != nil {
+			return nil, err
+		}
+
+		if skipped, err := io.CopyN(io.Discard, log, offset); err != nil {
+			log.Close()
+			if errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("%w: %d bytes, expected at least %d", ErrAuditLogTruncated, skipped, offset)
+			}
+			return nil, err
+		}
+		return log, nil
+	}
+}
+
+// APIServerAuditLog returns an opener of the audit log served by the API
+// server at path, e.g. /logs/kube-audit.log. Only the bytes from the offset
+// on are requested.
+func APIServerAuditLog(client *rest.RESTClient, path string) AuditLogOpener {
+	return func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.Get().AbsPath(path).URL().String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+		rsp, err := client.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		switch rsp.StatusCode {
+		case http.StatusPartialContent:
+			return rsp.Body, nil
+		case http.StatusOK:
+			// the range was ignored
+			return ReaderAuditLog(func() (io.ReadCloser, error) { return rsp.Body, nil })(ctx, offset)
+		case http.StatusRequestedRangeNotSatisfiable:
+			rsp.Body.Close()
+			return nil, fmt.Errorf("%w: range %d- not satisfiable", ErrAuditLogTruncated, offset)
+		default:
+			rsp.Body.Close()
+			return nil, fmt.Errorf("failed to get audit log %s: %s", path, rsp.Status)
+		}
+	}
+}
+
+// FileAuditLog returns an opener of the audit log file at path.
+func FileAuditLog(path string) AuditLogOpener {
+	return func(_ context.Context, offset int64) (io.ReadCloser, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := file.Stat()
+		if err == nil && info.Size() < offset {
+			err = fmt.Errorf("%w: %d bytes, expected at least %d", ErrAuditLogTruncated, info.Size(), offset)
+		}
+		if err == nil {
+			_, err = file.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return file, nil
+	}
+}
+
+// maxAuditLogCursors is the number of logs an AuditLogFollower follows, e.g.
+// of the API servers behind a load balancer.
+const maxAuditLogCursors = 8
+
+// auditEventKey identifies an event of a request.
+type auditEventKey struct {
+	id    types.UID
+	stage auditinternal.Stage
+}
+
+// auditLogCursor is the position in a log after the last complete line read.
+type auditLogCursor struct {
+	// offset is the offset after the line, lastLine is the line before the
+	// offset, including the newline.
+	offset   int64
+	lastLine []byte
+	// line is the number of lines before the offset.
+	line int
+}
+
+// AuditLogFollower reads an audit log incrementally. It remembers the offset
+// of the last complete line and only decodes the lines appended since.
+//
+// The opener can return different logs, e.g. of the API servers behind a load
+// balancer, so the follower keeps a cursor per log. A log which doesn't
+// continue any of the cursors, because it's new or was rotated, is read from
+// the start again. Events which were already observed, identified by their
+// audit ID and stage, are skipped, so that every event is observed once.
+// Events appended to a rotated log after the last read are lost. Lines which
+// can't be decoded are skipped and counted whenever they are read, like with
+// ScanAuditLinesSkipping.
+type AuditLogFollower struct {
+	open    AuditLogOpener
+	version schema.GroupVersion
+
+	// cursors are the positions in the logs read, the most recently read
+	// log first.
+	cursors []*auditLogCursor
+	seen    map[auditEventKey]struct{}
+
+	// NumEventsChecked is the number of events observed, Rotations the
+	// number of times a log was read from the start after the first read,
+	// because it's another log or it was rotated.
+	NumEventsChecked int
+	Rotations        int
+	// InvalidLines is the number of lines skipped because they couldn't be
+	// decoded, LastInvalidLine the error of the last one.
+	InvalidLines    int
+	LastInvalidLine *AuditLineError
+}
+
+// NewAuditLogFollower returns a follower of the log, starting at its start.
+func NewAuditLogFollower(open AuditLogOpener, version schema.GroupVersion) *AuditLogFollower {
+	return &AuditLogFollower{open: open, version: version, seen: map[auditEventKey]struct{}{}}
+}
+
+// Next decodes the lines appended since the last call and calls observe with
+// every event not observed before. An incomplete last line is left for the
+// next call.
+func (f *AuditLogFollower) Next(ctx context.Context, observe func(*auditinternal.Event, AuditEvent)) error {
+	log, cursor, err := f.openAppended(ctx)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	// a log read from the start can be one of the other logs, if the
+	// opener returned another log while looking for it
+	fromStart := cursor.offset == 0
+
+	reader := bufio.NewReader(log)
+	decoder := audit.Codecs.UniversalDecoder(f.version)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		cursor.offset += int64(len(line))
+		cursor.lastLine = line
+		cursor.line++
+		if fromStart {
+			f.mergeCursors(cursor)
+		}
+
+		e := &auditinternal.Event{}
+		err = runtime.DecodeInto(decoder, bytes.TrimSpace(line), e)
+
+		var event AuditEvent
+		if err == nil {
+			event, err = testEventFromInternal(e)
+		}
+		if err != nil {
+			f.InvalidLines++
+			f.LastInvalidLine = &AuditLineError{Line: cursor.line, Version: f.version, Err: err, content: truncateAuditLine(line)}
+			continue
+		}
+
+		key := auditEventKey{id: e.AuditID, stage: e.Stage}
+		if _, ok := f.seen[key]; ok {
+			continue
+		}
+		f.seen[key] = struct{}{}
+
+		f.NumEventsChecked++
+		observe(e, event)
+	}
+}
+
+// openAppended opens the log after the last line read of one of the cursors.
+// It reads the last line again to verify that the log continues the cursor.
+// If no cursor is continued, the log is opened at its start with a new
+// cursor.
+func (f *AuditLogFollower) openAppended(ctx context.Context) (io.ReadCloser, *auditLogCursor, error) {
+	for i, cursor := range f.cursors {
+		log, err := f.open(ctx, cursor.offset-int64(len(cursor.lastLine)))
+		if err == nil {
+			last := make([]byte, len(cursor.lastLine))
+			if _, err = io.ReadFull(log, last); err == nil && bytes.Equal(last, cursor.lastLine) {
+				f.cursors = append(append([]*auditLogCursor{cursor}, f.cursors[:i]...), f.cursors[i+1:]...)
+				return log, cursor, nil
+			}
+			log.Close()
+		}
+		if err != nil && !errors.Is(err, ErrAuditLogTruncated) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return nil, nil, err
+		}
+	}
+
+	log, err := f.open(ctx, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(f.cursors) > 0 {
+		f.Rotations++
+	}
+
+	cursor := &auditLogCursor{}
+	f.cursors = append([]*auditLogCursor{cursor}, f.cursors...)
+	if len(f.cursors) > maxAuditLogCursors {
+		f.cursors = f.cursors[:maxAuditLogCursors]
+	}
+	return log, cursor, nil
+}
+
+// mergeCursors removes the other cursors at the position of the cursor, which
+// is read from the start, as they follow the same log.
+func (f *AuditLogFollower) mergeCursors(cursor *auditLogCursor) {
+	f.cursors = slices.DeleteFunc(f.cursors, func(other *auditLogCursor) bool {
+		return other != cursor && other.offset == cursor.offset && bytes.Equal(other.lastLine, cursor.lastLine)
+	})
+}
@@ -0,0 +1,327 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+// fakeAuditLog is an audit log which can be appended to and rotated.
+type fakeAuditLog struct {
+	mu    sync.Mutex
+	data  []byte
+	opens int
+	// onOpen is called before the log is opened.
+	onOpen func(log *fakeAuditLog)
+}
+
+func (l *fakeAuditLog) append(lines ...string) {
+	for _, line := range lines {
+		l.data = append(l.data, line+"\n"...)
+	}
+}
+
+func (l *fakeAuditLog) opener() AuditLogOpener {
+	return ReaderAuditLog(func() (io.ReadCloser, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.opens++
+		if l.onOpen != nil {
+			l.onOpen(l)
+		}
+		return io.NopCloser(bytes.NewReader(bytes.Clone(l.data))), nil
+	})
+}
+
+func followedVerbs(t *testing.T, follower *AuditLogFollower) []string {
+	var verbs []string
+	err := follower.Next(context.Background(), func(_ *auditinternal.Event, event AuditEvent) {
+		verbs = append(verbs, event.Verb)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verbs
+}
+
+func TestAuditLogFollower(t *testing.T) {
+	const pod = "/api/v1/namespaces/teapot/pods/web"
+	log := &fakeAuditLog{}
+	log.append(testAuditLine("1", "create", pod, "alice"))
+
+	follower := NewAuditLogFollower(log.opener(), auditv1.SchemeGroupVersion)
+	if verbs := followedVerbs(t, follower); strings.Join(verbs, ",") != "create" {
+		t.Fatalf("expected create, got %v", verbs)
+	}
+
+	// incomplete lines are read once they're complete
+	update := testAuditLine("3", "update", pod, "alice")
+	log.append(testAuditLine("2", "get", pod, "alice"))
+	log.data = append(log.data, update[:20]...)
+	if verbs := followedVerbs(t, follower); strings.Join(verbs, ",") != "get" {
+		t.Fatalf("expected only the appended get, got %v", verbs)
+	}
+	log.data = append(log.data, update[20:]+"\n"...)
+	if verbs := followedVerbs(t, follower); strings.Join(verbs, ",") != "update" {
+		t.Fatalf("expected the completed update, got %v", verbs)
+	}
+	if verbs := followedVerbs(t, follower); len(verbs) != 0 {
+		t.Fatalf("expected no events, got %v", verbs)
+	}
+
+	// rotated to a shorter log
+	log.data = nil
+	log.append(testAuditLine("4", "patch", pod, "alice"))
+	if verbs := followedVerbs(t, follower); strings.Join(verbs, ",") != "patch" {
+		t.Fatalf("expected the patch of the rotated log, got %v", verbs)
+	}
+
+	// rotated to a log longer than the offset
+	log.data = nil
+	log.append(
+		testAuditLine("5", "list", pod, "bob"),
+		testAuditLine("6", "watch", pod, "bob"),
+		testAuditLine("7", "delete", pod, "bob"),
+	)
+	if verbs := followedVerbs(t, follower); strings.Join(verbs, ",") != "list,watch,delete" {
+		t.Fatalf("expected all events of the rotated log, got %v", verbs)
+	}
+
+	if follower.NumEventsChecked != 7 || follower.Rotations != 2 {
+		t.Errorf("expected 7 events and 2 rotations, got %d and %d", follower.NumEventsChecked, follower.Rotations)
+	}
+}
+
+func TestAuditLogFollowerInvalidLines(t *testing.T) {
+	const pod = "/api/v1/namespaces/teapot/pods/web"
+	log := &fakeAuditLog{}
+	log.append(testAuditLine("1", "create", pod, "alice"), `{"kind":"Event","auditID":`)
+
+	follower := NewAuditLogFollower(log.opener(), auditv1.SchemeGroupVersion)
+	if verbs := followedVerbs(t, follower); strings.Join(verbs, ",") != "create" {
+		t.Fatalf("expected the create before the invalid line, got %v", verbs)
+	}
+	if follower.InvalidLines != 1 || follower.LastInvalidLine == nil || follower.LastInvalidLine.Line != 2 {
+		t.Fatalf("expected line 2 to be invalid, got %d invalid lines: %v", follower.InvalidLines, follower.LastInvalidLine)
+	}
+
+	// the invalid line isn't read again
+	log.append(testAuditLine("2", "delete", pod, "alice"))
+	if verbs := followedVerbs(t, follower); strings.Join(verbs, ",") != "delete" {
+		t.Fatalf("expected the delete after the invalid line, got %v", verbs)
+	}
+	if follower.InvalidLines != 1 {
+		t.Errorf("expected 1 invalid line, got %d", follower.InvalidLines)
+	}
+}
+
+func TestAuditLogFollowerAlternatingLogs(t *testing.T) {
+	const pod = "/api/v1/namespaces/teapot/pods/web"
+	logs := map[byte]*fakeAuditLog{'a': {}, 'b': {}}
+	logs['a'].append(testAuditLine("a1", "create", pod, "alice"), testAuditLine("a2", "get", pod, "alice"))
+	logs['b'].append(testAuditLine("b1", "list", pod, "bob"), testAuditLine("b2", "get", pod, "bob"))
+
+	// the log of the API server every open is sent to
+	const servers = "abbaaabbaba"
+	opens := 0
+	follower := NewAuditLogFollower(func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		if opens == len(servers) {
+			t.Fatalf("unexpected open %d", opens+1)
+		}
+		log := logs[servers[opens]]
+		opens++
+		return log.opener()(ctx, offset)
+	}, auditv1.SchemeGroupVersion)
+
+	for i, step := range []struct {
+		appendA, appendB string
+		expected         string
+	}{
+		{expected: "create,get"},
+		// the probe of the cursor of a hits b, b is read from the start
+		{appendA: "update", appendB: "patch", expected: "list,get,patch"},
+		// the probe of the cursor of b hits a, which continues its cursor
+		{expected: "update"},
+		{appendA: "delete", appendB: "watch", expected: "delete"},
+		{expected: "watch"},
+		// no cursor is continued, a is read from the start again
+		{expected: ""},
+	} {
+		if step.appendA != "" {
+			logs['a'].append(testAuditLine(fmt.Sprintf("a%d", i+2), step.appendA, pod, "alice"))
+		}
+		if step.appendB != "" {
+			logs['b'].append(testAuditLine(fmt.Sprintf("b%d", i+2), step.appendB, pod, "bob"))
+		}
+		if verbs := followedVerbs(t, follower); strings.Join(verbs, ",") != step.expected {
+			t.Fatalf("step %d: expected %q, got %v", i, step.expected, verbs)
+		}
+	}
+
+	if opens != len(servers) {
+		t.Errorf("expected %d opens, got %d", len(servers), opens)
+	}
+	// every event is observed once
+	if follower.NumEventsChecked != 8 || follower.Rotations != 2 {
+		t.Errorf("expected 8 events and 2 rotations, got %d and %d", follower.NumEventsChecked, follower.Rotations)
+	}
+	// the cursor of a read from the start replaced the previous one
+	if len(follower.cursors) != 2 {
+		t.Errorf("expected a cursor per log, got %d", len(follower.cursors))
+	}
+}
+
+func TestWaitForAuditEvents(t *testing.T) {
+	const pod = "/api/v1/namespaces/teapot/pods/web"
+	verbs := []string{"create", "get", "update", "delete", "get"}
+
+	// every poll appends the next event
+	log := &fakeAuditLog{onOpen: func(log *fakeAuditLog) {
+		if log.opens <= len(verbs) {
+			log.append(testAuditLine(strconv.Itoa(log.opens), verbs[log.opens-1], pod, "alice"))
+		}
+	}}
+	follower := NewAuditLogFollower(log.opener(), auditv1.SchemeGroupVersion)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	report, err := WaitForAuditEvents(ctx, follower, time.Millisecond, []AuditExpectation{
+		&AuditEventMatcher{Verb: "update"},
+		&AuditEventMatcher{Verb: "create"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.MissingEvents) > 0 {
+		t.Fatalf("unexpected missing events: %s", report)
+	}
+	// stops as soon as the update is found
+	if follower.NumEventsChecked != 3 {
+		t.Errorf("expected to stop after 3 events, checked %d", follower.NumEventsChecked)
+	}
+
+	report2, err := WaitForAuditAssertions(ctx, follower, time.Millisecond, 0,
+		InOrder(&AuditEventMatcher{Verb: "delete"}, &AuditEventMatcher{Verb: "get"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report2.Failures) > 0 || follower.NumEventsChecked != 5 {
+		t.Errorf("expected the assertions to hold after 5 events, got %d: %s", follower.NumEventsChecked, report2)
+	}
+
+	// times out if the events never appear
+	timeout, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report, err = WaitForAuditEvents(timeout, follower, time.Millisecond, []AuditExpectation{&AuditEventMatcher{Verb: "patch"}})
+	if err == nil || len(report.MissingEvents) != 1 {
+		t.Errorf("expected a timeout with a missing event, got %v: %s", err, report)
+	}
+}
+
+func TestWaitForAuditAssertionsSettle(t *testing.T) {
+	const pods = "/api/v1/namespaces/teapot/pods"
+	create := &AuditEventMatcher{Verb: "create"}
+
+	for _, tc := range []struct {
+		name  string
+		lines []string
+		err   string
+	}{{
+		name:  "single event",
+		lines: []string{testAuditLine("1", "create", pods, "alice"), testAuditLine("2", "get", pods, "alice")},
+	}, {
+		name:  "late duplicate",
+		lines: []string{testAuditLine("1", "create", pods, "alice"), testAuditLine("2", "get", pods, "alice"), testAuditLine("3", "create", pods, "alice")},
+		err:   "assertions stopped holding",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			// every poll appends the next line
+			log := &fakeAuditLog{onOpen: func(log *fakeAuditLog) {
+				if log.opens <= len(tc.lines) {
+					log.append(tc.lines[log.opens-1])
+				}
+			}}
+			follower := NewAuditLogFollower(log.opener(), auditv1.SchemeGroupVersion)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// holds after the first event, but the source is read until the
+			// last one is appended
+			report, err := WaitForAuditAssertions(ctx, follower, time.Millisecond, 100*time.Millisecond, Exactly(1, create))
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("expected the assertions to hold, got %v: %s", err, report)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Fatalf("expected error containing %q, got %v", tc.err, err)
+			}
+			if follower.NumEventsChecked != len(tc.lines) {
+				t.Errorf("expected %d events to be checked, got %d", len(tc.lines), follower.NumEventsChecked)
+			}
+			if tc.err != "" && !strings.Contains(report.String(), "expected exactly 1 events matching") {
+				t.Errorf("expected the duplicate to be reported, got %s", report)
+			}
+		})
+	}
+}
+
+func TestAPIServerAuditLog(t *testing.T) {
+	content := testAuditLine("1", "create", "/api/v1/namespaces/teapot/pods", "alice") + "\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/logs/kube-audit.log" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "kube-audit.log", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	client, err := rest.UnversionedRESTClientFor(&rest.Config{
+		Host:    server.URL,
+		APIPath: "/",
+		ContentConfig: rest.ContentConfig{
+			NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := APIServerAuditLog(client, "/logs/kube-audit.log")
+
+	log, err := open(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(log)
+	log.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content[10:] {
+		t.Errorf("expected the log from offset 10, got %q", data)
+	}
+
+	if _, err := open(context.Background(), int64(len(content)+1)); !errors.Is(err, ErrAuditLogTruncated) {
+		t.Errorf("expected truncation error, got %v", err)
+	}
+
+	if _, err := APIServerAuditLog(client, "/logs/missing.log")(context.Background(), 0); err == nil {
+		t.Error("expected error for missing log")
+	}
+}
@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+)
+
+// AuditExpectation is an expected audit event. Mismatches returns the
+// differences of an actual event to the expectation, none if it matches.
+type AuditExpectation interface {
+	Mismatches(actual AuditEvent) []string
+	String() string
+}
+
+// AuditEventMatcher matches audit events on the fields it sets only. Fields
+// left empty match any value. Regular expressions are unanchored, use Exact
+// to match a whole string.
+type AuditEventMatcher struct {
+	Level      auditinternal.Level
+	Stage      auditinternal.Stage
+	RequestURI *regexp.Regexp
+	Verb       string
+	Code       int32
+	// User matches the username, Groups must all be groups of the user.
+	User               *regexp.Regexp
+	Groups             []string
+	ImpersonatedUser   *regexp.Regexp
+	ImpersonatedGroups []string
+	Resource           string
+	Namespace          string
+	RequestObject      *bool
+	ResponseObject     *bool
+	AuthorizeDecision  string
+
+	// The annotations must exist and their values match the expressions. A
+	// nil expression only checks that the annotation exists.
+	AdmissionWebhookMutationAnnotations map[string]*regexp.Regexp
+	AdmissionWebhookPatchAnnotations    map[string]*regexp.Regexp
+}
+
+// Exact returns a regular expression matching exactly s.
+func Exact(s string) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(s) + "$")
+}
+
+// Bool returns a pointer to b, e.g. for AuditEventMatcher.RequestObject.
+func Bool(b bool) *bool {
+	return &b
+}
+
+// Match returns true if the event matches all fields set in the matcher.
+func (m *AuditEventMatcher) Match(event AuditEvent) bool {
+	return len(m.Mismatches(event)) == 0
+}
+
+// Mismatches returns the fields of the event which don't match.
+func (m *AuditEventMatcher) Mismatches(event AuditEvent) []string {
+	var mismatches mismatchList
+	if m.Level != "" {
+		mismatches.compare("level", m.Level, event.Level)
+	}
+	if m.Stage != "" {
+		mismatches.compare("stage", m.Stage, event.Stage)
+	}
+	mismatches.match("requestURI", m.RequestURI, event.RequestURI)
+	if m.Verb != "" {
+		mismatches.compare("verb", m.Verb, event.Verb)
+	}
+	if m.Code != 0 {
+		mismatches.compare("code", m.Code, event.Code)
+	}
+	mismatches.match("user", m.User, event.User.Username)
+	mismatches.contains("groups", m.Groups, event.User.Groups)
+	mismatches.match("impersonatedUser", m.ImpersonatedUser, event.ImpersonatedUser)
+	mismatches.contains("impersonatedGroups", m.ImpersonatedGroups, strings.Split(event.ImpersonatedGroups, ","))
+	if m.Resource != "" {
+		mismatches.compare("resource", m.Resource, event.Resource)
+	}
+	if m.Namespace != "" {
+		mismatches.compare("namespace", m.Namespace, event.Namespace)
+	}
+	if m.RequestObject != nil {
+		mismatches.compare("requestObject", *m.RequestObject, event.RequestObject)
+	}
+	if m.ResponseObject != nil {
+		mismatches.compare("responseObject", *m.ResponseObject, event.ResponseObject)
+	}
+	if m.AuthorizeDecision != "" {
+		mismatches.compare("authorizeDecision", m.AuthorizeDecision, event.AuthorizeDecision)
+	}
+	mismatches.annotations("mutation annotation", m.AdmissionWebhookMutationAnnotations, event.AdmissionWebhookMutationAnnotations)
+	mismatches.annotations("patch annotation", m.AdmissionWebhookPatchAnnotations, event.AdmissionWebhookPatchAnnotations)
+	return mismatches
+}
+
+// String returns the fields set in the matcher.
+func (m *AuditEventMatcher) String() string {
+	var fields []string
+	add := func(name string, value any, set bool) {
+		if set {
+			fields = append(fields, fmt.Sprintf("%s=%v", name, value))
+		}
+	}
+
+	add("level", m.Level, m.Level != "")
+	add("stage", m.Stage, m.Stage != "")
+	add("requestURI", m.RequestURI, m.RequestURI != nil)
+	add("verb", m.Verb, m.Verb != "")
+	add("code", m.Code, m.Code != 0)
+	add("user", m.User, m.User != nil)
+	add("groups", m.Groups, len(m.Groups) > 0)
+	add("impersonatedUser", m.ImpersonatedUser, m.ImpersonatedUser != nil)
+	add("impersonatedGroups", m.ImpersonatedGroups, len(m.ImpersonatedGroups) > 0)
+	add("resource", m.Resource, m.Resource != "")
+	add("namespace", m.Namespace, m.Namespace != "")
+	if m.RequestObject != nil {
+		add("requestObject", *m.RequestObject, true)
+	}
+	if m.ResponseObject != nil {
+		add("responseObject", *m.ResponseObject, true)
+	}
+	add("authorizeDecision", m.AuthorizeDecision, m.AuthorizeDecision != "")
+	add("mutationAnnotations", m.AdmissionWebhookMutationAnnotations, len(m.AdmissionWebhookMutationAnnotations) > 0)
+	add("patchAnnotations", m.AdmissionWebhookPatchAnnotations, len(m.AdmissionWebhookPatchAnnotations) > 0)
+	return "{" + strings.Join(fields, " ") + "}"
+}
+
+// Mismatches returns the fields of the actual event which differ from the
+// expected one. All fields are compared except for the ID and the
+// annotations, which are only compared if set in the expectation.
+func (e AuditEvent) Mismatches(actual AuditEvent) []string {
+	var mismatches mismatchList
+	if e.ID != "" {
+		mismatches.compare("id", e.ID, actual.ID)
+	}
+	mismatches.compare("level", e.Level, actual.Level)
+	mismatches.compare("stage", e.Stage, actual.Stage)
+	mismatches.compare("requestURI", e.RequestURI, actual.RequestURI)
+	mismatches.compare("verb", e.Verb, actual.Verb)
+	mismatches.compare("code", e.Code, actual.Code)
+	if !reflect.DeepEqual(e.User, actual.User) {
+		mismatches = append(mismatches, fmt.Sprintf("user: expected %+v, got %+v", e.User, actual.User))
+	}
+	mismatches.compare("impersonatedUser", e.ImpersonatedUser, actual.ImpersonatedUser)
+	mismatches.compare("impersonatedGroups", e.ImpersonatedGroups, actual.ImpersonatedGroups)
+	mismatches.compare("resource", e.Resource, actual.Resource)
+	mismatches.compare("namespace", e.Namespace, actual.Namespace)
+	mismatches.compare("requestObject", e.RequestObject, actual.RequestObject)
+	mismatches.compare("responseObject", e.ResponseObject, actual.ResponseObject)
+	mismatches.compare("authorizeDecision", e.AuthorizeDecision, actual.AuthorizeDecision)
+	if e.AdmissionWebhookMutationAnnotations != nil && !reflect.DeepEqual(e.AdmissionWebhookMutationAnnotations, actual.AdmissionWebhookMutationAnnotations) {
+		mismatches = append(mismatches, fmt.Sprintf("mutation annotations: expected %v, got %v", e.AdmissionWebhookMutationAnnotations, actual.AdmissionWebhookMutationAnnotations))
+	}
+	if e.AdmissionWebhookPatchAnnotations != nil && !reflect.DeepEqual(e.AdmissionWebhookPatchAnnotations, actual.AdmissionWebhookPatchAnnotations) {
+		mismatches = append(mismatches, fmt.Sprintf("patch annotations: expected %v, got %v", e.AdmissionWebhookPatchAnnotations, actual.AdmissionWebhookPatchAnnotations))
+	}
+	return mismatches
+}
+
+// String returns a short description of the event.
+func (e AuditEvent) String() string {
+	s := fmt.Sprintf("%s %s %d by %s (%s/%s)", e.Verb, e.RequestURI, e.Code, e.User.Username, e.Level, e.Stage)
+	if e.ImpersonatedUser != "" {
+		s += fmt.Sprintf(" as %s [%s]", e.ImpersonatedUser, e.ImpersonatedGroups)
+	}
+	return s
+}
+
+// mismatchList collects the differences of an event to an expectation.
+type mismatchList []string
+
+func (l *mismatchList) compare(field string, expected, actual any) {
+	if expected != actual {
+		*l = append(*l, fmt.Sprintf("%s: expected %s, got %s", field, formatValue(expected), formatValue(actual)))
+	}
+}
+
+// formatValue quotes strings, so that empty values are visible.
+func formatValue(value any) string {
+	if reflect.ValueOf(value).Kind() == reflect.String {
+		return fmt.Sprintf("%q", value)
+	}
+	return fmt.Sprint(value)
+}
+
+func (l *mismatchList) match(field string, expected *regexp.Regexp, actual string) {
+	if expected != nil && !expected.MatchString(actual) {
+		*l = append(*l, fmt.Sprintf("%s: expected to match %q, got %q", field, expected, actual))
+	}
+}
+
+func (l *mismatchList) contains(field string, expected, actual []string) {
+	for _, value := range expected {
+		if !slices.Contains(actual, value) {
+			*l = append(*l, fmt.Sprintf("%s: expected to contain %q, got %v", field, value, actual))
+		}
+	}
+}
+
+func (l *mismatchList) annotations(field string, expected map[string]*regexp.Regexp, actual map[string]string) {
+	for _, key := range slices.Sorted(maps.Keys(expected)) {
+		value := expected[key]
+		annotation, ok := actual[key]
+		if !ok {
+			*l = append(*l, fmt.Sprintf("%s %s: missing", field, key))
+			continue
+		}
+		l.match(field+" "+key, value, annotation)
+	}
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const testAuditLog = `{"kind":"Event","apiVersion":"audit.k8s.io/v1","level":"Request","auditID":"1","stage":"ResponseComplete","requestURI":"/api/v1/namespaces/e2e-audit-1/pods","verb":"create","user":{"username":"alice","groups":["system:masters","system:authenticated"]},"objectRef":{"resource":"pods","namespace":"e2e-audit-1"},"responseStatus":{"code":201},"requestObject":{},"requestReceivedTimestamp":"2024-01-01T10:00:00.000000Z","annotations":{"authorization.k8s.io/decision":"allow","mutation.webhook.admission.k8s.io/round_0_index_0":"{\"configuration\":\"pod-defaults\",\"webhook\":\"pod-defaults.zalando.org\",\"mutated\":true}","patch.webhook.admission.k8s.io/round_0_index_0":"{\"configuration\":\"pod-defaults\",\"webhook\":\"pod-defaults.zalando.org\",\"patchType\":\"JSONPatch\"}"}}
+{"kind":"Event","apiVersion":"audit.k8s.io/v1","level":"Request","auditID":"2","stage":"ResponseComplete","requestURI":"/api/v1/namespaces/e2e-audit-1/pods/web","verb":"delete","user":{"username":"bob","groups":["system:authenticated"]},"impersonatedUser":{"username":"carol","groups":["Emergency","system:authenticated"]},"objectRef":{"resource":"pods","namespace":"e2e-audit-1","name":"web"},"responseStatus":{"code":200},"requestReceivedTimestamp":"2024-01-01T10:00:05.000000Z","annotations":{"authorization.k8s.io/decision":"allow"}}
+`
+
+func TestAuditEventMatcher(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		matcher    *AuditEventMatcher
+		mismatches []string
+	}{{
+		name:    "empty matcher matches everything",
+		matcher: &AuditEventMatcher{},
+	}, {
+		name: "partial",
+		matcher: &AuditEventMatcher{
+			Verb:          "create",
+			RequestURI:    regexp.MustCompile(`^/api/v1/namespaces/e2e-audit-\d+/pods$`),
+			User:          Exact("alice"),
+			Groups:        []string{"system:masters"},
+			RequestObject: Bool(true),
+		},
+	}, {
+		name: "admission webhook annotations",
+		matcher: &AuditEventMatcher{
+			AdmissionWebhookMutationAnnotations: map[string]*regexp.Regexp{
+				"mutation.webhook.admission.k8s.io/round_0_index_0": regexp.MustCompile(`"mutated":true`),
+			},
+			AdmissionWebhookPatchAnnotations: map[string]*regexp.Regexp{
+				"patch.webhook.admission.k8s.io/round_0_index_0": nil,
+			},
+		},
+	}, {
+		name: "mismatches",
+		matcher: &AuditEventMatcher{
+			Verb:           "update",
+			User:           Exact("ali"),
+			Groups:         []string{"Emergency"},
+			RequestObject:  Bool(true),
+			ResponseObject: Bool(true),
+			AdmissionWebhookPatchAnnotations: map[string]*regexp.Regexp{
+				"patch.webhook.admission.k8s.io/round_1_index_0": nil,
+				"patch.webhook.admission.k8s.io/round_0_index_0": regexp.MustCompile("MergePatch"),
+			},
+		},
+		mismatches: []string{
+			`verb: expected "update", got "create"`,
+			`user: expected to match "^ali$", got "alice"`,
+			`groups: expected to contain "Emergency", got [system:masters system:authenticated]`,
+			`responseObject: expected true, got false`,
+			`patch annotation patch.webhook.admission.k8s.io/round_0_index_0: expected to match "MergePatch", got "{\"configuration\":\"pod-defaults\",\"webhook\":\"pod-defaults.zalando.org\",\"patchType\":\"JSONPatch\"}"`,
+			`patch annotation patch.webhook.admission.k8s.io/round_1_index_0: missing`,
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			report, err := CheckAuditExpectations(strings.NewReader(testAuditLog), []AuditExpectation{tc.matcher}, auditv1.SchemeGroupVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.mismatches == nil {
+				if len(report.MissingEvents) > 0 {
+					t.Fatalf("unexpected missing events: %s", report)
+				}
+				return
+			}
+
+			if len(report.MissingEvents) != 1 {
+				t.Fatalf("expected a missing event, got: %s", report)
+			}
+			missing := report.MissingEvents[0]
+			if missing.Closest == nil || missing.Closest.Verb != "create" {
+				t.Errorf("expected the create event as closest candidate, got %v", missing.Closest)
+			}
+			if !reflect.DeepEqual(missing.Mismatches, tc.mismatches) {
+				t.Errorf("expected mismatches:\n%s\ngot:\n%s", strings.Join(tc.mismatches, "\n"), strings.Join(missing.Mismatches, "\n"))
+			}
+		})
+	}
+}
+
+func TestCheckAuditLines(t *testing.T) {
+	deleted := AuditEvent{
+		Level:      auditinternal.LevelRequest,
+		Stage:      auditinternal.StageResponseComplete,
+		RequestURI: "/api/v1/namespaces/e2e-audit-1/pods/web",
+		Verb:       "delete",
+		Code:       200,
+		User: authnv1.UserInfo{
+			Username: "bob",
+			Groups:   []string{"system:authenticated"},
+		},
+		ImpersonatedUser:   "carol",
+		ImpersonatedGroups: "Emergency,system:authenticated",
+		Resource:           "pods",
+		Namespace:          "e2e-audit-1",
+		AuthorizeDecision:  "allow",
+	}
+
+	// exact expectations ignore the annotations unless they're set
+	report, err := CheckAuditLines(strings.NewReader(testAuditLog), []AuditEvent{deleted}, auditv1.SchemeGroupVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.MissingEvents) > 0 {
+		t.Fatalf("unexpected missing events: %s", report)
+	}
+
+	notDeleted := deleted
+	notDeleted.Code = 404
+	report, err = CheckAuditLines(strings.NewReader(testAuditLog), []AuditEvent{notDeleted}, auditv1.SchemeGroupVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.NumEventsChecked != 2 || len(report.MissingEvents) != 1 {
+		t.Fatalf("expected one missing event of two checked, got: %s", report)
+	}
+
+	expected := `missing 1 of the expected events, checked 2 events from 2024-01-01T10:00:00Z to 2024-01-01T10:00:05Z
+
+- missing: delete /api/v1/namespaces/e2e-audit-1/pods/web 404 by bob (Request/ResponseComplete) as carol [Emergency,system:authenticated]
+  closest: delete /api/v1/namespaces/e2e-audit-1/pods/web 200 by bob (Request/ResponseComplete) as carol [Emergency,system:authenticated]
+    code: expected 404, got 200
+`
+	if report.String() != expected {
+		t.Errorf("expected report:\n%s\ngot:\n%s", expected, report)
+	}
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"slices"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/audit"
+	"k8s.io/apiserver/pkg/audit/policy"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+var (
+	// longRunningVerbs and longRunningSubresources are the requests the API
+	// server treats as long-running, which are logged when the response
+	// starts as well as when it's complete.
+	longRunningVerbs        = []string{"watch", "proxy"}
+	longRunningSubresources = []string{"attach", "exec", "proxy", "log", "portforward"}
+
+	// requestObjectVerbs are the verbs of requests with a body, which is
+	// logged from level Request on.
+	requestObjectVerbs = []string{"create", "update", "patch", "delete", "deletecollection"}
+)
+
+// NewAuditPolicyEvaluator returns the upstream evaluator of the audit
+// policy, e.g. the content of the API server's --audit-policy-file.
+func NewAuditPolicyEvaluator(data []byte) (audit.PolicyRuleEvaluator, error) {
+	p, err := policy.LoadPolicyFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return policy.NewPolicyRuleEvaluator(p), nil
+}
+
+// AuditPolicyEvents returns the events the API server logs for a request with
+// the attributes, one per stage which isn't omitted by the policy. Requests
+// logged at level None have no events. The events don't have an ID, a
+// request URI for resource requests or a response code.
+func AuditPolicyEvents(evaluator audit.PolicyRuleEvaluator, attrs authorizer.Attributes) ([]AuditEvent, error) {
+	config := evaluator.EvaluatePolicyRule(attrs)
+	if config.Level == auditinternal.LevelNone {
+		return nil, nil
+	}
+
+	stages := []auditinternal.Stage{auditinternal.StageRequestReceived}
+	if slices.Contains(longRunningVerbs, attrs.GetVerb()) || slices.Contains(longRunningSubresources, attrs.GetSubresource()) {
+		stages = append(stages, auditinternal.StageResponseStarted)
+	}
+	stages = append(stages, auditinternal.StageResponseComplete)
+
+	var events []AuditEvent
+	for _, stage := range stages {
+		if slices.Contains(config.OmitStages, stage) {
+			continue
+		}
+
+		event, err := testEventFromInternal(auditEventFromAttributes(attrs, config.Level, stage))
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// auditEventFromAttributes returns the event logged for a request with the
+// attributes at the level and stage. The request and response objects are
+// only set to mark that they are logged.
+func auditEventFromAttributes(attrs authorizer.Attributes, level auditinternal.Level, stage auditinternal.Stage) *auditinternal.Event {
+	e := &auditinternal.Event{
+		Level: level,
+		Stage: stage,
+		Verb:  attrs.GetVerb(),
+	}
+
+	if info := attrs.GetUser(); info != nil {
+		e.User = authnv1.UserInfo{
+			Username: info.GetName(),
+			UID:      info.GetUID(),
+			Groups:   info.GetGroups(),
+		}
+		for key, value := range info.GetExtra() {
+			if e.User.Extra == nil {
+				e.User.Extra = map[string]authnv1.ExtraValue{}
+			}
+			e.User.Extra[key] = value
+		}
+	}
+
+	if attrs.IsResourceRequest() {
+		e.ObjectRef = &auditinternal.ObjectReference{
+			Resource:    attrs.GetResource(),
+			Namespace:   attrs.GetNamespace(),
+			Name:        attrs.GetName(),
+			APIGroup:    attrs.GetAPIGroup(),
+			Subresource: attrs.GetSubresource(),
+		}
+	} else {
+		e.RequestURI = attrs.GetPath()
+	}
+
+	// the body is only read after the request was received
+	if level.GreaterOrEqual(auditinternal.LevelRequest) && stage != auditinternal.StageRequestReceived && slices.Contains(requestObjectVerbs, attrs.GetVerb()) {
+		e.RequestObject = &runtime.Unknown{}
+	}
+	if level.GreaterOrEqual(auditinternal.LevelRequestResponse) && stage == auditinternal.StageResponseComplete {
+		e.ResponseObject = &runtime.Unknown{}
+	}
+
+	return e
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+const testAuditPolicy = `
+apiVersion: audit.k8s.io/v1
+kind: Policy
+omitStages: ["RequestReceived"]
+rules:
+- level: None
+  users: ["system:kube-proxy"]
+- level: RequestResponse
+  resources:
+  - group: ""
+    resources: ["pods"]
+- level: Metadata
+  resources:
+  - group: ""
+    resources: ["secrets", "secrets/*"]
+  omitStages: ["ResponseStarted"]
+- level: Request
+`
+
+func TestAuditPolicyEvents(t *testing.T) {
+	evaluator, err := NewAuditPolicyEvaluator([]byte(testAuditPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resource := func(username, verb, resource, subresource string) authorizer.Attributes {
+		return authorizer.AttributesRecord{
+			User:            &user.DefaultInfo{Name: username},
+			ResourceRequest: true,
+			Verb:            verb,
+			Namespace:       "teapot",
+			Resource:        resource,
+			Subresource:     subresource,
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		attrs  authorizer.Attributes
+		events []string
+	}{{
+		name:  "not logged",
+		attrs: resource("system:kube-proxy", "watch", "endpoints", ""),
+	}, {
+		name:   "request and response",
+		attrs:  resource("alice", "create", "pods", ""),
+		events: []string{"RequestResponse/ResponseComplete request=true response=true"},
+	}, {
+		name:   "long-running",
+		attrs:  resource("alice", "watch", "pods", ""),
+		events: []string{"RequestResponse/ResponseStarted request=false response=false", "RequestResponse/ResponseComplete request=false response=true"},
+	}, {
+		name:   "stages omitted by the rule",
+		attrs:  resource("alice", "get", "secrets", "exec"),
+		events: []string{"Metadata/ResponseComplete request=false response=false"},
+	}, {
+		name:   "long-running subresource",
+		attrs:  resource("alice", "create", "nodes", "proxy"),
+		events: []string{"Request/ResponseStarted request=true response=false", "Request/ResponseComplete request=true response=false"},
+	}, {
+		name:   "non-resource request",
+		attrs:  authorizer.AttributesRecord{User: &user.DefaultInfo{Name: "alice"}, Verb: "get", Path: "/version"},
+		events: []string{"Request/ResponseComplete request=false response=false"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			events, err := AuditPolicyEvents(evaluator, tc.attrs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, event := range events {
+				if event.Verb != tc.attrs.GetVerb() || event.User.Username != tc.attrs.GetUser().GetName() || event.Resource != tc.attrs.GetResource() {
+					t.Errorf("unexpected request in event: %s", event)
+				}
+				got = append(got, fmt.Sprintf("%s/%s request=%t response=%t", event.Level, event.Stage, event.RequestObject, event.ResponseObject))
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.events, "\n") {
+				t.Errorf("expected events:\n%s\ngot:\n%s", strings.Join(tc.events, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+}
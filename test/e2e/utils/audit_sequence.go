@@ -0,0 +1,278 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+)
+
+// AuditAssertion is an assertion on a sequence of audit events, e.g. their
+// order or number. Assertions observe the events in the order of the log and
+// keep state, use Reset before checking another log.
+type AuditAssertion interface {
+	// Observe is called with every checked event.
+	Observe(event AuditEvent)
+	// Err returns why the assertion doesn't hold for the observed events.
+	Err() error
+	// Reset forgets all observed events.
+	Reset()
+}
+
+// AuditAssertionReport is the result of checking assertions on an audit log
+type AuditAssertionReport struct {
+	NumEventsChecked int
+	Failures         []error
+}
+
+// String returns a human readable string representation of the report
+func (r *AuditAssertionReport) String() string {
+	if len(r.Failures) == 0 {
+		return fmt.Sprintf("all assertions hold for %d events", r.NumEventsChecked)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d assertions failed for %d events:\n", len(r.Failures), r.NumEventsChecked)
+	for _, failure := range r.Failures {
+		fmt.Fprintf(&b, "\n- %s\n", strings.ReplaceAll(failure.Error(), "\n", "\n  "))
+	}
+	return b.String()
+}
+
+// CheckAuditAssertions checks the assertions on all events of the audit log.
+func CheckAuditAssertions(stream io.Reader, version schema.GroupVersion, assertions ...AuditAssertion) (*AuditAssertionReport, error) {
+	for _, assertion := range assertions {
+		assertion.Reset()
+	}
+
+	n, err := ScanAuditLines(stream, version, func(_ *auditinternal.Event, event AuditEvent) {
+		for _, assertion := range assertions {
+			assertion.Observe(event)
+		}
+	})
+	report := &AuditAssertionReport{NumEventsChecked: n}
+	if err != nil {
+		return report, err
+	}
+
+	for _, assertion := range assertions {
+		if err := assertion.Err(); err != nil {
+			report.Failures = append(report.Failures, err)
+		}
+	}
+	return report, nil
+}
+
+// maxReportedEvents limits the number of events listed in a failure.
+const maxReportedEvents = 5
+
+// InOrder asserts that events matching the expectations occur in the given
+// order, e.g. create before update before delete of the same object. Other
+// events may occur in between.
+func InOrder(expectations ...AuditExpectation) AuditAssertion {
+	a := &orderAssertion{expectations: expectations}
+	a.Reset()
+	return a
+}
+
+type orderAssertion struct {
+	expectations []AuditExpectation
+	// next is the index of the next expectation to match.
+	next int
+	// position is the number of observed events.
+	position int
+	// matched are the positions of the events matching the expectations in
+	// order, early are the first positions of events matching the
+	// expectations before their predecessor.
+	matched []int
+	early   map[int]int
+}
+
+func (a *orderAssertion) Observe(event AuditEvent) {
+	a.position++
+	for i := a.next; i < len(a.expectations); i++ {
+		if len(a.expectations[i].Mismatches(event)) > 0 {
+			continue
+		}
+		if i == a.next {
+			a.matched = append(a.matched, a.position)
+			a.next++
+			return
+		}
+		if _, ok := a.early[i]; !ok {
+			a.early[i] = a.position
+		}
+	}
+}
+
+func (a *orderAssertion) Err() error {
+	if a.next == len(a.expectations) {
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "expected %d events in order, found the first %d", len(a.expectations), a.next)
+	for i, position := range a.matched {
+		fmt.Fprintf(&b, "\n%d. %s: event %d", i+1, a.expectations[i], position)
+	}
+	fmt.Fprintf(&b, "\n%d. %s: not found", a.next+1, a.expectations[a.next])
+	if position, ok := a.early[a.next]; ok {
+		fmt.Fprintf(&b, " after its predecessor, but at event %d before it", position)
+	}
+	return errors.New(b.String())
+}
+
+func (a *orderAssertion) Reset() {
+	a.next = 0
+	a.position = 0
+	a.matched = nil
+	a.early = map[int]int{}
+}
+
+// Exactly asserts that exactly n events match the expectation. For n = 1
+// this catches duplicated events.
+func Exactly(n int, expectation AuditExpectation) AuditAssertion {
+	return &countAssertion{expectation: expectation, min: n, max: n}
+}
+
+// AtLeast asserts that at least n events match the expectation.
+func AtLeast(n int, expectation AuditExpectation) AuditAssertion {
+	return &countAssertion{expectation: expectation, min: n, max: -1}
+}
+
+// Never asserts that no event matches the expectation, e.g. no event with
+// verb delete by a user.
+func Never(expectation AuditExpectation) AuditAssertion {
+	return Exactly(0, expectation)
+}
+
+type countAssertion struct {
+	expectation AuditExpectation
+	// max is negative if unbounded.
+	min, max int
+	matched  []AuditEvent
+	count    int
+}
+
+func (a *countAssertion) Observe(event AuditEvent) {
+	if len(a.expectation.Mismatches(event)) > 0 {
+		return
+	}
+	a.count++
+	if len(a.matched) < maxReportedEvents {
+		a.matched = append(a.matched, event)
+	}
+}
+
+func (a *countAssertion) Err() error {
+	if a.count >= a.min && (a.max < 0 || a.count <= a.max) {
+		return nil
+	}
+
+	expected := fmt.Sprintf("exactly %d", a.min)
+	if a.max < 0 {
+		expected = fmt.Sprintf("at least %d", a.min)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "expected %s events matching %s, got %d", expected, a.expectation, a.count)
+	writeEvents(&b, a.matched, a.count)
+	return errors.New(b.String())
+}
+
+func (a *countAssertion) Reset() {
+	a.matched = nil
+	a.count = 0
+}
+
+// NoDuplicates asserts that no event is logged twice, i.e. there are no two
+// events with the same audit ID and stage.
+func NoDuplicates() AuditAssertion {
+	a := &duplicateAssertion{}
+	a.Reset()
+	return a
+}
+
+type duplicateKey struct {
+	id    types.UID
+	stage auditinternal.Stage
+}
+
+type duplicateAssertion struct {
+	seen       map[duplicateKey]struct{}
+	duplicates []AuditEvent
+	count      int
+}
+
+func (a *duplicateAssertion) Observe(event AuditEvent) {
+	key := duplicateKey{id: event.ID, stage: event.Stage}
+	if _, ok := a.seen[key]; !ok {
+		a.seen[key] = struct{}{}
+		return
+	}
+
+	a.count++
+	if len(a.duplicates) < maxReportedEvents {
+		a.duplicates = append(a.duplicates, event)
+	}
+}
+
+func (a *duplicateAssertion) Err() error {
+	if a.count == 0 {
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "found %d duplicated events", a.count)
+	writeEvents(&b, a.duplicates, a.count)
+	return errors.New(b.String())
+}
+
+func (a *duplicateAssertion) Reset() {
+	a.seen = map[duplicateKey]struct{}{}
+	a.duplicates = nil
+	a.count = 0
+}
+
+// AllOf combines assertions into one which holds if all of them hold.
+func AllOf(assertions ...AuditAssertion) AuditAssertion {
+	return allOf(assertions)
+}
+
+type allOf []AuditAssertion
+
+func (a allOf) Observe(event AuditEvent) {
+	for _, assertion := range a {
+		assertion.Observe(event)
+	}
+}
+
+func (a allOf) Err() error {
+	var errs []error
+	for _, assertion := range a {
+		if err := assertion.Err(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (a allOf) Reset() {
+	for _, assertion := range a {
+		assertion.Reset()
+	}
+}
+
+// writeEvents lists the first events of count.
+func writeEvents(b *strings.Builder, events []AuditEvent, count int) {
+	for _, event := range events {
+		fmt.Fprintf(b, "\n%s %s", event.ID, event)
+	}
+	if count > len(events) {
+		fmt.Fprintf(b, "\n... and %d more", count-len(events))
+	}
+}
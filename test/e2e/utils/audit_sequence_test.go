@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+func testAuditLine(id, verb, uri, user string) string {
+	return fmt.Sprintf(`{"kind":"Event","apiVersion":"audit.k8s.io/v1","level":"Request","auditID":%q,"stage":"ResponseComplete","requestURI":%q,"verb":%q,"user":{"username":%q},"objectRef":{"resource":"pods","namespace":"teapot"},"responseStatus":{"code":200},"requestReceivedTimestamp":"2024-01-01T10:00:00.000000Z"}`, id, uri, verb, user)
+}
+
+func TestCheckAuditAssertions(t *testing.T) {
+	const pod = "/api/v1/namespaces/teapot/pods/web"
+	log := strings.Join([]string{
+		testAuditLine("1", "create", "/api/v1/namespaces/teapot/pods", "alice"),
+		testAuditLine("2", "get", pod, "bob"),
+		testAuditLine("3", "delete", pod, "alice"),
+		testAuditLine("4", "update", pod, "alice"),
+		testAuditLine("4", "update", pod, "alice"),
+	}, "\n")
+
+	verb := func(verb string) *AuditEventMatcher {
+		return &AuditEventMatcher{Verb: verb}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		assertion AuditAssertion
+		failure   string
+	}{{
+		name:      "in order",
+		assertion: InOrder(verb("create"), verb("get"), verb("update")),
+	}, {
+		name:      "out of order",
+		assertion: InOrder(verb("create"), verb("update"), verb("delete")),
+		failure: `expected 3 events in order, found the first 2
+1. {verb=create}: event 1
+2. {verb=update}: event 4
+3. {verb=delete}: not found after its predecessor, but at event 3 before it`,
+	}, {
+		name:      "exact count",
+		assertion: Exactly(2, verb("update")),
+	}, {
+		name:      "duplicated",
+		assertion: Exactly(1, verb("update")),
+		failure: `expected exactly 1 events matching {verb=update}, got 2
+4 update /api/v1/namespaces/teapot/pods/web 200 by alice (Request/ResponseComplete)
+4 update /api/v1/namespaces/teapot/pods/web 200 by alice (Request/ResponseComplete)`,
+	}, {
+		name:      "at least",
+		assertion: AtLeast(3, &AuditEventMatcher{User: Exact("alice")}),
+	}, {
+		name:      "absent",
+		assertion: Never(&AuditEventMatcher{Verb: "delete", User: Exact("bob")}),
+	}, {
+		name:      "not absent",
+		assertion: Never(&AuditEventMatcher{Verb: "delete", User: Exact("alice")}),
+		failure: `expected exactly 0 events matching {verb=delete user=^alice$}, got 1
+3 delete /api/v1/namespaces/teapot/pods/web 200 by alice (Request/ResponseComplete)`,
+	}, {
+		name:      "no duplicates",
+		assertion: NoDuplicates(),
+		failure: `found 1 duplicated events
+4 update /api/v1/namespaces/teapot/pods/web 200 by alice (Request/ResponseComplete)`,
+	}, {
+		name:      "all of",
+		assertion: AllOf(Exactly(1, verb("create")), Never(verb("patch"))),
+	}, {
+		name:      "all of failing",
+		assertion: AllOf(Exactly(1, verb("create")), AtLeast(1, verb("patch"))),
+		failure:   `expected at least 1 events matching {verb=patch}, got 0`,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			// checking twice verifies that the assertions are reset
+			for i := 0; i < 2; i++ {
+				report, err := CheckAuditAssertions(strings.NewReader(log), auditv1.SchemeGroupVersion, tc.assertion)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if report.NumEventsChecked != 5 {
+					t.Errorf("expected 5 events checked, got %d", report.NumEventsChecked)
+				}
+
+				if tc.failure == "" {
+					if len(report.Failures) > 0 {
+						t.Fatalf("unexpected failure: %s", report)
+					}
+					continue
+				}
+
+				if len(report.Failures) != 1 {
+					t.Fatalf("expected one failure, got: %s", report)
+				}
+				if failure := report.Failures[0].Error(); failure != tc.failure {
+					t.Errorf("expected failure:\n%s\ngot:\n%s", tc.failure, failure)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/apiserver/pkg/audit"
+	"k8s.io/client-go/rest"
+)
+
+// AuditSource provides audit events in the order they were logged, e.g. an
+// AuditLogFollower or an AuditWebhookReceiver.
+type AuditSource interface {
+	// Next calls observe with every event logged since the last call.
+	Next(ctx context.Context, observe func(*auditinternal.Event, AuditEvent)) error
+}
+
+// APIServerAuditSource returns a source of the audit log served by the API
+// server at path, e.g. /logs/kube-audit.log.
+func APIServerAuditSource(client *rest.RESTClient, path string) AuditSource {
+	return NewAuditLogFollower(APIServerAuditLog(client, path), auditv1.SchemeGroupVersion)
+}
+
+// FileAuditSource returns a source of the audit log file at path.
+func FileAuditSource(path string) AuditSource {
+	return NewAuditLogFollower(FileAuditLog(path), auditv1.SchemeGroupVersion)
+}
+
+// AuditWebhookReceiver is an audit webhook backend. It accepts the
+// audit.k8s.io/v1 EventLists POSTed by the API server and provides their
+// events as an AuditSource.
+type AuditWebhookReceiver struct {
+	mu     sync.Mutex
+	events []*auditinternal.Event
+	// next is the index of the first event not returned by Next yet.
+	next int
+}
+
+// NewAuditWebhookReceiver returns a receiver without events.
+func NewAuditWebhookReceiver() *AuditWebhookReceiver {
+	return &AuditWebhookReceiver{}
+}
+
+func (r *AuditWebhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list := &auditinternal.EventList{}
+	if err := runtime.DecodeInto(audit.Codecs.UniversalDecoder(auditv1.SchemeGroupVersion), body, list); err != nil {
+		http.Error(w, fmt.Sprintf("failed decoding event list: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range list.Items {
+		r.events = append(r.events, &list.Items[i])
+	}
+}
+
+// Next calls observe with every event received since the last call.
+func (r *AuditWebhookReceiver) Next(_ context.Context, observe func(*auditinternal.Event, AuditEvent)) error {
+	r.mu.Lock()
+	events := r.events[r.next:]
+	r.next = len(r.events)
+	r.mu.Unlock()
+
+	for _, e := range events {
+		event, err := testEventFromInternal(e)
+		if err != nil {
+			return err
+		}
+		observe(e, event)
+	}
+	return nil
+}
+
+// CheckAuditSource checks the events provided by the source once for the
+// expected events.
+func CheckAuditSource(ctx context.Context, source AuditSource, expected []AuditExpectation) (*MissingEventsReport, error) {
+	expectations := newAuditEventTracker(expected)
+
+	report := &MissingEventsReport{}
+	err := source.Next(ctx, report.observe(expectations))
+	report.MissingEvents = expectations.Missing()
+	return report, err
+}
+
+// WaitForAuditEvents reads the source every interval until all expected events
+// are found or ctx is done.
+func WaitForAuditEvents(ctx context.Context, source AuditSource, interval time.Duration, expected []AuditExpectation) (*MissingEventsReport, error) {
+	expectations := newAuditEventTracker(expected)
+
+	report := &MissingEventsReport{}
+	err := pollAuditSource(ctx, source, interval, report.observe(expectations), func() bool {
+		report.MissingEvents = expectations.Missing()
+		return len(report.MissingEvents) == 0
+	})
+	return report, err
+}
+
+// observe returns a function marking the expected events and recording the
+// checked events in the report.
+func (m *MissingEventsReport) observe(expectations *auditEventTracker) func(*auditinternal.Event, AuditEvent) {
+	return func(e *auditinternal.Event, event AuditEvent) {
+		if m.FirstEventChecked == nil {
+			m.FirstEventChecked = e
+		}
+		m.LastEventChecked = e
+		m.NumEventsChecked++
+		expectations.Mark(event)
+	}
+}
+
+// WaitForAuditAssertions reads the source every interval until all assertions
+// hold or ctx is done. Assertions on the number of events, e.g. Exactly or
+// Never, can be violated by events logged later, so once all assertions hold
+// the source is read for settle longer, e.g. a flush interval of the log. It
+// fails as soon as an assertion doesn't hold anymore.
+func WaitForAuditAssertions(ctx context.Context, source AuditSource, interval, settle time.Duration, assertions ...AuditAssertion) (*AuditAssertionReport, error) {
+	for _, assertion := range assertions {
+		assertion.Reset()
+	}
+
+	var held time.Time
+	report := &AuditAssertionReport{}
+	err := pollAuditSource(ctx, source, interval, func(_ *auditinternal.Event, event AuditEvent) {
+		report.NumEventsChecked++
+		for _, assertion := range assertions {
+			assertion.Observe(event)
+		}
+	}, func() bool {
+		report.Failures = nil
+		for _, assertion := range assertions {
+			if err := assertion.Err(); err != nil {
+				report.Failures = append(report.Failures, err)
+			}
+		}
+		if len(report.Failures) > 0 {
+			return !held.IsZero()
+		}
+		if held.IsZero() {
+			held = time.Now()
+		}
+		return time.Since(held) >= settle
+	})
+	if err == nil && len(report.Failures) > 0 {
+		return report, fmt.Errorf("assertions stopped holding %s after they held", time.Since(held).Round(time.Millisecond))
+	}
+	return report, err
+}
+
+// pollAuditSource reads the source every interval until done returns true.
+// Errors reading the source are retried until ctx is done.
+func pollAuditSource(ctx context.Context, source AuditSource, interval time.Duration, observe func(*auditinternal.Event, AuditEvent), done func() bool) error {
+	var lastErr error
+	err := wait.PollUntilContextCancel(ctx, interval, true, func(ctx context.Context) (bool, error) {
+		lastErr = source.Next(ctx, observe)
+		return lastErr == nil && done(), nil
+	})
+	if err != nil && lastErr != nil {
+		return fmt.Errorf("%w: %w", err, lastErr)
+	}
+	return err
+}
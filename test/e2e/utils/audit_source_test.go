@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+)
+
+func postAuditEvents(t *testing.T, url string, lines ...string) *http.Response {
+	body := `{"kind":"EventList","apiVersion":"audit.k8s.io/v1","items":[` + strings.Join(lines, ",") + `]}`
+	rsp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	return rsp
+}
+
+func TestAuditSources(t *testing.T) {
+	const pod = "/api/v1/namespaces/teapot/pods/web"
+	first := []string{
+		testAuditLine("1", "create", "/api/v1/namespaces/teapot/pods", "alice"),
+		testAuditLine("2", "get", pod, "bob"),
+	}
+	second := []string{
+		testAuditLine("3", "delete", pod, "alice"),
+	}
+
+	file := filepath.Join(t.TempDir(), "kube-audit.log")
+	appendFile := func(lines ...string) {
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		for _, line := range lines {
+			if _, err := f.WriteString(line + "\n"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	receiver := NewAuditWebhookReceiver()
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name   string
+		source AuditSource
+		log    func(lines ...string)
+	}{{
+		name:   "file",
+		source: FileAuditSource(file),
+		log:    appendFile,
+	}, {
+		name:   "webhook",
+		source: receiver,
+		log: func(lines ...string) {
+			if rsp := postAuditEvents(t, server.URL, lines...); rsp.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status %s", rsp.Status)
+			}
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.log(first...)
+
+			report, err := CheckAuditSource(context.Background(), tc.source, []AuditExpectation{
+				&AuditEventMatcher{Verb: "create", User: Exact("alice")},
+				&AuditEventMatcher{Verb: "delete"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.NumEventsChecked != 2 || len(report.MissingEvents) != 1 || report.MissingEvents[0].Closest == nil {
+				t.Fatalf("expected the delete to be missing after 2 events, got: %s", report)
+			}
+
+			// only the new events are provided
+			tc.log(second...)
+			var verbs []string
+			err = tc.source.Next(context.Background(), func(_ *auditinternal.Event, event AuditEvent) {
+				verbs = append(verbs, event.Verb)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(verbs, ",") != "delete" {
+				t.Errorf("expected only the delete, got %v", verbs)
+			}
+		})
+	}
+}
+
+func TestAuditWebhookReceiverErrors(t *testing.T) {
+	server := httptest.NewServer(NewAuditWebhookReceiver())
+	defer server.Close()
+
+	rsp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be rejected, got %s", rsp.Status)
+	}
+
+	if rsp := postAuditEvents(t, server.URL, `{"kind":"Event","apiVersion":"audit.k8s.io/v1","stage":1}`); rsp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected invalid events to be rejected, got %s", rsp.Status)
+	}
+}
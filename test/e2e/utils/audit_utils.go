@@ -18,11 +18,13 @@ package utils
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"reflect"
 	"sort"
 	"strings"
+	"time"
 
 	authnv1 "k8s.io/api/authentication/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -61,68 +63,161 @@ type MissingEventsReport struct {
 	FirstEventChecked *auditinternal.Event
 	LastEventChecked  *auditinternal.Event
 	NumEventsChecked  int
-	MissingEvents     []AuditEvent
+	MissingEvents     []MissingEvent
+}
+
+// MissingEvent is an expected event which wasn't found, with the checked
+// event closest to it.
+type MissingEvent struct {
+	Expected AuditExpectation
+	// Closest is the checked event with the fewest mismatches, nil if no
+	// event was checked.
+	Closest    *AuditEvent
+	Mismatches []string
 }
 
 // String returns a human readable string representation of the report
 func (m *MissingEventsReport) String() string {
-	return fmt.Sprintf(`missing %d events
-
-- first event checked: %#v
-
-- last event checked: %#v
-
-- number of events checked: %d
+	var b strings.Builder
+	fmt.Fprintf(&b, "missing %d of the expected events, checked %d events", len(m.MissingEvents), m.NumEventsChecked)
+	if m.FirstEventChecked != nil {
+		fmt.Fprintf(&b, " from %s to %s", m.FirstEventChecked.RequestReceivedTimestamp.Format(time.RFC3339), m.LastEventChecked.RequestReceivedTimestamp.Format(time.RFC3339))
+	}
+	b.WriteString("\n")
 
-- missing events: %#v`, len(m.MissingEvents), m.FirstEventChecked, m.LastEventChecked, m.NumEventsChecked, m.MissingEvents)
+	for _, missing := range m.MissingEvents {
+		fmt.Fprintf(&b, "\n- missing: %s\n", missing.Expected)
+		if missing.Closest == nil {
+			continue
+		}
+		fmt.Fprintf(&b, "  closest: %s\n", missing.Closest)
+		for _, mismatch := range missing.Mismatches {
+			fmt.Fprintf(&b, "    %s\n", mismatch)
+		}
+	}
+	return b.String()
 }
 
 // CheckAuditLines searches the audit log for the expected audit lines.
 func CheckAuditLines(stream io.Reader, expected []AuditEvent, version schema.GroupVersion) (missingReport *MissingEventsReport, err error) {
+	return CheckAuditExpectations(stream, AuditEventExpectations(expected), version)
+}
+
+// CheckAuditExpectations searches the audit log for events matching the
+// expectations, e.g. AuditEventMatchers.
+func CheckAuditExpectations(stream io.Reader, expected []AuditExpectation, version schema.GroupVersion) (missingReport *MissingEventsReport, err error) {
 	expectations := newAuditEventTracker(expected)
 
+	missingReport = &MissingEventsReport{
+		MissingEvents: expectations.Missing(),
+	}
+
+	n, err := ScanAuditLines(stream, version, func(e *auditinternal.Event, event AuditEvent) {
+		if missingReport.FirstEventChecked == nil {
+			missingReport.FirstEventChecked = e
+		}
+		missingReport.LastEventChecked = e
+
+		expectations.Mark(event)
+	})
+	if err != nil {
+		return missingReport, err
+	}
+
+	missingReport.MissingEvents = expectations.Missing()
+	missingReport.NumEventsChecked = n
+	return missingReport, nil
+}
+
+// maxAuditLineInError is the number of bytes of an audit log line included
+// in an error.
+const maxAuditLineInError = 200
+
+// AuditLineError is the error of an audit log line which couldn't be decoded,
+// e.g. the incomplete last line of a log being written.
+type AuditLineError struct {
+	// Line is the number of the line, starting at 1.
+	Line    int
+	Version schema.GroupVersion
+	Err     error
+	// content is the start of the line.
+	content string
+}
+
+func (e *AuditLineError) Error() string {
+	return fmt.Sprintf("failed decoding line %d: %s, apiVersion: %s: %v", e.Line, e.content, e.Version, e.Err)
+}
+
+func (e *AuditLineError) Unwrap() error {
+	return e.Err
+}
+
+// truncateAuditLine returns the start of an audit log line for an error.
+func truncateAuditLine(line []byte) string {
+	line = bytes.TrimSpace(line)
+	if len(line) <= maxAuditLineInError {
+		return string(line)
+	}
+	return fmt.Sprintf("%s... (%d bytes)", line[:maxAuditLineInError], len(line))
+}
+
+// ScanAuditLines decodes the audit events in the log and calls observe with
+// every event in the order of the log. It returns the number of events, and
+// fails with an *AuditLineError on the first line which can't be decoded.
+func ScanAuditLines(stream io.Reader, version schema.GroupVersion, observe func(*auditinternal.Event, AuditEvent)) (int, error) {
+	return scanAuditLines(stream, version, observe, func(err *AuditLineError) error { return err })
+}
+
+// ScanAuditLinesSkipping is like ScanAuditLines, but calls skip with the
+// error of every line which can't be decoded and continues with the next
+// line.
+func ScanAuditLinesSkipping(stream io.Reader, version schema.GroupVersion, observe func(*auditinternal.Event, AuditEvent), skip func(*AuditLineError)) (int, error) {
+	return scanAuditLines(stream, version, observe, func(err *AuditLineError) error {
+		skip(err)
+		return nil
+	})
+}
+
+// scanAuditLines decodes the audit events in the log. The lines which can't
+// be decoded are passed to invalid, which stops the scan if it returns an
+// error.
+func scanAuditLines(stream io.Reader, version schema.GroupVersion, observe func(*auditinternal.Event, AuditEvent), invalid func(*AuditLineError) error) (int, error) {
 	scanner := bufio.NewScanner(stream)
 
 	buf := make([]byte, 10487560)
 	scanner.Buffer(buf, cap(buf))
 
-	missingReport = &MissingEventsReport{
-		MissingEvents: expected,
-	}
-
-	var i int
-	for i = 0; scanner.Scan(); i++ {
-		line := scanner.Text()
+	decoder := audit.Codecs.UniversalDecoder(version)
 
+	events := 0
+	for line := 1; scanner.Scan(); line++ {
 		e := &auditinternal.Event{}
-		decoder := audit.Codecs.UniversalDecoder(version)
-		if err := runtime.DecodeInto(decoder, []byte(line), e); err != nil {
-			return missingReport, fmt.Errorf("failed decoding buf: %s, apiVersion: %s", line, version)
-		}
-		if i == 0 {
-			missingReport.FirstEventChecked = e
-		}
-		missingReport.LastEventChecked = e
+		err := runtime.DecodeInto(decoder, scanner.Bytes(), e)
 
-		event, err := testEventFromInternal(e)
+		var event AuditEvent
+		if err == nil {
+			event, err = testEventFromInternal(e)
+		}
 		if err != nil {
-			return missingReport, err
+			if err := invalid(&AuditLineError{Line: line, Version: version, Err: err, content: truncateAuditLine(scanner.Bytes())}); err != nil {
+				return events, err
+			}
+			continue
 		}
 
-		expectations.Mark(event)
+		events++
+		observe(e, event)
 	}
 	if err := scanner.Err(); err != nil {
-		return missingReport, err
+		return events, err
 	}
 
-	missingReport.MissingEvents = expectations.Missing()
-	missingReport.NumEventsChecked = i
-	return missingReport, nil
+	return events, nil
 }
 
 // CheckAuditList searches an audit event list for the expected audit events.
 func CheckAuditList(el auditinternal.EventList, expected []AuditEvent) (missing []AuditEvent, err error) {
-	expectations := newAuditEventTracker(expected)
+	expectations := newAuditEventTracker(AuditEventExpectations(expected))
 
 	for _, e := range el.Items {
 		event, err := testEventFromInternal(&e)
@@ -133,7 +228,20 @@ func CheckAuditList(el auditinternal.EventList, expected []AuditEvent) (missing
 		expectations.Mark(event)
 	}
 
-	return expectations.Missing(), nil
+	for _, m := range expectations.Missing() {
+		missing = append(missing, m.Expected.(AuditEvent))
+	}
+	return missing, nil
+}
+
+// AuditEventExpectations returns the events as expectations matching all
+// fields, e.g. to check them against an AuditSource.
+func AuditEventExpectations(events []AuditEvent) []AuditExpectation {
+	expectations := make([]AuditExpectation, 0, len(events))
+	for _, event := range events {
+		expectations = append(expectations, event)
+	}
+	return expectations
 }
 
 // CheckForDuplicates checks a list for duplicate events
@@ -147,7 +255,6 @@ func CheckForDuplicates(el auditinternal.EventList) (auditinternal.EventList, er
 		if err != nil {
 			return duplicates, err
 		}
-		event.ID = e.AuditID
 		for _, existing := range existingEvents {
 			if reflect.DeepEqual(existing, event) {
 				duplicates.Items = append(duplicates.Items, e)
@@ -163,6 +270,7 @@ func CheckForDuplicates(el auditinternal.EventList) (auditinternal.EventList, er
 // testEventFromInternal takes an internal audit event and returns a test event
 func testEventFromInternal(e *auditinternal.Event) (AuditEvent, error) {
 	event := AuditEvent{
+		ID:         e.AuditID,
 		Level:      e.Level,
 		Stage:      e.Stage,
 		RequestURI: e.RequestURI,
@@ -204,10 +312,13 @@ func testEventFromInternal(e *auditinternal.Event) (AuditEvent, error) {
 	return event, nil
 }
 
-// auditEvent is a private wrapper on top of AuditEvent used by auditEventTracker
+// auditEvent is a private wrapper on top of an AuditExpectation used by
+// auditEventTracker
 type auditEvent struct {
-	event AuditEvent
-	found bool
+	expected   AuditExpectation
+	found      bool
+	closest    *AuditEvent
+	mismatches []string
 }
 
 // auditEventTracker keeps track of AuditEvent expectations and marks matching events as found
@@ -216,33 +327,48 @@ type auditEventTracker struct {
 }
 
 // newAuditEventTracker creates a tracker that tracks whether expect events are found
-func newAuditEventTracker(expected []AuditEvent) *auditEventTracker {
+func newAuditEventTracker(expected []AuditExpectation) *auditEventTracker {
 	expectations := &auditEventTracker{events: []*auditEvent{}}
 	for _, event := range expected {
-		// we copy the references to the maps in event
-		expectations.events = append(expectations.events, &auditEvent{event: event, found: false})
+		expectations.events = append(expectations.events, &auditEvent{expected: event, found: false})
 	}
 	return expectations
 }
 
-// Mark marks the given event as found if it's expected
+// Mark marks the given event as found if it's expected, otherwise it's
+// remembered if it's the closest candidate of an expectation so far.
 func (t *auditEventTracker) Mark(event AuditEvent) {
-	// reset Annotation maps as we don't want to compare those
-	event.AdmissionWebhookMutationAnnotations = nil
-	event.AdmissionWebhookPatchAnnotations = nil
 	for _, e := range t.events {
-		if reflect.DeepEqual(e.event, event) {
+		if e.found {
+			continue
+		}
+
+		mismatches := e.expected.Mismatches(event)
+		if len(mismatches) == 0 {
 			e.found = true
+			e.closest = nil
+			e.mismatches = nil
+			continue
+		}
+
+		if e.closest == nil || len(mismatches) < len(e.mismatches) {
+			closest := event
+			e.closest = &closest
+			e.mismatches = mismatches
 		}
 	}
 }
 
 // Missing reports events that are expected but not found
-func (t *auditEventTracker) Missing() []AuditEvent {
-	var missing []AuditEvent
+func (t *auditEventTracker) Missing() []MissingEvent {
+	var missing []MissingEvent
 	for _, e := range t.events {
 		if !e.found {
-			missing = append(missing, e.event)
+			missing = append(missing, MissingEvent{
+				Expected:   e.expected,
+				Closest:    e.closest,
+				Mismatches: e.mismatches,
+			})
 		}
 	}
 	return missing
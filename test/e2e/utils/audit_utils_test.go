@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+func TestScanAuditLines(t *testing.T) {
+	const pod = "/api/v1/namespaces/teapot/pods/web"
+	huge := `{"kind":"Event","apiVersion":"audit.k8s.io/v1","requestURI":"` + strings.Repeat("x", 100000)
+	log := strings.Join([]string{
+		testAuditLine("1", "create", pod, "alice"),
+		huge,
+		testAuditLine("2", "get", pod, "alice"),
+		"not an event",
+	}, "\n")
+
+	var verbs []string
+	observe := func(_ *auditinternal.Event, event AuditEvent) {
+		verbs = append(verbs, event.Verb)
+	}
+
+	n, err := ScanAuditLines(strings.NewReader(log), auditv1.SchemeGroupVersion, observe)
+	var lineErr *AuditLineError
+	if !errors.As(err, &lineErr) || lineErr.Line != 2 || n != 1 {
+		t.Fatalf("expected the scan to fail on line 2 after 1 event, got %d: %v", n, err)
+	}
+	if msg := err.Error(); len(msg) > 1000 || !strings.Contains(msg, "(100061 bytes)") {
+		t.Errorf("expected a truncated line in the error, got %q", msg)
+	}
+
+	verbs = nil
+	var skipped []int
+	n, err = ScanAuditLinesSkipping(strings.NewReader(log), auditv1.SchemeGroupVersion, observe, func(err *AuditLineError) {
+		skipped = append(skipped, err.Line)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || strings.Join(verbs, ",") != "create,get" {
+		t.Errorf("expected the create and the get, got %d: %v", n, verbs)
+	}
+	if len(skipped) != 2 || skipped[0] != 2 || skipped[1] != 4 {
+		t.Errorf("expected lines 2 and 4 to be skipped, got %v", skipped)
+	}
+}